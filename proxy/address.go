@@ -0,0 +1,149 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	addressViewFlat     = "flat"
+	addressViewDetailed = "detailed"
+)
+
+// AddressDetails is the structured form of an address, the same for every
+// provider. Providers fill in what they know, the rest stays empty.
+//
+// swagger:model addressDetails
+type AddressDetails struct {
+	// example: Россия
+	Country string `json:"country,omitempty"`
+	// ISO 3166 alpha-2 code
+	//
+	// example: RU
+	CountryISO string `json:"country_iso,omitempty"`
+	// example: г Москва
+	Region string `json:"region,omitempty"`
+	// example: г Москва
+	City string `json:"city,omitempty"`
+	// village or other settlement outside a city
+	Settlement string `json:"settlement,omitempty"`
+	// example: ул Сухонская
+	Street string `json:"street,omitempty"`
+	// house number with its block, if any
+	//
+	// example: д 11
+	House string `json:"house,omitempty"`
+	// example: кв 1
+	Flat string `json:"flat,omitempty"`
+	// example: 127642
+	PostalCode string `json:"postal_code,omitempty"`
+	// FIAS code of the most detailed known part of the address
+	//
+	// example: f26b876b-6857-4951-b060-ec6559f04a9a
+	FiasID string `json:"fias_id,omitempty"`
+	// FIAS level of that part: 1 region ... 8 house, 9 flat
+	//
+	// example: 8
+	FiasLevel string `json:"fias_level,omitempty"`
+	// KLADR code
+	//
+	// example: 7700000000028360004
+	KladrID string `json:"kladr_id,omitempty"`
+	// example: 45280583000
+	OKATO string `json:"okato,omitempty"`
+	// example: 45362000
+	OKTMO string `json:"oktmo,omitempty"`
+	// precision of the coordinates: 0 exact house ... 4 city, 5 not found
+	//
+	// example: 0
+	QualityGeo *int `json:"qc_geo,omitempty"`
+	// whether the address was recognised: 0 sure ... 3 guessed
+	Quality *int `json:"qc,omitempty"`
+	// whether the address is complete enough for delivery
+	QualityComplete *int `json:"qc_complete,omitempty"`
+	// whether the house is known
+	QualityHouse *int `json:"qc_house,omitempty"`
+	// example: UTC+3
+	Timezone string `json:"timezone,omitempty"`
+	// OpenStreetMap identifier, as type and id
+	//
+	// example: W123456
+	OSMID string `json:"osm_id,omitempty"`
+}
+
+// addressView picks the shape of the addresses in a response: detailed when
+// asked for with ?view=detailed or an Accept header with profile="detailed",
+// flat otherwise.
+func addressView(r *http.Request) string {
+	if v := r.URL.Query().Get("view"); v != "" {
+		if v == addressViewDetailed {
+			return addressViewDetailed
+		}
+		return addressViewFlat
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if _, params, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && params["profile"] == addressViewDetailed {
+			return addressViewDetailed
+		}
+	}
+	return addressViewFlat
+}
+
+// viewAddresses returns addresses in the given view. The flat view drops the
+// details.
+func viewAddresses(addresses []*Address, view string) []*Address {
+	if view == addressViewDetailed {
+		return addresses
+	}
+	return editAddresses(addresses, func(a *Address) { a.Details = nil })
+}
+
+// editAddresses returns copies of addresses changed by edit. Handlers change
+// copies only, as the addresses may be shared with the cache.
+func editAddresses(addresses []*Address, edit func(a *Address)) []*Address {
+	res := make([]*Address, len(addresses))
+	for i, a := range addresses {
+		c := *a
+		edit(&c)
+		res[i] = &c
+	}
+	return res
+}
+
+// qualityCode reads a DaData quality code, which comes as a number, a string or null.
+func qualityCode(v interface{}) *int {
+	var n int
+	switch v := v.(type) {
+	case float64:
+		n = int(v)
+	case int64:
+		n = int(v)
+	case string:
+		var err error
+		if n, err = strconv.Atoi(v); err != nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return &n
+}
+
+// joinNonEmpty joins the non-empty parts with sep.
+func joinNonEmpty(sep string, parts ...string) string {
+	var res []string
+	for _, p := range parts {
+		if p != "" {
+			res = append(res, p)
+		}
+	}
+	return strings.Join(res, sep)
+}
+
+// stringOf returns v when it is a string, DaData sends null for missing parts.
+func stringOf(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_addressView(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		accept string
+		want   string
+	}{
+		{"default", "/", "", addressViewFlat},
+		{"query", "/?view=detailed", "", addressViewDetailed},
+		{"query wins", "/?view=flat", `application/json; profile="detailed"`, addressViewFlat},
+		{"accept", "/", `text/html, application/json;profile=detailed`, addressViewDetailed},
+		{"other profile", "/", `application/json; profile="short"`, addressViewFlat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.url, nil)
+			r.Header.Set("Accept", tt.accept)
+			assert.Equal(t, tt.want, addressView(r))
+		})
+	}
+}
+
+func Test_viewAddresses(t *testing.T) {
+	addresses := []*Address{{Address: "г Москва", Details: &AddressDetails{City: "г Москва"}}}
+	flat := viewAddresses(addresses, addressViewFlat)
+	assert.Nil(t, flat[0].Details)
+	assert.NotNil(t, addresses[0].Details, "the original keeps its details")
+	assert.Equal(t, addresses, viewAddresses(addresses, addressViewDetailed))
+}
+
+func TestDaDataProvider_details(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Secret") == "" {
+			fmt.Fprint(w, mockResGeo)
+			return
+		}
+		fmt.Fprint(w, `[{"result":"г Москва, ул Сухонская, д 11 к 2, кв 5","country":"Россия","country_iso_code":"RU",
+			"region_with_type":"г Москва","city_with_type":"г Москва","street_with_type":"ул Сухонская",
+			"house_type":"д","house":"11","block_type":"к","block":"2","flat_type":"кв","flat":"5","postal_code":"127642",
+			"fias_id":"5ee84ac0","fias_level":"9","kladr_id":"7700000000028360004","timezone":"UTC+3",
+			"qc_geo":0,"qc":0,"qc_complete":5,"qc_house":2}]`)
+	}))
+	defer ts.Close()
+
+	p := NewDaDataProvider(DaDataConfig{SearchURL: ts.URL, GeocodeURL: ts.URL, Credentials: []DaDataCredential{{Token: "t", Secret: "s"}}})
+	zero, two, five := 0, 2, 5
+
+	got, err := p.Search(context.Background(), "Сухонская 11к2 кв 5")
+	assert.NoError(t, err)
+	assert.Equal(t, &AddressDetails{
+		Country: "Россия", CountryISO: "RU", Region: "г Москва", City: "г Москва", Street: "ул Сухонская",
+		House: "д 11 к 2", Flat: "кв 5", PostalCode: "127642", FiasID: "5ee84ac0", FiasLevel: "9", KladrID: "7700000000028360004",
+		QualityGeo: &zero, Quality: &zero, QualityComplete: &five, QualityHouse: &two, Timezone: "UTC+3",
+	}, got[0].Details)
+
+	got, err = p.Reverse(context.Background(), 55.878, 37.653)
+	assert.NoError(t, err)
+	assert.Equal(t, &AddressDetails{
+		Country: "Россия", CountryISO: "RU", Region: "г Москва", City: "г Москва", Street: "ул Сухонская",
+		House: "д 11", PostalCode: "127642", FiasID: "5ee84ac0-eb9a-4b42-b814-2f5f7c27c255", FiasLevel: "8", KladrID: "7700000000028360004",
+		OKATO: "45280583000", OKTMO: "45362000", QualityGeo: &zero,
+	}, got[0].Details)
+}
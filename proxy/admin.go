@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// adminWriteMu serializes the admin changes to users, so that no two of them
+// both find another enabled admin left and then take away one each.
+var adminWriteMu sync.Mutex
+
+// swagger:model adminUser
+type adminUser struct {
+	// user login
+	//
+	// example: user1
+	Login string `json:"login"`
+	// user roles
+	//
+	// example: ["user"]
+	Roles []string `json:"roles"`
+	// scopes granted on top of the roles
+	//
+	// example: ["address:search"]
+	Scopes []string `json:"scopes"`
+	// disabled accounts can not log in or use issued tokens
+	Disabled bool `json:"disabled"`
+}
+
+// swagger:model adminUserList
+type adminUserList struct {
+	// users of the requested page ordered by login
+	Users []adminUser `json:"users"`
+	// total number of users
+	//
+	// example: 42
+	Total int `json:"total"`
+	// example: 0
+	Offset int `json:"offset"`
+	// example: 20
+	Limit int `json:"limit"`
+}
+
+// swagger:model adminUserCreate
+type adminUserCreate struct {
+	// user login
+	//
+	// required: true
+	// example: user1
+	Login string `json:"login"`
+	// user password
+	//
+	// required: true
+	// example: qwerty
+	Password string `json:"password"`
+	// user roles, "user" when empty
+	//
+	// example: ["user"]
+	Roles []string `json:"roles"`
+	// scopes granted on top of the roles
+	//
+	// example: ["address:search"]
+	Scopes []string `json:"scopes"`
+}
+
+// swagger:model adminUserPatch
+type adminUserPatch struct {
+	// new roles, unchanged when omitted
+	//
+	// example: ["user", "admin"]
+	Roles *[]string `json:"roles"`
+	// new scopes, unchanged when omitted
+	//
+	// example: []
+	Scopes *[]string `json:"scopes"`
+	// disable or enable the account, unchanged when omitted
+	//
+	// example: true
+	Disabled *bool `json:"disabled"`
+}
+
+// swagger:model passwordResetRequest
+type passwordResetRequest struct {
+	// new password
+	//
+	// required: true
+	// example: n3w-pa55word
+	Password string `json:"password"`
+}
+
+func newAdminUser(u User) adminUser {
+	roles, scopes := u.Roles, u.Scopes
+	if roles == nil {
+		roles = []string{}
+	}
+	if scopes == nil {
+		scopes = []string{}
+	}
+	return adminUser{Login: u.Login, Roles: roles, Scopes: scopes, Disabled: u.Disabled}
+}
+
+func handleAdminListUsers(w http.ResponseWriter, r *http.Request) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeError(w, "bad request: invalid offset", http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultPageLimit)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		writeError(w, "bad request: limit must be between 1 and "+strconv.Itoa(maxPageLimit), http.StatusBadRequest)
+		return
+	}
+
+	users, total, err := userRepo.List(r.Context(), offset, limit)
+	if err != nil {
+		log.Printf("admin.go: list users: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	res := adminUserList{Users: make([]adminUser, len(users)), Total: total, Offset: offset, Limit: limit}
+	for i, u := range users {
+		res.Users[i] = newAdminUser(u)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func handleAdminCreateUser(w http.ResponseWriter, r *http.Request) {
+	var reqInput adminUserCreate
+	err := json.NewDecoder(r.Body).Decode(&reqInput)
+	defer r.Body.Close()
+	if err != nil {
+		writeError(w, "bad request: invalid user", http.StatusBadRequest)
+		return
+	}
+	fields := validateCredentials(reqInput.Login, reqInput.Password)
+	fields = append(fields, validateAccess(reqInput.Roles, reqInput.Scopes)...)
+	if len(fields) > 0 {
+		writeValidationError(w, fields, http.StatusUnprocessableEntity)
+		return
+	}
+
+	pass, err := hashPassword(reqInput.Password)
+	if err != nil {
+		log.Printf("admin.go: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	roles := reqInput.Roles
+	if len(roles) == 0 {
+		roles = []string{RoleUser}
+	}
+
+	user := User{Login: reqInput.Login, Password: pass, Roles: roles, Scopes: reqInput.Scopes, TokensValidAfter: time.Now()}
+	err = userRepo.Create(r.Context(), user)
+	if errors.Is(err, ErrUserExists) {
+		writeError(w, "User already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("admin.go: create user: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newAdminUser(user))
+}
+
+func handleAdminGetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, newAdminUser(user))
+}
+
+func handleAdminUpdateUser(w http.ResponseWriter, r *http.Request) {
+	var reqInput adminUserPatch
+	err := json.NewDecoder(r.Body).Decode(&reqInput)
+	defer r.Body.Close()
+	if err != nil {
+		writeError(w, "bad request: invalid user patch", http.StatusBadRequest)
+		return
+	}
+
+	adminWriteMu.Lock()
+	defer adminWriteMu.Unlock()
+	user, ok := adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+	wasAdmin := isEnabledAdmin(user)
+	if reqInput.Roles != nil {
+		user.Roles = *reqInput.Roles
+	}
+	if reqInput.Scopes != nil {
+		user.Scopes = *reqInput.Scopes
+	}
+	if reqInput.Disabled != nil {
+		user.Disabled = *reqInput.Disabled
+	}
+	if fields := validateAccess(user.Roles, user.Scopes); len(fields) > 0 {
+		writeValidationError(w, fields, http.StatusUnprocessableEntity)
+		return
+	}
+	if wasAdmin && !isEnabledAdmin(user) && !adminKeepOne(w, r, user.Login) {
+		return
+	}
+	// Tokens carry the roles and scopes they were issued with, so none
+	// issued so far may outlive a change of them.
+	accessChanged := reqInput.Roles != nil || reqInput.Scopes != nil
+	if accessChanged {
+		user.TokensValidAfter = time.Now()
+	}
+
+	if !adminSaveUser(w, r, user) {
+		return
+	}
+	if accessChanged {
+		if err := refreshTokens.RevokeLogin(r.Context(), user.Login); err != nil {
+			log.Printf("admin.go: revoke refresh tokens: %v", err)
+		}
+	}
+	writeJSON(w, http.StatusOK, newAdminUser(user))
+}
+
+func handleAdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	adminWriteMu.Lock()
+	defer adminWriteMu.Unlock()
+	user, ok := adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+	if isEnabledAdmin(user) && !adminKeepOne(w, r, user.Login) {
+		return
+	}
+
+	err := userRepo.Delete(r.Context(), user.Login)
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("admin.go: delete user: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// A later account with the same login must not inherit the sessions,
+	// keys, history, places or jobs.
+	if err := refreshTokens.RevokeLogin(r.Context(), chi.URLParam(r, "login")); err != nil {
+		log.Printf("admin.go: revoke refresh tokens: %v", err)
+	}
+	if err := apiKeys.DeleteByLogin(r.Context(), chi.URLParam(r, "login")); err != nil {
+		log.Printf("admin.go: delete api keys: %v", err)
+	}
+	if err := userData.DeleteByLogin(r.Context(), chi.URLParam(r, "login")); err != nil {
+		log.Printf("admin.go: delete user data: %v", err)
+	}
+	if err := jobManager.DeleteByLogin(chi.URLParam(r, "login")); err != nil {
+		log.Printf("admin.go: delete jobs: %v", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminResetPassword sets a new password and invalidates every token
+// issued to the user so far.
+func handleAdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	var reqInput passwordResetRequest
+	err := json.NewDecoder(r.Body).Decode(&reqInput)
+	defer r.Body.Close()
+	if err != nil {
+		writeError(w, "bad request: invalid password reset", http.StatusBadRequest)
+		return
+	}
+
+	adminWriteMu.Lock()
+	defer adminWriteMu.Unlock()
+	user, ok := adminLoadUser(w, r)
+	if !ok {
+		return
+	}
+	if fields := passwordPolicy.Check(user.Login, reqInput.Password); len(fields) > 0 {
+		writeValidationError(w, fields, http.StatusUnprocessableEntity)
+		return
+	}
+	user.Password, err = hashPassword(reqInput.Password)
+	if err != nil {
+		log.Printf("admin.go: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	user.TokensValidAfter = time.Now()
+
+	if !adminSaveUser(w, r, user) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminLoadUser fetches the user named in the URL and writes the error response if it fails.
+func adminLoadUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	user, err := userRepo.GetByLogin(r.Context(), chi.URLParam(r, "login"))
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(w, "User not found", http.StatusNotFound)
+		return User{}, false
+	}
+	if err != nil {
+		log.Printf("admin.go: get user: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return User{}, false
+	}
+	return user, true
+}
+
+// adminSaveUser stores user and writes the error response if it fails.
+func adminSaveUser(w http.ResponseWriter, r *http.Request, user User) bool {
+	err := userRepo.Update(r.Context(), user)
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(w, "User not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		log.Printf("admin.go: update user: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// validateAccess checks that roles and scopes are ones roleScopes knows.
+func validateAccess(roles, scopes []string) []FieldError {
+	var fields []FieldError
+	for _, check := range []struct {
+		field string
+		got   []string
+		known []string
+	}{{"roles", roles, knownRoles()}, {"scopes", scopes, knownScopes()}} {
+		known := map[string]bool{}
+		for _, v := range check.known {
+			known[v] = true
+		}
+		for _, v := range check.got {
+			if !known[v] {
+				fields = append(fields, FieldError{Field: check.field, Message: "may only contain " + strings.Join(check.known, ", ")})
+				break
+			}
+		}
+	}
+	return fields
+}
+
+// isEnabledAdmin reports whether u holds the admin role on an enabled account.
+func isEnabledAdmin(u User) bool {
+	if u.Disabled {
+		return false
+	}
+	for _, role := range u.Roles {
+		if role == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// adminKeepOne makes sure an enabled admin other than login is left before
+// login stops being one, and writes the error response if not. The caller
+// holds adminWriteMu until the change is stored.
+func adminKeepOne(w http.ResponseWriter, r *http.Request, login string) bool {
+	for offset := 0; ; offset += maxPageLimit {
+		users, total, err := userRepo.List(r.Context(), offset, maxPageLimit)
+		if err != nil {
+			log.Printf("admin.go: list users: %v", err)
+			writeError(w, "Internal Server Error", http.StatusInternalServerError)
+			return false
+		}
+		for _, u := range users {
+			if u.Login != login && isEnabledAdmin(u) {
+				return true
+			}
+		}
+		if len(users) == 0 || offset+len(users) >= total {
+			writeError(w, "At least one enabled admin must remain", http.StatusConflict)
+			return false
+		}
+	}
+}
+
+// queryInt returns the integer query parameter key or def when it is absent.
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_handleAdminUsers(t *testing.T) {
+	savedJobs := jobManager
+	jobManager = newTestJobManager(t, t.TempDir())
+	defer func() { jobManager = savedJobs }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	admin := issueTestToken(t, User{Login: "AdminRoot", Roles: []string{RoleUser, RoleAdmin}})
+	user := issueTestToken(t, User{Login: "AdminPlain", Roles: []string{RoleUser}})
+
+	type args struct {
+		Method string
+		Url    string
+		Body   string
+		token  string
+	}
+
+	tests := []struct {
+		name       string
+		args       args
+		want       string
+		wantStatus int
+	}{
+		{"forbidden", args{Method: "GET", Url: "/api/admin/users", token: user}, "{\"error\":\"insufficient scope: admin:users required\"}\n", http.StatusForbidden},
+		{"create", args{Method: "POST", Url: "/api/admin/users", Body: `{"login":"AdminMade","password":"s3cret-hugo","scopes":["address:search"]}`, token: admin}, `{"login":"AdminMade","roles":["user"],"scopes":["address:search"],"disabled":false}`, http.StatusCreated},
+		{"create exists", args{Method: "POST", Url: "/api/admin/users", Body: `{"login":"AdminMade","password":"s3cret-hugo"}`, token: admin}, "{\"error\":\"User already exists\"}\n", http.StatusConflict},
+		{"create unknown", args{Method: "POST", Url: "/api/admin/users", Body: `{"login":"AdminOdd","password":"s3cret-hugo","roles":["root"],"scopes":["address:search","everything"]}`, token: admin}, `{"error":"validation failed","fields":[{"field":"roles","message":"may only contain admin, user"},{"field":"scopes","message":"may only contain address:geocode, address:search, admin:metrics, admin:tokens, admin:users, me:read, me:write"}]}`, http.StatusUnprocessableEntity},
+		{"create bad", args{Method: "POST", Url: "/api/admin/users", Body: `{"login":"AdminWeak","password":"qwerty"}`, token: admin}, `{"error":"validation failed","fields":[{"field":"password","message":"must be at least 8 characters long"}`, http.StatusUnprocessableEntity},
+		{"list page", args{Method: "GET", Url: "/api/admin/users?offset=1&limit=1", token: admin}, `"offset":1,"limit":1}`, http.StatusOK},
+		{"list limit", args{Method: "GET", Url: "/api/admin/users?limit=1000", token: admin}, "{\"error\":\"bad request: limit must be between 1 and 100\"}\n", http.StatusBadRequest},
+		{"get", args{Method: "GET", Url: "/api/admin/users/AdminMade", token: admin}, `{"login":"AdminMade","roles":["user"],"scopes":["address:search"],"disabled":false}`, http.StatusOK},
+		{"get missing", args{Method: "GET", Url: "/api/admin/users/nobody", token: admin}, "{\"error\":\"User not found\"}\n", http.StatusNotFound},
+		{"login", args{Method: "POST", Url: "/api/login", Body: `{"login":"AdminMade","password":"s3cret-hugo"}`}, `{"access_token":"Bearer `, http.StatusOK},
+		{"disable", args{Method: "PATCH", Url: "/api/admin/users/AdminMade", Body: `{"disabled":true}`, token: admin}, `{"login":"AdminMade","roles":["user"],"scopes":["address:search"],"disabled":true}`, http.StatusOK},
+		{"login disabled", args{Method: "POST", Url: "/api/login", Body: `{"login":"AdminMade","password":"s3cret-hugo"}`}, "{\"error\":\"Account disabled\"}\n", http.StatusForbidden},
+		{"patch unknown", args{Method: "PATCH", Url: "/api/admin/users/AdminMade", Body: `{"scopes":["address:everything"]}`, token: admin}, `{"error":"validation failed","fields":[{"field":"scopes","message":"may only contain `, http.StatusUnprocessableEntity},
+		{"enable", args{Method: "PATCH", Url: "/api/admin/users/AdminMade", Body: `{"disabled":false,"scopes":[]}`, token: admin}, `{"login":"AdminMade","roles":["user"],"scopes":[],"disabled":false}`, http.StatusOK},
+		{"reset weak", args{Method: "POST", Url: "/api/admin/users/AdminMade/password", Body: `{"password":"password1"}`, token: admin}, `{"error":"validation failed","fields":[{"field":"password","message":"is too common, it appears in a list of breached passwords"}]}`, http.StatusUnprocessableEntity},
+		{"reset", args{Method: "POST", Url: "/api/admin/users/AdminMade/password", Body: `{"password":"chang3d-hugo"}`, token: admin}, "", http.StatusNoContent},
+		{"login old password", args{Method: "POST", Url: "/api/login", Body: `{"login":"AdminMade","password":"s3cret-hugo"}`}, "{\"error\":\"Invalid login or password\"}\n", http.StatusUnauthorized},
+		{"login new password", args{Method: "POST", Url: "/api/login", Body: `{"login":"AdminMade","password":"chang3d-hugo"}`}, `{"access_token":"Bearer `, http.StatusOK},
+		{"delete", args{Method: "DELETE", Url: "/api/admin/users/AdminMade", token: admin}, "", http.StatusNoContent},
+		{"delete missing", args{Method: "DELETE", Url: "/api/admin/users/AdminMade", token: admin}, "{\"error\":\"User not found\"}\n", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.args.Method, ts.URL+tt.args.Url, strings.NewReader(tt.args.Body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+tt.args.token)
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+			buf := new(bytes.Buffer)
+			defer res.Body.Close()
+			buf.ReadFrom(res.Body)
+			if strings.HasPrefix(tt.want, "{") {
+				assert.True(t, strings.HasPrefix(buf.String(), tt.want), buf.String())
+			} else {
+				assert.True(t, strings.HasSuffix(buf.String(), tt.want), buf.String())
+			}
+		})
+	}
+}
+
+func Test_handleAdminLastAdmin(t *testing.T) {
+	saved := userRepo
+	userRepo = NewMemoryUserRepository()
+	defer func() { userRepo = saved }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	admin := "Bearer " + issueTestToken(t, User{Login: "OnlyAdmin", Roles: []string{RoleUser, RoleAdmin}})
+	do := func(method, url, body string) (int, string) {
+		req, _ := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		req.Header.Set("Authorization", admin)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res.StatusCode, buf.String()
+	}
+
+	for _, change := range []struct{ method, body string }{
+		{"PATCH", `{"roles":["user"]}`},
+		{"PATCH", `{"disabled":true}`},
+		{"DELETE", ""},
+	} {
+		status, body := do(change.method, "/api/admin/users/OnlyAdmin", change.body)
+		assert.Equal(t, http.StatusConflict, status, change.body)
+		assert.Equal(t, "{\"error\":\"At least one enabled admin must remain\"}\n", body)
+	}
+
+	status, _ := do("PATCH", "/api/admin/users/OnlyAdmin", `{"scopes":["address:search"]}`)
+	assert.Equal(t, http.StatusOK, status, "changes keeping the admin are fine")
+	// The change revoked the tokens issued before it.
+	admin = "Bearer " + issueTestToken(t, User{Login: "OnlyAdmin", Roles: []string{RoleUser, RoleAdmin}})
+	status, _ = do("POST", "/api/admin/users", `{"login":"NextAdmin","password":"s3cret-hugo","roles":["admin"]}`)
+	assert.Equal(t, http.StatusCreated, status)
+	status, _ = do("PATCH", "/api/admin/users/OnlyAdmin", `{"roles":["user"]}`)
+	assert.Equal(t, http.StatusOK, status, "another admin is left")
+}
+
+func Test_handleAdminLastAdminConcurrent(t *testing.T) {
+	saved := userRepo
+	userRepo = NewMemoryUserRepository()
+	defer func() { userRepo = saved }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	keeper := "Bearer " + issueTestToken(t, User{Login: "KeeperUser", Roles: []string{RoleUser}, Scopes: []string{ScopeAdminUsers}})
+	issueTestToken(t, User{Login: "PairAdmin1", Roles: []string{RoleAdmin}})
+	issueTestToken(t, User{Login: "PairAdmin2", Roles: []string{RoleAdmin}})
+
+	statuses := make([]int, 2)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("PATCH", fmt.Sprintf("%s/api/admin/users/PairAdmin%d", ts.URL, i+1), strings.NewReader(`{"roles":["user"]}`))
+			req.Header.Set("Authorization", keeper)
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			res.Body.Close()
+			statuses[i] = res.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	assert.ElementsMatch(t, []int{http.StatusOK, http.StatusConflict}, statuses, "one admin is left")
+}
+
+func Test_handleAdminUpdateUserAccess(t *testing.T) {
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	admin := issueTestToken(t, User{Login: "DemotingAdmin", Roles: []string{RoleAdmin}})
+	do := func(method, url, body, token string) (int, string) {
+		req, _ := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res.StatusCode, buf.String()
+	}
+
+	// The demoted admin got their tokens a minute before the change.
+	savedIssuer, savedRefresh := tokenIssuer, refreshTokens
+	tokenIssuer = NewTokenIssuer(signingKeys, savedIssuer.ttl)
+	tokenIssuer.now = func() time.Time { return time.Now().Add(-time.Minute) }
+	refreshTokens = NewRefreshTokens(NewMemoryRefreshTokenStore(), defaultRefreshTokenTTL)
+	refreshTokens.now = tokenIssuer.now
+	defer func() { tokenIssuer, refreshTokens = savedIssuer, savedRefresh }()
+	demoted := issueTestToken(t, User{Login: "DemotedAdmin", Roles: []string{RoleAdmin}})
+	refresh, err := refreshTokens.Issue(context.Background(), "DemotedAdmin", "")
+	assert.NoError(t, err)
+	tokenIssuer.now, refreshTokens.now = time.Now, time.Now
+
+	status, _ := do("PATCH", "/api/admin/users/DemotedAdmin", `{"roles":["user"]}`, admin)
+	assert.Equal(t, http.StatusOK, status)
+	status, body := do("PATCH", "/api/admin/users/DemotedAdmin", `{"roles":["admin"]}`, demoted)
+	assert.Equal(t, http.StatusUnauthorized, status, "no way back with the old token")
+	assert.Equal(t, "{\"error\":\"Token revoked\"}\n", body)
+	_, err = refreshTokens.Rotate(context.Background(), refresh)
+	assert.ErrorIs(t, err, ErrRefreshTokenInvalid)
+}
+
+func Test_AuthenticatorUserState(t *testing.T) {
+	savedJobs := jobManager
+	jobManager = newTestJobManager(t, t.TempDir())
+	defer func() { jobManager = savedJobs }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	admin := issueTestToken(t, User{Login: "StateAdmin", Roles: []string{RoleAdmin}})
+	token := issueTestToken(t, User{Login: "StateUser", Roles: []string{RoleUser}})
+
+	do := func(method, url, body, token string) (int, string) {
+		req, _ := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res.StatusCode, buf.String()
+	}
+
+	do("PATCH", "/api/admin/users/StateUser", `{"disabled":true}`, admin)
+	status, body := do("POST", "/api/logout", "", token)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "{\"error\":\"Account disabled\"}\n", body)
+
+	do("DELETE", "/api/admin/users/StateUser", "", admin)
+	status, body = do("POST", "/api/logout", "", token)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "{\"error\":\"Token revoked\"}\n", body)
+}
+
+func Test_handleAdminDeleteUser(t *testing.T) {
+	savedJobs := jobManager
+	jobManager = newTestJobManager(t, t.TempDir())
+	defer func() { jobManager = savedJobs }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	admin := issueTestToken(t, User{Login: "RebornAdmin", Roles: []string{RoleAdmin}})
+	do := func(method, url, body, token string) (int, string) {
+		req, _ := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		req.Header.Set("Authorization", token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res.StatusCode, buf.String()
+	}
+
+	// The first account got its tokens a minute before it was deleted.
+	savedIssuer, savedRefresh := tokenIssuer, refreshTokens
+	tokenIssuer = NewTokenIssuer(signingKeys, savedIssuer.ttl)
+	tokenIssuer.now = func() time.Time { return time.Now().Add(-time.Minute) }
+	refreshTokens = NewRefreshTokens(NewMemoryRefreshTokenStore(), defaultRefreshTokenTTL)
+	refreshTokens.now = tokenIssuer.now
+	defer func() { tokenIssuer, refreshTokens = savedIssuer, savedRefresh }()
+
+	_, body := do("POST", "/api/register", `{"login":"Reborn","password":"s3cret-hugo"}`, "")
+	var old tokenResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &old))
+
+	job, err := jobManager.Create("Reborn", jobFormatCSV, strings.NewReader("address\naa\n"), allowAll)
+	assert.NoError(t, err)
+
+	status, _ := do("DELETE", "/api/admin/users/Reborn", "", "Bearer "+admin)
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Empty(t, jobManager.List("Reborn"))
+	_, err = os.Stat(jobManager.path(job.ID, ".input"))
+	assert.True(t, os.IsNotExist(err), "the upload is gone")
+	tokenIssuer.now, refreshTokens.now = time.Now, time.Now
+	status, _ = do("POST", "/api/register", `{"login":"Reborn","password":"s3cret-hugo"}`, "")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, body = do("POST", "/api/refresh", `{"refresh_token":"`+old.RefreshToken+`"}`, "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "{\"error\":\"refresh token is invalid or expired\"}\n", body)
+	status, body = do("GET", "/api/me/keys", "", old.AccessToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "{\"error\":\"Token revoked\"}\n", body)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+	// apiKeyClaim carries the key id in the token APIKeyVerifier puts into the context.
+	apiKeyClaim = "api_key"
+	// apiKeyPrefix starts every key, so leaked keys are easy to grep for.
+	apiKeyPrefix = "gpk_"
+
+	apiKeyNameMaxLength = 64
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey is the server side record of an API key. Only the hash of the key
+// is kept, the key itself is shown once when it is created.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Login     string    `json:"login"`
+	Hash      string    `json:"hash"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKeyStore keeps API key records.
+// Implementations must be safe for concurrent use.
+type APIKeyStore interface {
+	// Create stores a new key.
+	Create(ctx context.Context, key APIKey) error
+	// GetByHash returns the key with the given hash or ErrAPIKeyNotFound.
+	GetByHash(ctx context.Context, hash string) (APIKey, error)
+	// ListByLogin returns the keys of login ordered by creation time.
+	ListByLogin(ctx context.Context, login string) ([]APIKey, error)
+	// Delete removes the key id of login or returns ErrAPIKeyNotFound.
+	Delete(ctx context.Context, login, id string) error
+	// DeleteByLogin removes every key of login.
+	DeleteByLogin(ctx context.Context, login string) error
+}
+
+// newAPIKeyStore builds the store matching cfg.UserStore, keys live as long as their users.
+func newAPIKeyStore(cfg *Config) (APIKeyStore, error) {
+	switch cfg.UserStore {
+	case "", "memory":
+		return NewMemoryAPIKeyStore(), nil
+	case "file":
+		return NewFileAPIKeyStore(cfg.APIKeyStorePath)
+	default:
+		return nil, fmt.Errorf("unknown user store %q", cfg.UserStore)
+	}
+}
+
+// MemoryAPIKeyStore keeps API keys in process memory, they are lost on restart.
+type MemoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+	// byHash maps the hash of every key to its id, for the lookup every
+	// request made with a key does.
+	byHash map[string]string
+	// save, when set, persists the changed set of keys before it becomes visible.
+	save func(keys map[string]APIKey) error
+}
+
+func NewMemoryAPIKeyStore() *MemoryAPIKeyStore {
+	return &MemoryAPIKeyStore{keys: make(map[string]APIKey), byHash: make(map[string]string)}
+}
+
+func (m *MemoryAPIKeyStore) Create(_ context.Context, key APIKey) error {
+	return m.mutate(func(keys map[string]APIKey) error {
+		keys[key.ID] = key
+		return nil
+	})
+}
+
+func (m *MemoryAPIKeyStore) GetByHash(_ context.Context, hash string) (APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key, ok := m.keys[m.byHash[hash]]
+	if !ok {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, nil
+}
+
+func (m *MemoryAPIKeyStore) ListByLogin(_ context.Context, login string) ([]APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := []APIKey{}
+	for _, key := range m.keys {
+		if key.Login == login {
+			list = append(list, key)
+		}
+	}
+	sortAPIKeys(list)
+	return list, nil
+}
+
+func (m *MemoryAPIKeyStore) Delete(_ context.Context, login, id string) error {
+	return m.mutate(func(keys map[string]APIKey) error {
+		if key, ok := keys[id]; !ok || key.Login != login {
+			return ErrAPIKeyNotFound
+		}
+		delete(keys, id)
+		return nil
+	})
+}
+
+func (m *MemoryAPIKeyStore) DeleteByLogin(_ context.Context, login string) error {
+	return m.mutate(func(keys map[string]APIKey) error {
+		for id, key := range keys {
+			if key.Login == login {
+				delete(keys, id)
+			}
+		}
+		return nil
+	})
+}
+
+func sortAPIKeys(list []APIKey) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+}
+
+// mutate applies fn to a copy of the keys and swaps it in once saved,
+// so a failed save leaves the store unchanged.
+func (m *MemoryAPIKeyStore) mutate(fn func(keys map[string]APIKey) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.save == nil {
+		err := fn(m.keys)
+		m.index()
+		return err
+	}
+
+	next := make(map[string]APIKey, len(m.keys)+1)
+	for k, v := range m.keys {
+		next[k] = v
+	}
+	if err := fn(next); err != nil {
+		return err
+	}
+	if err := m.save(next); err != nil {
+		return err
+	}
+	m.keys = next
+	m.index()
+	return nil
+}
+
+// index rebuilds byHash from the keys, the caller holds m.mu. Keys change
+// seldom enough for that to be simpler than keeping both maps in step.
+func (m *MemoryAPIKeyStore) index() {
+	m.byHash = make(map[string]string, len(m.keys))
+	for id, key := range m.keys {
+		m.byHash[key.Hash] = id
+	}
+}
+
+// FileAPIKeyStore persists every change to a JSON file.
+type FileAPIKeyStore struct {
+	*MemoryAPIKeyStore
+	path string
+}
+
+// NewFileAPIKeyStore loads keys from path, a missing file is an empty store.
+func NewFileAPIKeyStore(path string) (*FileAPIKeyStore, error) {
+	f := &FileAPIKeyStore{MemoryAPIKeyStore: NewMemoryAPIKeyStore(), path: path}
+
+	var keys []APIKey
+	if err := readJSONFile(path, &keys); err != nil {
+		return nil, fmt.Errorf("load api key store: %w", err)
+	}
+	for _, k := range keys {
+		f.keys[k.ID] = k
+	}
+	f.index()
+	f.save = f.flush
+
+	return f, nil
+}
+
+func (f *FileAPIKeyStore) flush(keys map[string]APIKey) error {
+	list := make([]APIKey, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, k)
+	}
+	sortAPIKeys(list)
+	if err := writeJSONFile(f.path, list); err != nil {
+		return fmt.Errorf("save api key store: %w", err)
+	}
+	return nil
+}
+
+// newAPIKey returns a fresh random key and its id.
+func newAPIKey() (key, id string, err error) {
+	if id, err = newTokenID(); err != nil {
+		return "", "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("generate api key: %w", err)
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), id, nil
+}
+
+// APIKeyVerifier accepts an API key in the X-API-Key header in place of a
+// bearer token. The key is turned into an unsigned token with the owner as
+// subject and the key's scopes, limited to the ones the owner still has, and
+// stored in the context the way Verifier does. Authenticator and
+// RequireScopes then treat it like any access token. It must run after Verifier.
+func APIKeyVerifier(store APIKeyStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			raw := r.Header.Get(apiKeyHeader)
+			if raw == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, err := apiKeyToken(r.Context(), store, raw)
+			if errors.Is(err, ErrAPIKeyNotFound) {
+				writeError(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				log.Printf("apikeys.go: verify api key: %v", err)
+				writeError(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			ctx := jwtauth.NewContext(r.Context(), token, nil)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+func apiKeyToken(ctx context.Context, store APIKeyStore, raw string) (jwt.Token, error) {
+	key, err := store.GetByHash(ctx, hashToken(raw))
+	if err != nil {
+		return nil, err
+	}
+	user, err := userRepo.GetByLogin(ctx, key.Login)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := jwt.NewBuilder().
+		Subject(key.Login).
+		IssuedAt(time.Now()).
+		Claim(apiKeyClaim, key.ID).
+		Claim(rolesClaim, user.Roles).
+		Claim(scopeClaim, strings.Join(grantedScopes(user, key.Scopes), " ")).
+		Build()
+	if err != nil {
+		return nil, fmt.Errorf("build api key token: %w", err)
+	}
+	return token, nil
+}
+
+// grantedScopes returns the scopes of requested that user holds.
+func grantedScopes(user User, requested []string) []string {
+	held := map[string]bool{}
+	for _, scope := range user.EffectiveScopes() {
+		held[scope] = true
+	}
+	granted := []string{}
+	for _, scope := range requested {
+		if held[scope] {
+			granted = append(granted, scope)
+		}
+	}
+	return granted
+}
+
+// isAPIKeyToken reports whether token was made by APIKeyVerifier.
+func isAPIKeyToken(token jwt.Token) bool {
+	_, ok := token.Get(apiKeyClaim)
+	return ok
+}
+
+// swagger:model apiKeyCreate
+type apiKeyCreate struct {
+	// what the key is used for
+	//
+	// required: true
+	// example: nightly geocoding
+	Name string `json:"name"`
+	// scopes of the key, every one must be held by the user; all of the
+	// user's scopes when empty
+	//
+	// example: ["address:search"]
+	Scopes []string `json:"scopes"`
+}
+
+// swagger:model apiKey
+type apiKeyInfo struct {
+	// example: 9f86d081884c7d659a2feaa0c55ad015
+	ID string `json:"id"`
+	// example: nightly geocoding
+	Name string `json:"name"`
+	// example: ["address:search"]
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	// the key to send in the X-API-Key header, only present in the create response
+	//
+	// example: gpk_Vx1n0yRZbN6p3oW6mFh1JQq2R0b4uYtq9xS8Hk3l7aE
+	Key string `json:"key,omitempty"`
+}
+
+func newAPIKeyInfo(k APIKey) apiKeyInfo {
+	return apiKeyInfo{ID: k.ID, Name: k.Name, Scopes: k.Scopes, CreatedAt: k.CreatedAt}
+}
+
+// apiKeyOwner returns the login of the access token in the request. API keys
+// cannot manage keys, otherwise a narrow key could mint a broader one.
+func apiKeyOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token, _, _ := jwtauth.FromContext(r.Context())
+	if isAPIKeyToken(token) {
+		writeError(w, "API keys can not manage API keys, use an access token", http.StatusForbidden)
+		return "", false
+	}
+	return token.Subject(), true
+}
+
+func handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	login, ok := apiKeyOwner(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := apiKeys.ListByLogin(r.Context(), login)
+	if err != nil {
+		log.Printf("apikeys.go: list api keys: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]apiKeyInfo, len(keys))
+	for i, k := range keys {
+		res[i] = newAPIKeyInfo(k)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	login, ok := apiKeyOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var reqInput apiKeyCreate
+	err := json.NewDecoder(r.Body).Decode(&reqInput)
+	defer r.Body.Close()
+	if err != nil {
+		writeError(w, "bad request: invalid api key", http.StatusBadRequest)
+		return
+	}
+
+	user, err := userRepo.GetByLogin(r.Context(), login)
+	if err != nil {
+		log.Printf("apikeys.go: get user: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var fields []FieldError
+	name := strings.TrimSpace(reqInput.Name)
+	if name == "" || len(name) > apiKeyNameMaxLength {
+		fields = append(fields, FieldError{Field: "name", Message: fmt.Sprintf("must be 1 to %d characters long", apiKeyNameMaxLength)})
+	}
+	scopes := reqInput.Scopes
+	if len(scopes) == 0 {
+		scopes = user.EffectiveScopes()
+	}
+	granted := grantedScopes(user, scopes)
+	if len(granted) != len(scopes) {
+		fields = append(fields, FieldError{Field: "scopes", Message: "may only contain scopes you hold: " + strings.Join(user.EffectiveScopes(), ", ")})
+	}
+	if len(fields) > 0 {
+		writeValidationError(w, fields, http.StatusUnprocessableEntity)
+		return
+	}
+
+	raw, id, err := newAPIKey()
+	if err != nil {
+		log.Printf("apikeys.go: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	key := APIKey{ID: id, Name: name, Login: login, Hash: hashToken(raw), Scopes: granted, CreatedAt: time.Now().UTC()}
+	if err := apiKeys.Create(r.Context(), key); err != nil {
+		log.Printf("apikeys.go: create api key: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	res := newAPIKeyInfo(key)
+	res.Key = raw
+	writeJSON(w, http.StatusCreated, res)
+}
+
+func handleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	login, ok := apiKeyOwner(w, r)
+	if !ok {
+		return
+	}
+
+	err := apiKeys.Delete(r.Context(), login, chi.URLParam(r, "id"))
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		writeError(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("apikeys.go: delete api key: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileAPIKeyStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "api_keys.json")
+	store, err := NewFileAPIKeyStore(path)
+	assert.NoError(t, err)
+
+	key := APIKey{ID: "k1", Name: "batch", Login: "User1", Hash: hashToken("secret"), Scopes: []string{ScopeAddressSearch}, CreatedAt: time.Unix(1700000000, 0).UTC()}
+	assert.NoError(t, store.Create(ctx, key))
+	assert.NoError(t, store.Create(ctx, APIKey{ID: "k2", Login: "User2", Hash: hashToken("other")}))
+
+	reloaded, err := NewFileAPIKeyStore(path)
+	assert.NoError(t, err)
+	got, err := reloaded.GetByHash(ctx, hashToken("secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, key, got)
+
+	assert.ErrorIs(t, reloaded.Delete(ctx, "User2", "k1"), ErrAPIKeyNotFound)
+	assert.NoError(t, reloaded.DeleteByLogin(ctx, "User1"))
+	_, err = reloaded.GetByHash(ctx, hashToken("secret"))
+	assert.ErrorIs(t, err, ErrAPIKeyNotFound)
+	list, err := reloaded.ListByLogin(ctx, "User2")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+}
+
+func Test_APIKeys(t *testing.T) {
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	protected := chi.NewRouter()
+	protected.Use(Verifier(signingKeys))
+	protected.Use(APIKeyVerifier(apiKeys))
+	protected.Use(Authenticator())
+	protected.With(RequireScopes(ScopeAddressSearch)).Get("/search", func(w http.ResponseWriter, r *http.Request) {
+		token, _, _ := jwtauth.FromContext(r.Context())
+		w.Write([]byte(token.Subject() + " " + strings.Join(tokenScopes(token), " ")))
+	})
+	protected.With(RequireScopes(ScopeAddressGeocode)).Get("/geocode", handleHello)
+	pts := httptest.NewServer(protected)
+	defer pts.Close()
+
+	token := issueTestToken(t, User{Login: "KeyUser", Roles: []string{RoleUser}})
+
+	do := func(base, method, url, body string, header ...string) (int, string) {
+		req, _ := http.NewRequest(method, base+url, strings.NewReader(body))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res.StatusCode, buf.String()
+	}
+	bearer := "Bearer " + token
+
+	status, body := do(ts.URL, "POST", "/api/me/keys", `{"name":"nightly","scopes":["admin:users"]}`, "Authorization", bearer)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Contains(t, body, `"field":"scopes"`)
+
+	status, body = do(ts.URL, "POST", "/api/me/keys", `{"name":"nightly","scopes":["address:search"]}`, "Authorization", bearer)
+	assert.Equal(t, http.StatusCreated, status)
+	var created apiKeyInfo
+	assert.NoError(t, json.Unmarshal([]byte(body), &created))
+	assert.True(t, strings.HasPrefix(created.Key, apiKeyPrefix), created.Key)
+	assert.Equal(t, []string{ScopeAddressSearch}, created.Scopes)
+
+	status, body = do(pts.URL, "GET", "/search", "", apiKeyHeader, created.Key)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "KeyUser address:search", body)
+
+	status, body = do(pts.URL, "GET", "/geocode", "", apiKeyHeader, created.Key)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "{\"error\":\"insufficient scope: address:geocode required\"}\n", body)
+
+	status, body = do(pts.URL, "GET", "/search", "", apiKeyHeader, "gpk_wrong")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "{\"error\":\"Invalid API key\"}\n", body)
+
+	status, _ = do(ts.URL, "POST", "/api/me/keys", `{"name":"escalate"}`, apiKeyHeader, created.Key)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, body = do(ts.URL, "GET", "/api/me/keys", "", "Authorization", bearer)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"id":"`+created.ID+`","name":"nightly"`)
+	assert.NotContains(t, body, created.Key)
+
+	status, _ = do(ts.URL, "DELETE", "/api/me/keys/"+created.ID, "", "Authorization", bearer)
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = do(ts.URL, "DELETE", "/api/me/keys/"+created.ID, "", "Authorization", bearer)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _ = do(pts.URL, "GET", "/search", "", apiKeyHeader, created.Key)
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultBatchMaxQueries = 1000
+	defaultBatchChunkSize  = 10
+	defaultBatchWorkers    = 4
+)
+
+// BatchConfig bounds POST /api/address/search/batch.
+type BatchConfig struct {
+	// MaxQueries is the most queries one request may hold.
+	MaxQueries int
+	// ChunkSize queries go upstream together in one call.
+	ChunkSize int
+	// Workers is how many chunks of one request are looked up at the same time.
+	Workers int
+}
+
+// batchConfig is replaced in main by the configured one.
+var batchConfig = BatchConfig{MaxQueries: defaultBatchMaxQueries, ChunkSize: defaultBatchChunkSize, Workers: defaultBatchWorkers}
+
+// swagger:model searchBatchRequest
+type SearchBatchRequest struct {
+	// address queries, each at least 2 characters long
+	//
+	// required: true
+	// example: ["Москва, Сухонская 11", "Санкт-Петербург, Ленинский проспект 118к1"]
+	Queries []string `json:"queries"`
+}
+
+// swagger:model searchBatchResponse
+type SearchBatchResponse struct {
+	// one result for each query, in the order of the queries
+	Results []SearchBatchResult `json:"results"`
+}
+
+// swagger:model searchBatchResult
+type SearchBatchResult struct {
+	// the query as sent
+	//
+	// example: Москва, Сухонская 11
+	Query string `json:"query"`
+	// found addresses, null when the query failed
+	Addresses []*Address `json:"addresses"`
+	// why the query failed, absent on success
+	//
+	// example: must be at least 2 characters long
+	Error string `json:"error,omitempty"`
+}
+
+func handleSearchBatch(w http.ResponseWriter, r *http.Request) {
+	var reqInput SearchBatchRequest
+	err := json.NewDecoder(r.Body).Decode(&reqInput)
+	defer r.Body.Close()
+	if err != nil {
+		writeError(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	switch n := len(reqInput.Queries); {
+	case n == 0:
+		writeValidationError(w, []FieldError{{Field: "queries", Message: "must not be empty"}}, http.StatusBadRequest)
+		return
+	case n > batchConfig.MaxQueries:
+		writeValidationError(w, []FieldError{{Field: "queries", Message: fmt.Sprintf("must hold at most %d queries", batchConfig.MaxQueries)}}, http.StatusBadRequest)
+		return
+	}
+
+	results := make([]SearchBatchResult, len(reqInput.Queries))
+	var valid []int
+	for i, q := range reqInput.Queries {
+		results[i].Query = q
+		if fields := validateSearchRequest(&SearchRequest{Query: q}); len(fields) > 0 {
+			results[i].Error = fields[0].Message
+			continue
+		}
+		valid = append(valid, i)
+	}
+
+	lookups := 0
+	for _, i := range valid {
+		if !searchCached(reqInput.Queries[i]) {
+			lookups++
+		}
+	}
+	if err := spendQuota(r.Context(), lookups); err != nil {
+		writeQuotaExceeded(w)
+		return
+	}
+
+	view := addressView(r)
+	for _, chunk := range runBatch(r, valid, reqInput.Queries) {
+		for j, i := range chunk.ids {
+			if chunk.err != nil {
+				results[i].Error = chunk.err.Error()
+				continue
+			}
+			results[i].Addresses = viewAddresses(chunk.addresses[j], view)
+		}
+	}
+
+	w.Header().Add("Vary", "Accept")
+	writeJSON(w, http.StatusOK, SearchBatchResponse{Results: results})
+}
+
+type batchChunk struct {
+	ids       []int
+	addresses [][]*Address
+	err       error
+}
+
+// runBatch looks up the queries at ids in chunks of batchConfig.ChunkSize,
+// running up to batchConfig.Workers chunks at the same time. A failed chunk
+// carries the error to show for each of its queries.
+func runBatch(r *http.Request, ids []int, queries []string) []*batchChunk {
+	size, workers := batchConfig.ChunkSize, batchConfig.Workers
+	if size < 1 {
+		size = 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	var chunks []*batchChunk
+	for start := 0; start < len(ids); start += size {
+		chunks = append(chunks, &batchChunk{ids: ids[start:minInt(start+size, len(ids))]})
+	}
+
+	jobs := make(chan *batchChunk)
+	var wg sync.WaitGroup
+	for n := minInt(workers, len(chunks)); n > 0; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range jobs {
+				chunk.addresses, chunk.err = searchChunk(r, chunk.ids, queries)
+			}
+		}()
+	}
+	for _, chunk := range chunks {
+		jobs <- chunk
+	}
+	close(jobs)
+	wg.Wait()
+	return chunks
+}
+
+func searchChunk(r *http.Request, ids []int, queries []string) ([][]*Address, error) {
+	ctx := r.Context()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	chunk := make([]string, len(ids))
+	for j, i := range ids {
+		chunk[j] = strings.TrimSpace(queries[i])
+	}
+
+	addresses, err := searchBatch(ctx, geoProvider, chunk)
+	switch {
+	case err == nil:
+		return addresses, nil
+	case errors.Is(err, ErrNoGeoProvider):
+		return nil, errors.New("Geo providers unavailable")
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	default:
+		log.Printf("batch.go: %v", err)
+		return nil, errors.New("Internal Server Error")
+	}
+}
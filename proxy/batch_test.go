@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// batchGeoProvider answers every query with its upper cased text and fails
+// batches holding "fail". It records the batches and the peak concurrency.
+type batchGeoProvider struct {
+	mu        sync.Mutex
+	batches   [][]string
+	running   int
+	maxActive int
+}
+
+func (p *batchGeoProvider) Search(ctx context.Context, query string) ([]*Address, error) {
+	res, err := p.SearchBatch(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	return res[0], nil
+}
+
+func (p *batchGeoProvider) Reverse(context.Context, float64, float64) ([]*Address, error) {
+	return nil, errors.New("not supported")
+}
+
+func (p *batchGeoProvider) SearchBatch(_ context.Context, queries []string) ([][]*Address, error) {
+	p.mu.Lock()
+	p.batches = append(p.batches, queries)
+	p.running++
+	if p.running > p.maxActive {
+		p.maxActive = p.running
+	}
+	p.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	p.mu.Lock()
+	p.running--
+	p.mu.Unlock()
+
+	res := make([][]*Address, len(queries))
+	for i, q := range queries {
+		if q == "fail" {
+			return nil, errors.New("upstream broke")
+		}
+		res[i] = []*Address{{Address: strings.ToUpper(q)}}
+	}
+	return res, nil
+}
+
+func Test_handleSearchBatch(t *testing.T) {
+	fake := &batchGeoProvider{}
+	savedProvider, savedConfig := geoProvider, batchConfig
+	geoProvider = fake
+	batchConfig = BatchConfig{MaxQueries: 20, ChunkSize: 2, Workers: 2}
+	defer func() { geoProvider, batchConfig = savedProvider, savedConfig }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	token := "Bearer " + issueTestToken(t, User{Login: "BatchUser", Roles: []string{RoleUser}})
+	do := func(body string) (int, string) {
+		req, _ := http.NewRequest("POST", ts.URL+"/api/address/search/batch", strings.NewReader(body))
+		req.Header.Set("Authorization", token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res.StatusCode, buf.String()
+	}
+
+	status, body := do(`{"queries":["aa","b","cc","fail","dd","ee","ff","gg"]}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"results":[`+
+		`{"query":"aa","addresses":[{"address":"AA","lat":0,"lon":0}]},`+
+		`{"query":"b","addresses":null,"error":"must be at least 2 characters long"},`+
+		`{"query":"cc","addresses":[{"address":"CC","lat":0,"lon":0}]},`+
+		`{"query":"fail","addresses":null,"error":"Internal Server Error"},`+
+		`{"query":"dd","addresses":null,"error":"Internal Server Error"},`+
+		`{"query":"ee","addresses":[{"address":"EE","lat":0,"lon":0}]},`+
+		`{"query":"ff","addresses":[{"address":"FF","lat":0,"lon":0}]},`+
+		`{"query":"gg","addresses":[{"address":"GG","lat":0,"lon":0}]}]}`, body)
+	assert.Len(t, fake.batches, 4, "7 valid queries in chunks of 2")
+	assert.Equal(t, 2, fake.maxActive)
+
+	status, body = do(`{"queries":[]}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, `{"error":"validation failed","fields":[{"field":"queries","message":"must not be empty"}]}`, body)
+
+	status, body = do(`{"queries":[` + strings.Repeat(`"aa",`, 20) + `"aa"]}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, `{"error":"validation failed","fields":[{"field":"queries","message":"must hold at most 20 queries"}]}`, body)
+
+	status, _ = do(`{"queries":"aa"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func Test_searchBatch(t *testing.T) {
+	fake := &fakeGeoProvider{addresses: []*Address{{Address: "г Москва"}}}
+	res, err := searchBatch(context.Background(), fake, []string{"Москва", "Тула"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]*Address{fake.addresses, fake.addresses}, res)
+	assert.Equal(t, "Тула", fake.query, "one by one without batch support")
+
+	fake.err = errors.New("offline")
+	_, err = searchBatch(context.Background(), fake, []string{"Москва"})
+	assert.EqualError(t, err, "offline")
+}
+
+func TestCachedProvider_SearchBatch(t *testing.T) {
+	fake := &batchGeoProvider{}
+	chain := NewProviderChain(defaultBreakerConfig)
+	chain.Add("batch", fake)
+	c, err := NewCachedProvider(chain, GeoCacheConfig{Size: 10, TTL: time.Hour})
+	assert.NoError(t, err)
+
+	c.Search(context.Background(), "aa")
+	ctx, answeredBy := withAnsweredBy(context.Background())
+	res, err := c.SearchBatch(ctx, []string{"AA", "bb", "cc", "BB "})
+	assert.NoError(t, err)
+	assert.Equal(t, "batch", answeredBy())
+	var got []string
+	for _, addresses := range res {
+		got = append(got, addresses[0].Address)
+	}
+	assert.Equal(t, []string{"AA", "BB", "CC", "BB"}, got)
+	assert.Equal(t, [][]string{{"aa"}, {"bb", "cc"}}, fake.batches, "hits and repeats are not sent again")
+	assert.Equal(t, int64(1), c.Stats().Hits)
+	assert.Equal(t, int64(3), c.Stats().Misses)
+}
+
+func TestDaDataProvider_SearchBatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		if buf.String() == `["fail"]` {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		assert.Equal(t, `["Москва","Тула"]`, buf.String())
+		fmt.Fprint(w, `[{"result":"г Москва","geo_lat":"55.75","geo_lon":"37.62"},{"result":"г Тула","geo_lat":"54.19","geo_lon":"37.61"}]`)
+	}))
+	defer ts.Close()
+
+	p := NewDaDataProvider(DaDataConfig{SearchURL: ts.URL})
+	res, err := p.SearchBatch(context.Background(), []string{"Москва", "Тула"})
+	assert.NoError(t, err)
+	assert.Len(t, res, 2)
+	assert.Equal(t, "г Тула", res[1][0].Address)
+	assert.Equal(t, 54.19, res[1][0].Lat)
+
+	_, err = p.SearchBatch(context.Background(), []string{"fail"})
+	assert.EqualError(t, err, "dadata.ru/api answered 0 addresses for 1 queries")
+}
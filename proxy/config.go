@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defaultAccessTokenTTL = 15 * time.Minute
+
+// Config holds the proxy settings, read from the environment at startup.
+type Config struct {
+	// UserStore selects the UserRepository: "memory" or "file".
+	UserStore string
+	// UserStorePath is the JSON file used by the "file" user store.
+	UserStorePath string
+	// APIKeyStorePath is the JSON file API keys are kept in with the "file" user store.
+	APIKeyStorePath string
+	// RefreshTokenStorePath is the JSON file refresh tokens are kept in with
+	// the "file" user store.
+	RefreshTokenStorePath string
+	// UserDataStorePath is the JSON file search history and saved places are
+	// kept in with the "file" user store.
+	UserDataStorePath string
+	// HistoryLimit is the number of searches kept in the history of each user.
+	HistoryLimit int
+	// AccessTokenTTL is the lifetime of issued access tokens.
+	AccessTokenTTL time.Duration
+	// RefreshTokenTTL is the lifetime of issued refresh tokens.
+	RefreshTokenTTL time.Duration
+	// AdminLogin and AdminPassword create an admin account at startup when set.
+	AdminLogin    string
+	AdminPassword string
+	// JWTKeysDir holds signing keys, <kid>.pem for RSA/EC/Ed25519 private keys
+	// and <kid>.secret for HS256 secrets. It is reloaded on SIGHUP.
+	JWTKeysDir string
+	// JWTSecret is an HS256 secret stored under the id JWTSecretKID.
+	JWTSecret    string
+	JWTSecretKID string
+	// JWTActiveKID is the id of the key new tokens are signed with.
+	JWTActiveKID string
+	// Password policy for new passwords, see PasswordPolicy.
+	PasswordMinLength     int
+	PasswordRequireUpper  bool
+	PasswordRequireLower  bool
+	PasswordRequireDigit  bool
+	PasswordRequireSymbol bool
+	// PasswordBlocklistPath is a file of breached passwords, one per line.
+	PasswordBlocklistPath string
+	// BcryptCost is the cost of newly hashed passwords.
+	BcryptCost int
+	// GeoProviders lists the geocoding backends in the order they are asked:
+	// "dadata", "nominatim", "photon" or "local".
+	GeoProviders []string
+	// GeoBreakerFailures and GeoBreakerOpen configure the circuit breaker of each backend.
+	GeoBreakerFailures int
+	GeoBreakerOpen     time.Duration
+	// DaDataSearchURL, DaDataGeocodeURL and DaDataSuggestURL override the DaData endpoints.
+	DaDataSearchURL  string
+	DaDataGeocodeURL string
+	DaDataSuggestURL string
+	// DaDataToken and DaDataSecret are the keys of a single DaData account,
+	// DaDataCredentialsFile names a JSON list of accounts, see DaDataCredential.
+	DaDataToken           string
+	DaDataSecret          string
+	DaDataCredentialsFile string
+	// NominatimURL and PhotonURL are the base URLs of those backends.
+	NominatimURL string
+	PhotonURL    string
+	// LocalDatasetPath is the .csv or .geojson address dataset of the "local" backend.
+	LocalDatasetPath string
+	// LocalReverseRadius is how far, in metres, the "local" backend looks around a point.
+	LocalReverseRadius float64
+	// The HTTP client of the geo providers, see UpstreamConfig.
+	UpstreamConnectTimeout      time.Duration
+	UpstreamReadTimeout         time.Duration
+	UpstreamTimeout             time.Duration
+	UpstreamMaxAttempts         int
+	UpstreamRetryBackoff        time.Duration
+	UpstreamMaxConnsPerHost     int
+	UpstreamMaxIdleConnsPerHost int
+	// Caching of geo answers, see GeoCacheConfig. A GeoCacheSize of 0 turns it off.
+	GeoCacheSize      int
+	GeoCacheTTL       time.Duration
+	GeoCacheDir       string
+	GeoCachePrecision int
+	// Limits of batch search, see BatchConfig.
+	BatchMaxQueries int
+	BatchChunkSize  int
+	BatchWorkers    int
+	// Background geocoding jobs, see JobsConfig.
+	JobsDir       string
+	JobsWorkers   int
+	JobsRate      float64
+	JobsChunkSize int
+	JobsMaxUpload int64
+	// RateLimits are the limits of each role, see RateLimit. QuotaStorePath
+	// keeps the quota usage across restarts, it is only kept in memory when empty.
+	RateLimits     map[string]RateLimit
+	QuotaStorePath string
+	// Brute-force protection of /api/login, see LoginGuardConfig.
+	LoginMaxFailures   int
+	LoginMaxIPFailures int
+	LoginLockoutBase   time.Duration
+	LoginLockoutMax    time.Duration
+	LoginFailureWindow time.Duration
+}
+
+func loadConfig() (*Config, error) {
+	jwtSecret, err := envSecret("JWT_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	dadataToken, err := envSecret("DADATA_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	dadataSecret, err := envSecret("DADATA_SECRET")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Config{
+		UserStore:             envString("USER_STORE", "memory"),
+		UserStorePath:         envString("USER_STORE_PATH", "./data/users.json"),
+		APIKeyStorePath:       envString("API_KEY_STORE_PATH", "./data/api_keys.json"),
+		RefreshTokenStorePath: envString("REFRESH_TOKEN_STORE_PATH", "./data/refresh_tokens.json"),
+		UserDataStorePath:     envString("USER_DATA_STORE_PATH", "./data/user_data.json"),
+		HistoryLimit:          envInt("HISTORY_LIMIT", defaultHistoryLimit),
+		AccessTokenTTL:        envDuration("ACCESS_TOKEN_TTL", defaultAccessTokenTTL),
+		RefreshTokenTTL:       envDuration("REFRESH_TOKEN_TTL", defaultRefreshTokenTTL),
+		AdminLogin:            envString("ADMIN_LOGIN", ""),
+		AdminPassword:         envString("ADMIN_PASSWORD", ""),
+		JWTKeysDir:            envString("JWT_KEYS_DIR", ""),
+		JWTSecret:             jwtSecret,
+		JWTSecretKID:          envString("JWT_SECRET_KID", "secret"),
+		JWTActiveKID:          envString("JWT_ACTIVE_KID", ""),
+
+		PasswordMinLength:     envInt("PASSWORD_MIN_LENGTH", defaultPasswordMinLength),
+		PasswordRequireUpper:  envBool("PASSWORD_REQUIRE_UPPER", false),
+		PasswordRequireLower:  envBool("PASSWORD_REQUIRE_LOWER", false),
+		PasswordRequireDigit:  envBool("PASSWORD_REQUIRE_DIGIT", true),
+		PasswordRequireSymbol: envBool("PASSWORD_REQUIRE_SYMBOL", false),
+		PasswordBlocklistPath: envString("PASSWORD_BLOCKLIST_PATH", ""),
+		BcryptCost:            envInt("BCRYPT_COST", bcrypt.DefaultCost),
+
+		GeoProviders:                geoProviderNames(),
+		GeoBreakerFailures:          envInt("GEO_BREAKER_FAILURES", defaultBreakerConfig.FailureThreshold),
+		GeoBreakerOpen:              envDuration("GEO_BREAKER_OPEN", defaultBreakerConfig.OpenTimeout),
+		DaDataSearchURL:             envString("DADATA_SEARCH_URL", defaultDaDataSearchURL),
+		DaDataGeocodeURL:            envString("DADATA_GEOCODE_URL", defaultDaDataGeocodeURL),
+		DaDataSuggestURL:            envString("DADATA_SUGGEST_URL", defaultDaDataSuggestURL),
+		DaDataToken:                 dadataToken,
+		DaDataSecret:                dadataSecret,
+		DaDataCredentialsFile:       envString("DADATA_CREDENTIALS_FILE", ""),
+		NominatimURL:                envString("NOMINATIM_URL", defaultNominatimURL),
+		PhotonURL:                   envString("PHOTON_URL", defaultPhotonURL),
+		LocalDatasetPath:            envString("LOCAL_DATASET_PATH", ""),
+		LocalReverseRadius:          envFloat("LOCAL_REVERSE_RADIUS", defaultLocalReverseRadius),
+		UpstreamConnectTimeout:      envDuration("UPSTREAM_CONNECT_TIMEOUT", defaultUpstreamConfig.ConnectTimeout),
+		UpstreamReadTimeout:         envDuration("UPSTREAM_READ_TIMEOUT", defaultUpstreamConfig.ReadTimeout),
+		UpstreamTimeout:             envDuration("UPSTREAM_TIMEOUT", defaultUpstreamConfig.Timeout),
+		UpstreamMaxAttempts:         envInt("UPSTREAM_MAX_ATTEMPTS", defaultUpstreamConfig.MaxAttempts),
+		UpstreamRetryBackoff:        envDuration("UPSTREAM_RETRY_BACKOFF", defaultUpstreamConfig.RetryBackoff),
+		UpstreamMaxConnsPerHost:     envInt("UPSTREAM_MAX_CONNS_PER_HOST", defaultUpstreamConfig.MaxConnsPerHost),
+		UpstreamMaxIdleConnsPerHost: envInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", defaultUpstreamConfig.MaxIdleConnsPerHost),
+		GeoCacheSize:                envInt("GEO_CACHE_SIZE", defaultGeoCacheSize),
+		GeoCacheTTL:                 envDuration("GEO_CACHE_TTL", defaultGeoCacheTTL),
+		GeoCacheDir:                 envString("GEO_CACHE_DIR", ""),
+		GeoCachePrecision:           envInt("GEO_CACHE_PRECISION", defaultGeoCachePrecision),
+		BatchMaxQueries:             envInt("BATCH_MAX_QUERIES", defaultBatchMaxQueries),
+		BatchChunkSize:              envInt("BATCH_CHUNK_SIZE", defaultBatchChunkSize),
+		BatchWorkers:                envInt("BATCH_WORKERS", defaultBatchWorkers),
+		JobsDir:                     envString("JOBS_DIR", defaultJobsDir),
+		JobsWorkers:                 envInt("JOBS_WORKERS", defaultJobsWorkers),
+		JobsRate:                    envFloat("JOBS_RATE", defaultJobsRate),
+		JobsChunkSize:               envInt("JOBS_CHUNK_SIZE", defaultJobsChunkSize),
+		JobsMaxUpload:               int64(envInt("JOBS_MAX_UPLOAD", defaultJobsMaxUpload)),
+
+		RateLimits:     rateLimits(),
+		QuotaStorePath: envString("QUOTA_STORE_PATH", ""),
+
+		LoginMaxFailures:   envInt("LOGIN_MAX_FAILURES", defaultLoginGuardConfig.MaxLoginFailures),
+		LoginMaxIPFailures: envInt("LOGIN_MAX_IP_FAILURES", defaultLoginGuardConfig.MaxIPFailures),
+		LoginLockoutBase:   envDuration("LOGIN_LOCKOUT_BASE", defaultLoginGuardConfig.BaseLockout),
+		LoginLockoutMax:    envDuration("LOGIN_LOCKOUT_MAX", defaultLoginGuardConfig.MaxLockout),
+		LoginFailureWindow: envDuration("LOGIN_FAILURE_WINDOW", defaultLoginGuardConfig.Window),
+	}, nil
+}
+
+// geoProviderNames reads GEO_PROVIDERS, a comma separated list. The older
+// GEO_PROVIDER and GEO_FALLBACK pair is still understood.
+func geoProviderNames() []string {
+	var names []string
+	list := envString("GEO_PROVIDERS", "")
+	if list == "" {
+		list = envString("GEO_PROVIDER", GeoProviderDaData) + "," + envString("GEO_FALLBACK", "")
+	}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// rateLimits reads the limits of every role from RATE_LIMIT_<ROLE>_RPS,
+// RATE_LIMIT_<ROLE>_BURST, QUOTA_<ROLE>_DAILY and QUOTA_<ROLE>_MONTHLY, e.g.
+// RATE_LIMIT_USER_RPS. The anonymous role limits requests without a token,
+// per client address. 0 turns a limit off.
+func rateLimits() map[string]RateLimit {
+	limits := map[string]RateLimit{}
+	for role, def := range defaultRateLimits {
+		name := strings.ToUpper(role)
+		limits[role] = RateLimit{
+			Rate:    envFloat("RATE_LIMIT_"+name+"_RPS", def.Rate),
+			Burst:   envInt("RATE_LIMIT_"+name+"_BURST", def.Burst),
+			Daily:   envInt("QUOTA_"+name+"_DAILY", def.Daily),
+			Monthly: envInt("QUOTA_"+name+"_MONTHLY", def.Monthly),
+		}
+	}
+	return limits
+}
+
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("config: invalid %s=%q, using %v", key, v, def)
+		return def
+	}
+	return n
+}
+
+func envFloat(key string, def float64) float64 {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("config: invalid %s=%q, using %v", key, v, def)
+		return def
+	}
+	return f
+}
+
+func envBool(key string, def bool) bool {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("config: invalid %s=%q, using %v", key, v, def)
+		return def
+	}
+	return b
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("config: invalid %s=%q, using %v", key, v, def)
+		return def
+	}
+	return d
+}
+
+// envSecret reads key from the environment or, when key_FILE is set,
+// from that file, which is how Docker secrets are mounted. A key_FILE that
+// can not be read is an error rather than an empty secret.
+func envSecret(key string) (string, error) {
+	if path := envString(key+"_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("read %s_FILE: %w", key, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return envString(key, ""), nil
+}
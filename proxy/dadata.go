@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	defaultDaDataSearchURL  = "https://cleaner.dadata.ru/api/v1/clean/address"
+	defaultDaDataGeocodeURL = "https://suggestions.dadata.ru/suggestions/api/4_1/rs/geolocate/address"
+	defaultDaDataSuggestURL = "https://suggestions.dadata.ru/suggestions/api/4_1/rs/suggest/address"
+)
+
+// DaDataCredential is the API key and secret key of one DaData account.
+type DaDataCredential struct {
+	// Name tells the accounts apart in logs, it defaults to the position in the list.
+	Name   string `json:"name"`
+	Token  string `json:"token"`
+	Secret string `json:"secret"`
+}
+
+// String keeps the keys out of logs, only their last characters are shown.
+func (c DaDataCredential) String() string {
+	return fmt.Sprintf("%s (token %s)", c.Name, redactSecret(c.Token))
+}
+
+func (c DaDataCredential) GoString() string {
+	return c.String()
+}
+
+// redactSecret masks all but the last four characters of s, short values entirely.
+func redactSecret(s string) string {
+	if len(s) < 12 {
+		return "****"
+	}
+	return "****" + s[len(s)-4:]
+}
+
+// loadDaDataCredentials collects the accounts configured in cfg: the list in
+// cfg.DaDataCredentialsFile, then the single DADATA_TOKEN and DADATA_SECRET pair.
+func loadDaDataCredentials(cfg *Config) ([]DaDataCredential, error) {
+	var creds []DaDataCredential
+	if cfg.DaDataCredentialsFile != "" {
+		data, err := os.ReadFile(cfg.DaDataCredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("dadata credentials: %w", err)
+		}
+		if err := json.Unmarshal(data, &creds); err != nil {
+			return nil, fmt.Errorf("dadata credentials: decode %s: %w", cfg.DaDataCredentialsFile, err)
+		}
+	}
+	if cfg.DaDataToken != "" || cfg.DaDataSecret != "" {
+		creds = append(creds, DaDataCredential{Name: "env", Token: cfg.DaDataToken, Secret: cfg.DaDataSecret})
+	}
+
+	if len(creds) == 0 {
+		return nil, errors.New("dadata credentials: none configured, set DADATA_TOKEN and DADATA_SECRET (or their _FILE variants) or DADATA_CREDENTIALS_FILE")
+	}
+	names := map[string]bool{}
+	for i := range creds {
+		c := &creds[i]
+		if c.Name == "" {
+			c.Name = strconv.Itoa(i + 1)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("dadata credentials: name %q used twice", c.Name)
+		}
+		names[c.Name] = true
+		if c.Token == "" || c.Secret == "" {
+			return nil, fmt.Errorf("dadata credentials %s: token and secret are both required", c.Name)
+		}
+		if strings.ContainsAny(c.Token+c.Secret, " \t\r\n") {
+			return nil, fmt.Errorf("dadata credentials %s: token and secret must not contain whitespace", c.Name)
+		}
+	}
+	return creds, nil
+}
+
+// DaDataConfig holds the endpoints and accounts of a DaDataProvider, empty
+// endpoints get the defaults.
+type DaDataConfig struct {
+	SearchURL   string
+	GeocodeURL  string
+	SuggestURL  string
+	Client      *http.Client
+	Credentials []DaDataCredential
+}
+
+// DaDataProvider searches with the DaData clean API, and reverse geocodes and
+// suggests with the DaData suggestions API. Requests take turns over the configured
+// accounts, an account that is refused or out of quota hands the request on
+// to the next one.
+type DaDataProvider struct {
+	searchURL   string
+	geocodeURL  string
+	suggestURL  string
+	client      *http.Client
+	credentials []DaDataCredential
+	turn        uint32
+}
+
+func NewDaDataProvider(cfg DaDataConfig) *DaDataProvider {
+	p := &DaDataProvider{searchURL: cfg.SearchURL, geocodeURL: cfg.GeocodeURL, suggestURL: cfg.SuggestURL, client: cfg.Client, credentials: cfg.Credentials}
+	if p.searchURL == "" {
+		p.searchURL = defaultDaDataSearchURL
+	}
+	if p.geocodeURL == "" {
+		p.geocodeURL = defaultDaDataGeocodeURL
+	}
+	if p.suggestURL == "" {
+		p.suggestURL = defaultDaDataSuggestURL
+	}
+	if p.client == nil {
+		p.client = defaultUpstreamClient
+	}
+	if len(p.credentials) == 0 {
+		// Unauthenticated, only useful against a test server.
+		p.credentials = []DaDataCredential{{}}
+	}
+	return p
+}
+
+func (p *DaDataProvider) Search(ctx context.Context, query string) ([]*Address, error) {
+	body, err := p.post(ctx, p.searchURL, []string{query}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	addrS, err := UnmarshalAddresses(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode dadata.ru/api response: %w", err)
+	}
+
+	addresses := make([]*Address, len(addrS))
+	for i, v := range addrS {
+		addresses[i] = v.address()
+	}
+	return addresses, nil
+}
+
+// SearchBatch sends all queries in one request, the clean API answers with
+// one address for each of them.
+func (p *DaDataProvider) SearchBatch(ctx context.Context, queries []string) ([][]*Address, error) {
+	body, err := p.post(ctx, p.searchURL, queries, true)
+	if err != nil {
+		return nil, err
+	}
+
+	addrS, err := UnmarshalAddresses(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode dadata.ru/api response: %w", err)
+	}
+	if len(addrS) != len(queries) {
+		return nil, fmt.Errorf("dadata.ru/api answered %d addresses for %d queries", len(addrS), len(queries))
+	}
+
+	res := make([][]*Address, len(addrS))
+	for i, v := range addrS {
+		res[i] = []*Address{v.address()}
+	}
+	return res, nil
+}
+
+func (p *DaDataProvider) Reverse(ctx context.Context, lat, lng float64) ([]*Address, error) {
+	body, err := p.post(ctx, p.geocodeURL, map[string]float64{"lat": lat, "lon": lng}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	addrS, err := UnmarshalGeoAddresses(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode dadata.ru/api response: %w", err)
+	}
+	return addrS.addresses(), nil
+}
+
+// Suggest completes query with the suggestions API. Regions are filtered by
+// DaData itself; it cannot favour a point, so when asked to it fetches as
+// many suggestions as it may and the closest of them are kept.
+func (p *DaDataProvider) Suggest(ctx context.Context, query string, opts SuggestOptions) ([]*Address, error) {
+	type location struct {
+		Region string `json:"region"`
+	}
+	payload := struct {
+		Query     string     `json:"query"`
+		Count     int        `json:"count"`
+		Locations []location `json:"locations,omitempty"`
+	}{Query: query, Count: opts.Limit}
+	if opts.Near {
+		payload.Count = maxSuggestLimit
+	}
+	for _, region := range opts.Regions {
+		payload.Locations = append(payload.Locations, location{Region: region})
+	}
+
+	body, err := p.post(ctx, p.suggestURL, payload, false)
+	if err != nil {
+		return nil, err
+	}
+	addrS, err := UnmarshalGeoAddresses(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode dadata.ru/api response: %w", err)
+	}
+	return opts.finish(addrS.addresses(), true, false), nil
+}
+
+// post sends payload as JSON to url and returns the response body.
+// The clean API also wants the secret key.
+func (p *DaDataProvider) post(ctx context.Context, url string, payload interface{}, withSecret bool) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	n := uint32(len(p.credentials))
+	first := atomic.AddUint32(&p.turn, 1) - 1
+	for i := uint32(0); ; i++ {
+		cred := p.credentials[(first+i)%n]
+		body, status, err := p.send(ctx, url, data, cred, withSecret)
+		if err == nil || i+1 == n || !accountRefused(status) {
+			return body, err
+		}
+		log.Printf("dadata.go: account %v got status %d, trying the next one", cred, status)
+	}
+}
+
+func (p *DaDataProvider) send(ctx context.Context, url string, data []byte, cred DaDataCredential, withSecret bool) ([]byte, int, error) {
+	// Lookups change nothing, so they may be retried, except for a 429 that
+	// post answers with the next account. The clean API bills every call and a
+	// 5xx does not tell whether it was carried out, so it is sent once.
+	if !withSecret {
+		ctx = withRetries(ctx, http.StatusTooManyRequests)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if cred.Token != "" {
+		req.Header.Set("Authorization", "Token "+cred.Token)
+	}
+	if withSecret && cred.Secret != "" {
+		req.Header.Set("X-Secret", cred.Secret)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("dadata.go: error request dadata.ru/api: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("error status %v dadata.ru/api", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	return body, resp.StatusCode, err
+}
+
+// accountRefused reports whether status is about the account rather than the
+// request: bad keys, no money left or the daily limit reached.
+func accountRefused(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusPaymentRequired, http.StatusForbidden, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+type Addresses []respSearch
+
+func UnmarshalAddresses(data []byte) (Addresses, error) {
+	var r Addresses
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+type respSearch struct {
+	Source             string      `json:"source"`
+	Result             string      `json:"result"`
+	PostalCode         string      `json:"postal_code"`
+	Country            string      `json:"country"`
+	CountryIsoCode     string      `json:"country_iso_code"`
+	Region             string      `json:"region"`
+	RegionWithType     string      `json:"region_with_type"`
+	CityWithType       string      `json:"city_with_type"`
+	CityArea           string      `json:"city_area"`
+	CityDistrict       string      `json:"city_district"`
+	SettlementWithType string      `json:"settlement_with_type"`
+	Street             string      `json:"street"`
+	StreetWithType     string      `json:"street_with_type"`
+	HouseType          string      `json:"house_type"`
+	House              string      `json:"house"`
+	BlockType          string      `json:"block_type"`
+	Block              string      `json:"block"`
+	FlatType           string      `json:"flat_type"`
+	Flat               string      `json:"flat"`
+	FiasID             string      `json:"fias_id"`
+	FiasLevel          string      `json:"fias_level"`
+	KladrID            string      `json:"kladr_id"`
+	Okato              string      `json:"okato"`
+	Oktmo              string      `json:"oktmo"`
+	Timezone           string      `json:"timezone"`
+	GeoLat             string      `json:"geo_lat"`
+	GeoLon             string      `json:"geo_lon"`
+	QcGeo              int64       `json:"qc_geo"`
+	Qc                 interface{} `json:"qc"`
+	QcComplete         interface{} `json:"qc_complete"`
+	QcHouse            interface{} `json:"qc_house"`
+}
+
+func (v respSearch) address() *Address {
+	addr := &Address{Address: v.Result, Details: v.details()}
+	addr.Lat, _ = strconv.ParseFloat(v.GeoLat, 64)
+	addr.Lon, _ = strconv.ParseFloat(v.GeoLon, 64)
+	return addr
+}
+
+func (v respSearch) details() *AddressDetails {
+	return &AddressDetails{
+		Country:         v.Country,
+		CountryISO:      v.CountryIsoCode,
+		Region:          v.RegionWithType,
+		City:            v.CityWithType,
+		Settlement:      v.SettlementWithType,
+		Street:          v.StreetWithType,
+		House:           joinNonEmpty(" ", v.HouseType, v.House, v.BlockType, v.Block),
+		Flat:            joinNonEmpty(" ", v.FlatType, v.Flat),
+		PostalCode:      v.PostalCode,
+		FiasID:          v.FiasID,
+		FiasLevel:       v.FiasLevel,
+		KladrID:         v.KladrID,
+		OKATO:           v.Okato,
+		OKTMO:           v.Oktmo,
+		QualityGeo:      qualityCode(v.QcGeo),
+		Quality:         qualityCode(v.Qc),
+		QualityComplete: qualityCode(v.QcComplete),
+		QualityHouse:    qualityCode(v.QcHouse),
+		Timezone:        v.Timezone,
+	}
+}
+
+func UnmarshalGeoAddresses(data []byte) (GeoAddresses, error) {
+	var r GeoAddresses
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+type GeoAddresses struct {
+	Suggestions []Suggestion `json:"suggestions"`
+}
+
+func (g GeoAddresses) addresses() []*Address {
+	addresses := make([]*Address, len(g.Suggestions))
+	for i, v := range g.Suggestions {
+		tempAddr := Address{Address: v.Value, Details: v.Data.details()}
+		tempAddr.Lat, _ = strconv.ParseFloat(v.Data.GeoLat, 64)
+
+		tempAddr.Lon, _ = strconv.ParseFloat(v.Data.GeoLon, 64)
+
+		addresses[i] = &tempAddr
+	}
+	return addresses
+}
+
+type Suggestion struct {
+	Value             string `json:"value"`
+	UnrestrictedValue string `json:"unrestricted_value"`
+	Data              Data   `json:"data"`
+}
+
+func (d Data) details() *AddressDetails {
+	return &AddressDetails{
+		Country:         d.Country,
+		CountryISO:      d.CountryIsoCode,
+		Region:          d.RegionWithType,
+		City:            d.CityWithType,
+		Settlement:      stringOf(d.SettlementWithType),
+		Street:          d.StreetWithType,
+		House:           joinNonEmpty(" ", d.HouseType, d.House, stringOf(d.BlockType), stringOf(d.Block)),
+		Flat:            joinNonEmpty(" ", stringOf(d.FlatType), stringOf(d.Flat)),
+		PostalCode:      d.PostalCode,
+		FiasID:          d.FiasID,
+		FiasLevel:       d.FiasLevel,
+		KladrID:         d.KladrID,
+		OKATO:           d.Okato,
+		OKTMO:           d.Oktmo,
+		QualityGeo:      qualityCode(d.QcGeo),
+		Quality:         qualityCode(d.Qc),
+		QualityComplete: qualityCode(d.QcComplete),
+		QualityHouse:    qualityCode(d.QcHouse),
+		Timezone:        stringOf(d.Timezone),
+	}
+}
+
+type Data struct {
+	Area                 interface{} `json:"area"`
+	AreaFiasID           interface{} `json:"area_fias_id"`
+	AreaKladrID          interface{} `json:"area_kladr_id"`
+	AreaType             interface{} `json:"area_type"`
+	AreaTypeFull         interface{} `json:"area_type_full"`
+	AreaWithType         interface{} `json:"area_with_type"`
+	BeltwayDistance      interface{} `json:"beltway_distance"`
+	BeltwayHit           interface{} `json:"beltway_hit"`
+	Block                interface{} `json:"block"`
+	BlockType            interface{} `json:"block_type"`
+	BlockTypeFull        interface{} `json:"block_type_full"`
+	CapitalMarker        string      `json:"capital_marker"`
+	City                 string      `json:"city"`
+	CityArea             string      `json:"city_area"`
+	CityDistrict         interface{} `json:"city_district"`
+	CityDistrictFiasID   interface{} `json:"city_district_fias_id"`
+	CityDistrictKladrID  interface{} `json:"city_district_kladr_id"`
+	CityDistrictType     interface{} `json:"city_district_type"`
+	CityDistrictTypeFull interface{} `json:"city_district_type_full"`
+	CityDistrictWithType interface{} `json:"city_district_with_type"`
+	CityFiasID           string      `json:"city_fias_id"`
+	CityKladrID          string      `json:"city_kladr_id"`
+	CityType             string      `json:"city_type"`
+	CityTypeFull         string      `json:"city_type_full"`
+	CityWithType         string      `json:"city_with_type"`
+	Country              string      `json:"country"`
+	CountryIsoCode       string      `json:"country_iso_code"`
+	Divisions            interface{} `json:"divisions"`
+	Entrance             interface{} `json:"entrance"`
+	FederalDistrict      string      `json:"federal_district"`
+	FiasActualityState   string      `json:"fias_actuality_state"`
+	FiasCode             interface{} `json:"fias_code"`
+	FiasID               string      `json:"fias_id"`
+	FiasLevel            string      `json:"fias_level"`
+	Flat                 interface{} `json:"flat"`
+	FlatArea             interface{} `json:"flat_area"`
+	FlatCadnum           interface{} `json:"flat_cadnum"`
+	FlatFiasID           interface{} `json:"flat_fias_id"`
+	FlatPrice            interface{} `json:"flat_price"`
+	FlatType             interface{} `json:"flat_type"`
+	FlatTypeFull         interface{} `json:"flat_type_full"`
+	Floor                interface{} `json:"floor"`
+	GeoLat               string      `json:"geo_lat"`
+	GeoLon               string      `json:"geo_lon"`
+	GeonameID            string      `json:"geoname_id"`
+	HistoryValues        interface{} `json:"history_values"`
+	House                string      `json:"house"`
+	HouseCadnum          interface{} `json:"house_cadnum"`
+	HouseFiasID          string      `json:"house_fias_id"`
+	HouseKladrID         string      `json:"house_kladr_id"`
+	HouseType            string      `json:"house_type"`
+	HouseTypeFull        string      `json:"house_type_full"`
+	KladrID              string      `json:"kladr_id"`
+	Metro                interface{} `json:"metro"`
+	Okato                string      `json:"okato"`
+	Oktmo                string      `json:"oktmo"`
+	PostalBox            interface{} `json:"postal_box"`
+	PostalCode           string      `json:"postal_code"`
+	Qc                   interface{} `json:"qc"`
+	QcComplete           interface{} `json:"qc_complete"`
+	QcGeo                string      `json:"qc_geo"`
+	QcHouse              interface{} `json:"qc_house"`
+	Region               string      `json:"region"`
+	RegionFiasID         string      `json:"region_fias_id"`
+	RegionIsoCode        string      `json:"region_iso_code"`
+	RegionKladrID        string      `json:"region_kladr_id"`
+	RegionType           string      `json:"region_type"`
+	RegionTypeFull       string      `json:"region_type_full"`
+	RegionWithType       string      `json:"region_with_type"`
+	Room                 interface{} `json:"room"`
+	RoomCadnum           interface{} `json:"room_cadnum"`
+	RoomFiasID           interface{} `json:"room_fias_id"`
+	RoomType             interface{} `json:"room_type"`
+	RoomTypeFull         interface{} `json:"room_type_full"`
+	Settlement           interface{} `json:"settlement"`
+	SettlementFiasID     interface{} `json:"settlement_fias_id"`
+	SettlementKladrID    interface{} `json:"settlement_kladr_id"`
+	SettlementType       interface{} `json:"settlement_type"`
+	SettlementTypeFull   interface{} `json:"settlement_type_full"`
+	SettlementWithType   interface{} `json:"settlement_with_type"`
+	Source               interface{} `json:"source"`
+	SquareMeterPrice     interface{} `json:"square_meter_price"`
+	Stead                interface{} `json:"stead"`
+	SteadCadnum          interface{} `json:"stead_cadnum"`
+	SteadFiasID          interface{} `json:"stead_fias_id"`
+	SteadType            interface{} `json:"stead_type"`
+	SteadTypeFull        interface{} `json:"stead_type_full"`
+	Street               string      `json:"street"`
+	StreetFiasID         string      `json:"street_fias_id"`
+	StreetKladrID        string      `json:"street_kladr_id"`
+	StreetType           string      `json:"street_type"`
+	StreetTypeFull       string      `json:"street_type_full"`
+	StreetWithType       string      `json:"street_with_type"`
+	TaxOffice            string      `json:"tax_office"`
+	TaxOfficeLegal       string      `json:"tax_office_legal"`
+	Timezone             interface{} `json:"timezone"`
+	UnparsedParts        interface{} `json:"unparsed_parts"`
+}
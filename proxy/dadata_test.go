@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadDaDataCredentials(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+	list := write("list.json", `[{"name":"main","token":"t1","secret":"s1"},{"token":"t2","secret":"s2"}]`)
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    []DaDataCredential
+		wantErr string
+	}{
+		{"env", Config{DaDataToken: "t", DaDataSecret: "s"}, []DaDataCredential{{Name: "env", Token: "t", Secret: "s"}}, ""},
+		{"file and env", Config{DaDataCredentialsFile: list, DaDataToken: "t", DaDataSecret: "s"}, []DaDataCredential{
+			{Name: "main", Token: "t1", Secret: "s1"},
+			{Name: "2", Token: "t2", Secret: "s2"},
+			{Name: "env", Token: "t", Secret: "s"},
+		}, ""},
+		{"none", Config{}, nil, "none configured"},
+		{"token only", Config{DaDataToken: "t"}, nil, "token and secret are both required"},
+		{"whitespace", Config{DaDataToken: "t t", DaDataSecret: "s"}, nil, "whitespace"},
+		{"missing file", Config{DaDataCredentialsFile: filepath.Join(dir, "none.json")}, nil, "no such file"},
+		{"bad file", Config{DaDataCredentialsFile: write("bad.json", `{"token":"t"}`)}, nil, "decode"},
+		{"same name", Config{DaDataCredentialsFile: write("twice.json", `[{"name":"a","token":"t1","secret":"s1"},{"name":"a","token":"t2","secret":"s2"}]`)}, nil, "used twice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadDaDataCredentials(&tt.cfg)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDaDataCredential_String(t *testing.T) {
+	c := DaDataCredential{Name: "main", Token: "0123456789abcdef0123456789abcdef0123706e", Secret: "fedcba9876543210fedcba9876543210fedcba98"}
+	for _, s := range []string{c.String(), fmt.Sprintf("%v", c), fmt.Sprintf("%+v", c), fmt.Sprintf("%#v", c)} {
+		assert.Equal(t, "main (token ****706e)", s)
+	}
+	assert.Equal(t, "x (token ****)", DaDataCredential{Name: "x", Token: "short"}.String())
+}
+
+func TestDaDataProvider_credentials(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Header.Get("Authorization")+"/"+r.Header.Get("X-Secret"))
+		mu.Unlock()
+		if r.Header.Get("Authorization") == "Token broke" {
+			w.WriteHeader(http.StatusPaymentRequired)
+			return
+		}
+		if r.URL.Path == "/geocode" {
+			w.Write([]byte(`{"suggestions":[]}`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+
+	p := NewDaDataProvider(DaDataConfig{SearchURL: ts.URL, GeocodeURL: ts.URL + "/geocode", Credentials: []DaDataCredential{
+		{Name: "a", Token: "ta", Secret: "sa"},
+		{Name: "broke", Token: "broke", Secret: "sb"},
+	}})
+
+	for i := 0; i < 2; i++ {
+		_, err := p.Search(context.Background(), "Москва")
+		assert.NoError(t, err)
+	}
+	_, err := p.Reverse(context.Background(), 55.75, 37.62)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Token ta/sa", "Token broke/sb", "Token ta/sa", "Token ta/"}, seen)
+
+	p = NewDaDataProvider(DaDataConfig{SearchURL: ts.URL, Credentials: []DaDataCredential{{Name: "broke", Token: "broke", Secret: "sb"}}})
+	_, err = p.Search(context.Background(), "Москва")
+	assert.EqualError(t, err, "error status 402 dadata.ru/api")
+
+	p = NewDaDataProvider(DaDataConfig{SearchURL: ts.URL + "/geocode"})
+	_, err = p.Search(context.Background(), "Москва")
+	assert.ErrorContains(t, err, "decode dadata.ru/api response")
+}
+
+func TestDaDataProvider_retries(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Header.Get("Authorization")+" "+r.URL.Path)
+		mu.Unlock()
+		switch {
+		case r.Header.Get("Authorization") == "Token busy":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case r.URL.Path == "/clean":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"suggestions":[]}`))
+		}
+	}))
+	defer ts.Close()
+
+	p := NewDaDataProvider(DaDataConfig{
+		SearchURL:   ts.URL + "/clean",
+		GeocodeURL:  ts.URL + "/geocode",
+		Client:      NewUpstreamClient(UpstreamConfig{MaxAttempts: 3, RetryBackoff: time.Millisecond}),
+		Credentials: []DaDataCredential{{Name: "busy", Token: "busy"}, {Name: "free", Token: "free"}},
+	})
+
+	_, err := p.Reverse(context.Background(), 55.75, 37.62)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Token busy /geocode", "Token free /geocode"}, seen, "a 429 moves on to the next account")
+
+	seen = nil
+	_, err = p.Search(context.Background(), "Москва")
+	assert.EqualError(t, err, "error status 503 dadata.ru/api")
+	assert.Equal(t, []string{"Token free /clean"}, seen, "the billed clean call is not retried")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+const (
+	GeoProviderDaData    = "dadata"
+	GeoProviderNominatim = "nominatim"
+	GeoProviderPhoton    = "photon"
+	GeoProviderLocal     = "local"
+
+	geoUserAgent = "GeoService/0.0.1"
+)
+
+// GeoProvider looks addresses up in a geocoding backend.
+// Implementations map the backend's answer to Address and must be safe for
+// concurrent use.
+type GeoProvider interface {
+	// Search returns the addresses matching a free form query.
+	Search(ctx context.Context, query string) ([]*Address, error)
+	// Reverse returns the addresses found at or near the point.
+	Reverse(ctx context.Context, lat, lng float64) ([]*Address, error)
+}
+
+// BatchSearcher is implemented by providers that look several queries up in
+// one call. Its result holds the addresses of each query, in query order.
+type BatchSearcher interface {
+	SearchBatch(ctx context.Context, queries []string) ([][]*Address, error)
+}
+
+// Suggester is implemented by providers with an API light enough to call on
+// every keystroke. Providers without one are skipped for suggestions rather
+// than falling back to the full search.
+type Suggester interface {
+	Suggest(ctx context.Context, query string, opts SuggestOptions) ([]*Address, error)
+}
+
+// searchBatch looks queries up with p, in one call when p supports it and one
+// by one otherwise. Any failed query fails the whole batch.
+func searchBatch(ctx context.Context, p GeoProvider, queries []string) ([][]*Address, error) {
+	if b, ok := p.(BatchSearcher); ok {
+		return b.SearchBatch(ctx, queries)
+	}
+	res := make([][]*Address, len(queries))
+	for i, q := range queries {
+		addresses, err := p.Search(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = addresses
+	}
+	return res, nil
+}
+
+// geoProvider is replaced in main by the configured chain, kept in geoChain
+// as well for its health report.
+var (
+	geoProvider GeoProvider = NewDaDataProvider(DaDataConfig{})
+	geoChain    *ProviderChain
+)
+
+// newGeoProvider builds the chain of providers named in cfg.GeoProviders.
+func newGeoProvider(cfg *Config) (*ProviderChain, error) {
+	names := cfg.GeoProviders
+	if len(names) == 0 {
+		names = []string{GeoProviderDaData}
+	}
+
+	chain := NewProviderChain(BreakerConfig{FailureThreshold: cfg.GeoBreakerFailures, OpenTimeout: cfg.GeoBreakerOpen})
+	// One client for all of them, so they share its connection pool.
+	client := NewUpstreamClient(UpstreamConfig{
+		ConnectTimeout:      cfg.UpstreamConnectTimeout,
+		ReadTimeout:         cfg.UpstreamReadTimeout,
+		Timeout:             cfg.UpstreamTimeout,
+		MaxAttempts:         cfg.UpstreamMaxAttempts,
+		RetryBackoff:        cfg.UpstreamRetryBackoff,
+		MaxConnsPerHost:     cfg.UpstreamMaxConnsPerHost,
+		MaxIdleConnsPerHost: cfg.UpstreamMaxIdleConnsPerHost,
+	})
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("geo provider %q listed twice", name)
+		}
+		seen[name] = true
+
+		p, err := buildGeoProvider(name, cfg, client)
+		if err != nil {
+			return nil, err
+		}
+		chain.Add(name, p)
+	}
+	return chain, nil
+}
+
+func buildGeoProvider(name string, cfg *Config, client *http.Client) (GeoProvider, error) {
+	switch name {
+	case GeoProviderDaData:
+		creds, err := loadDaDataCredentials(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewDaDataProvider(DaDataConfig{
+			SearchURL:   cfg.DaDataSearchURL,
+			GeocodeURL:  cfg.DaDataGeocodeURL,
+			SuggestURL:  cfg.DaDataSuggestURL,
+			Client:      client,
+			Credentials: creds,
+		}), nil
+	case GeoProviderNominatim:
+		return NewNominatimProvider(cfg.NominatimURL, client), nil
+	case GeoProviderPhoton:
+		return NewPhotonProvider(cfg.PhotonURL, client), nil
+	case GeoProviderLocal:
+		if cfg.LocalDatasetPath == "" {
+			return nil, fmt.Errorf("geo provider %q needs LOCAL_DATASET_PATH", name)
+		}
+		return LoadLocalProvider(cfg.LocalDatasetPath, cfg.LocalReverseRadius)
+	default:
+		return nil, fmt.Errorf("unknown geo provider %q", name)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGeoProvider answers from fixed data and records the last call.
+type fakeGeoProvider struct {
+	addresses []*Address
+	err       error
+	query     string
+	lat, lng  float64
+}
+
+func (f *fakeGeoProvider) Search(_ context.Context, query string) ([]*Address, error) {
+	f.query = query
+	return f.addresses, f.err
+}
+
+func (f *fakeGeoProvider) Reverse(_ context.Context, lat, lng float64) ([]*Address, error) {
+	f.lat, f.lng = lat, lng
+	return f.addresses, f.err
+}
+
+func Test_newGeoProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		want    []string
+		wantErr bool
+	}{
+		{"default", nil, []string{GeoProviderDaData}, false},
+		{"chain", []string{GeoProviderNominatim, GeoProviderPhoton, GeoProviderDaData}, []string{GeoProviderNominatim, GeoProviderPhoton, GeoProviderDaData}, false},
+		{"twice", []string{GeoProviderDaData, GeoProviderDaData}, nil, true},
+		{"local without dataset", []string{GeoProviderLocal}, nil, true},
+		{"unknown", []string{"google"}, nil, true},
+	}
+	creds := Config{DaDataToken: "token", DaDataSecret: "secret"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := creds
+			cfg.GeoProviders = tt.names
+			chain, err := newGeoProvider(&cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			var got []string
+			for _, h := range chain.Health() {
+				got = append(got, h.Name)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_handleGeoProvider(t *testing.T) {
+	fake := &fakeGeoProvider{addresses: []*Address{{Address: "г Москва", Lat: 55.75396, Lon: 37.620393}}}
+	saved := geoProvider
+	geoProvider = fake
+	defer func() { geoProvider = saved }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	token := "Bearer " + issueTestToken(t, User{Login: "GeoUser", Roles: []string{RoleUser}})
+
+	do := func(url, body string) (int, string) {
+		req, _ := http.NewRequest("POST", ts.URL+url, strings.NewReader(body))
+		req.Header.Set("Authorization", token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res.StatusCode, buf.String()
+	}
+	want := `{"addresses":[{"address":"г Москва","lat":55.75396,"lon":37.620393}]}`
+
+	status, body := do("/api/address/search", `{"query":"Москва"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, want, body)
+	assert.Equal(t, "Москва", fake.query)
+
+	status, body = do("/api/address/geocode", `{"lat":"55.75","lng":"37.62"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, want, body)
+	assert.Equal(t, 55.75, fake.lat)
+	assert.Equal(t, 37.62, fake.lng)
+
+	fake.addresses[0].Details = &AddressDetails{City: "г Москва"}
+	status, body = do("/api/address/search?view=detailed", `{"query":"Москва"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"addresses":[{"address":"г Москва","lat":55.75396,"lon":37.620393,"details":{"city":"г Москва"}}]}`, body)
+	status, body = do("/api/address/search", `{"query":"Москва"}`)
+	assert.Equal(t, want, body, "flat unless asked for")
+
+	status, body = do("/api/address/geocode", `{"lat":59.94,"lng":30.26}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 59.94, fake.lat)
+
+	status, body = do("/api/address/geocode", `{"lat":"north","lng":181}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, `{"error":"validation failed","fields":[{"field":"lat","message":"must be a number"},{"field":"lng","message":"must be between -180 and 180"}]}`, body)
+
+	status, body = do("/api/address/search", `{"query":" М "}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, `{"error":"validation failed","fields":[{"field":"query","message":"must be at least 2 characters long"}]}`, body)
+
+	status, _ = do("/api/address/search", `{"query":"ул \"Заречная\""}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `ул "Заречная"`, fake.query)
+
+	fake.err = errors.New("backend down")
+	status, body = do("/api/address/search", `{"query":"Москва"}`)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, "{\"error\":\"Internal Server Error\"}\n", body)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultGeoCacheSize      = 10000
+	defaultGeoCacheTTL       = 24 * time.Hour
+	defaultGeoCachePrecision = 4 // decimal places, about 11 m
+)
+
+// GeoCacheConfig holds the settings of a CachedProvider.
+type GeoCacheConfig struct {
+	// Size is the number of answers kept in memory.
+	Size int
+	TTL  time.Duration
+	// Dir, when set, keeps answers on disk as well, so they survive a restart
+	// and outlive eviction from memory.
+	Dir string
+	// Precision is the number of decimal places coordinates are rounded to.
+	Precision int
+}
+
+type geoCacheEntry struct {
+	Key       string     `json:"key"`
+	Provider  string     `json:"provider"`
+	Addresses []*Address `json:"addresses"`
+	ExpiresAt time.Time  `json:"expires_at"`
+}
+
+// swagger:model geoCacheStats
+type geoCacheStats struct {
+	// answers served from memory
+	Hits int64 `json:"hits"`
+	// answers served from the disk tier
+	DiskHits int64 `json:"disk_hits"`
+	// lookups that went to the providers
+	Misses int64 `json:"misses"`
+	// misses that waited for an identical lookup already in flight instead of calling the providers
+	Coalesced int64 `json:"coalesced"`
+	// answers dropped from memory to make room
+	Evictions int64 `json:"evictions"`
+	// answers held in memory
+	Entries int `json:"entries"`
+}
+
+type geoFlight struct {
+	done  chan struct{}
+	entry *geoCacheEntry
+	err   error
+}
+
+// CachedProvider answers repeated searches and reverse lookups from a cache
+// in front of another provider. Queries are compared case and whitespace
+// insensitively, coordinates after rounding to the configured precision.
+// Concurrent identical misses share a single upstream call.
+type CachedProvider struct {
+	next GeoProvider
+	cfg  GeoCacheConfig
+	now  func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	flights map[string]*geoFlight
+
+	hits, diskHits, misses, coalesced, evictions int64
+}
+
+func NewCachedProvider(next GeoProvider, cfg GeoCacheConfig) (*CachedProvider, error) {
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+			return nil, fmt.Errorf("geo cache dir: %w", err)
+		}
+	}
+	return &CachedProvider{
+		next:    next,
+		cfg:     cfg,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		flights: make(map[string]*geoFlight),
+	}, nil
+}
+
+func searchKey(query string) string {
+	return "search:" + strings.ToLower(strings.Join(strings.Fields(query), " "))
+}
+
+func (c *CachedProvider) Search(ctx context.Context, query string) ([]*Address, error) {
+	return c.get(ctx, searchKey(query), func(ctx context.Context) ([]*Address, error) {
+		return c.next.Search(ctx, query)
+	})
+}
+
+// SearchBatch answers what it can from the cache and sends the remaining
+// queries on in one batch. Unlike single lookups, batches are not coalesced.
+func (c *CachedProvider) SearchBatch(ctx context.Context, queries []string) ([][]*Address, error) {
+	res := make([][]*Address, len(queries))
+	var missing []string
+	missingAt := map[string][]int{}
+	for i, q := range queries {
+		key := searchKey(q)
+		if e := c.lookup(key); e != nil {
+			res[i] = e.Addresses
+			setAnsweredBy(ctx, e.Provider)
+			continue
+		}
+		if _, ok := missingAt[key]; !ok {
+			missing = append(missing, q)
+		}
+		missingAt[key] = append(missingAt[key], i)
+	}
+	if len(missing) == 0 {
+		return res, nil
+	}
+
+	atomic.AddInt64(&c.misses, int64(len(missing)))
+	fetchCtx, answeredBy := withAnsweredBy(ctx)
+	found, err := searchBatch(fetchCtx, c.next, missing)
+	if err != nil {
+		return nil, err
+	}
+	provider := answeredBy()
+	for j, q := range missing {
+		key := searchKey(q)
+		c.store(&geoCacheEntry{Key: key, Provider: provider, Addresses: found[j], ExpiresAt: c.now().Add(c.cfg.TTL)})
+		for _, i := range missingAt[key] {
+			res[i] = found[j]
+		}
+	}
+	setAnsweredBy(ctx, provider)
+	return res, nil
+}
+
+// Reverse looks the rounded point up, so every point sharing a cache entry gets the same answer.
+func (c *CachedProvider) Reverse(ctx context.Context, lat, lng float64) ([]*Address, error) {
+	lat, lng = roundTo(lat, c.cfg.Precision), roundTo(lng, c.cfg.Precision)
+	return c.get(ctx, c.reverseKey(lat, lng), func(ctx context.Context) ([]*Address, error) {
+		return c.next.Reverse(ctx, lat, lng)
+	})
+}
+
+func (c *CachedProvider) reverseKey(lat, lng float64) string {
+	lat, lng = roundTo(lat, c.cfg.Precision), roundTo(lng, c.cfg.Precision)
+	return "reverse:" + strconv.FormatFloat(lat, 'f', c.cfg.Precision, 64) + "," + strconv.FormatFloat(lng, 'f', c.cfg.Precision, 64)
+}
+
+// Suggest caches suggestions under the query and every option, a point to
+// favour is rounded like in Reverse.
+func (c *CachedProvider) Suggest(ctx context.Context, query string, opts SuggestOptions) ([]*Address, error) {
+	key := "suggest:" + strconv.Itoa(opts.Limit) + ":" + strings.ToLower(strings.Join(opts.Regions, "|"))
+	if opts.Near {
+		opts.Lat, opts.Lng = roundTo(opts.Lat, c.cfg.Precision), roundTo(opts.Lng, c.cfg.Precision)
+		key += ":" + strconv.FormatFloat(opts.Lat, 'f', c.cfg.Precision, 64) + "," + strconv.FormatFloat(opts.Lng, 'f', c.cfg.Precision, 64)
+	}
+	key += ":" + strings.TrimPrefix(searchKey(query), "search:")
+	return c.get(ctx, key, func(ctx context.Context) ([]*Address, error) {
+		return suggest(ctx, c.next, query, opts)
+	})
+}
+
+func roundTo(v float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(v*p) / p
+}
+
+func (c *CachedProvider) get(ctx context.Context, key string, fetch func(ctx context.Context) ([]*Address, error)) ([]*Address, error) {
+	if e := c.lookup(key); e != nil {
+		setAnsweredBy(ctx, e.Provider)
+		return e.Addresses, nil
+	}
+
+	c.mu.Lock()
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		atomic.AddInt64(&c.coalesced, 1)
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// The caller that made the upstream call went away, try on our own.
+		if f.err != nil && errors.Is(f.err, context.Canceled) && ctx.Err() == nil {
+			return c.get(ctx, key, fetch)
+		}
+		if f.err != nil {
+			return nil, f.err
+		}
+		setAnsweredBy(ctx, f.entry.Provider)
+		return f.entry.Addresses, nil
+	}
+	f := &geoFlight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	atomic.AddInt64(&c.misses, 1)
+	fetchCtx, answeredBy := withAnsweredBy(ctx)
+	addresses, err := fetch(fetchCtx)
+	if err == nil {
+		f.entry = &geoCacheEntry{Key: key, Provider: answeredBy(), Addresses: addresses, ExpiresAt: c.now().Add(c.cfg.TTL)}
+		c.store(f.entry)
+		setAnsweredBy(ctx, f.entry.Provider)
+	}
+	f.err = err
+
+	c.mu.Lock()
+	delete(c.flights, key)
+	c.mu.Unlock()
+	close(f.done)
+
+	return addresses, err
+}
+
+// lookup returns the live entry for key from memory or disk, nil on a miss.
+func (c *CachedProvider) lookup(key string) *geoCacheEntry {
+	now := c.now()
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*geoCacheEntry)
+		if now.Before(e.ExpiresAt) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			atomic.AddInt64(&c.hits, 1)
+			return e
+		}
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+
+	if c.cfg.Dir == "" {
+		return nil
+	}
+	var e geoCacheEntry
+	path := c.diskPath(key)
+	if err := readJSONFile(path, &e); err != nil {
+		log.Printf("geocache.go: %v", err)
+		return nil
+	}
+	if e.Key != key {
+		return nil
+	}
+	if !now.Before(e.ExpiresAt) {
+		os.Remove(path)
+		return nil
+	}
+	atomic.AddInt64(&c.diskHits, 1)
+	c.remember(&e)
+	return &e
+}
+
+// has reports whether a live answer for key is cached, without counting a hit.
+func (c *CachedProvider) has(key string) bool {
+	now := c.now()
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	live := ok && now.Before(el.Value.(*geoCacheEntry).ExpiresAt)
+	c.mu.Unlock()
+	if live || c.cfg.Dir == "" {
+		return live
+	}
+	var e geoCacheEntry
+	if err := readJSONFile(c.diskPath(key), &e); err != nil {
+		return false
+	}
+	return e.Key == key && now.Before(e.ExpiresAt)
+}
+
+func (c *CachedProvider) store(e *geoCacheEntry) {
+	c.remember(e)
+	if c.cfg.Dir != "" {
+		if err := writeJSONFile(c.diskPath(e.Key), e); err != nil {
+			log.Printf("geocache.go: save entry: %v", err)
+		}
+	}
+}
+
+// remember puts e into memory, evicting the least recently used entries over the size.
+func (c *CachedProvider) remember(e *geoCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[e.Key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.Key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.cfg.Size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*geoCacheEntry).Key)
+		atomic.AddInt64(&c.evictions, 1)
+	}
+}
+
+func (c *CachedProvider) diskPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.cfg.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Purge drops every cached answer, in memory and on disk.
+func (c *CachedProvider) Purge() error {
+	c.mu.Lock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.mu.Unlock()
+
+	if c.cfg.Dir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(c.cfg.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CachedProvider) Stats() geoCacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+
+	return geoCacheStats{
+		Hits:      atomic.LoadInt64(&c.hits),
+		DiskHits:  atomic.LoadInt64(&c.diskHits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Coalesced: atomic.LoadInt64(&c.coalesced),
+		Evictions: atomic.LoadInt64(&c.evictions),
+		Entries:   entries,
+	}
+}
+
+// geoCache is set in main when caching is enabled.
+var geoCache *CachedProvider
+
+// searchCached and reverseCached report whether geoCache answers a lookup
+// without asking the providers, so that it costs no quota.
+func searchCached(query string) bool {
+	return geoCache != nil && geoCache.has(searchKey(query))
+}
+
+func reverseCached(lat, lng float64) bool {
+	return geoCache != nil && geoCache.has(geoCache.reverseKey(lat, lng))
+}
+
+func handleAdminGeoCache(w http.ResponseWriter, r *http.Request) {
+	if geoCache == nil {
+		writeJSON(w, http.StatusOK, geoCacheStats{})
+		return
+	}
+	writeJSON(w, http.StatusOK, geoCache.Stats())
+}
+
+func handleAdminPurgeGeoCache(w http.ResponseWriter, r *http.Request) {
+	if geoCache != nil {
+		if err := geoCache.Purge(); err != nil {
+			log.Printf("geocache.go: purge: %v", err)
+			writeError(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingGeoProvider counts calls and can hold them until release is closed.
+type countingGeoProvider struct {
+	calls   int32
+	release chan struct{}
+	err     error
+}
+
+func (p *countingGeoProvider) Search(ctx context.Context, query string) ([]*Address, error) {
+	atomic.AddInt32(&p.calls, 1)
+	if p.release != nil {
+		<-p.release
+	}
+	setAnsweredBy(ctx, "fake")
+	return []*Address{{Address: query}}, p.err
+}
+
+func (p *countingGeoProvider) Reverse(ctx context.Context, lat, lng float64) ([]*Address, error) {
+	atomic.AddInt32(&p.calls, 1)
+	setAnsweredBy(ctx, "fake")
+	return []*Address{{Lat: lat, Lon: lng}}, p.err
+}
+
+func TestCachedProvider(t *testing.T) {
+	next := &countingGeoProvider{}
+	c, err := NewCachedProvider(next, GeoCacheConfig{Size: 2, TTL: time.Minute, Precision: 3})
+	assert.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	c.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	res, _ := c.Search(ctx, "Москва  Тверская")
+	assert.Equal(t, "Москва  Тверская", res[0].Address, "the first query goes upstream as typed")
+	ctx2, answeredBy := withAnsweredBy(ctx)
+	res, _ = c.Search(ctx2, " москва тверская ")
+	assert.Equal(t, "Москва  Тверская", res[0].Address)
+	assert.Equal(t, "fake", answeredBy(), "hits report the provider that answered")
+	assert.Equal(t, int32(1), next.calls)
+
+	res, _ = c.Reverse(ctx, 55.75123, 37.61987)
+	assert.Equal(t, &Address{Lat: 55.751, Lon: 37.62}, res[0], "the rounded point goes upstream")
+	c.Reverse(ctx, 55.7514, 37.6204)
+	assert.Equal(t, int32(2), next.calls)
+
+	c.Search(ctx, "Казань")
+	assert.Equal(t, int64(1), c.Stats().Evictions)
+	c.Search(ctx, "москва тверская")
+	assert.Equal(t, int32(4), next.calls, "the least recently used entry was evicted")
+
+	now = now.Add(time.Minute)
+	c.Search(ctx, "Казань")
+	assert.Equal(t, int32(5), next.calls, "expired")
+
+	next.err = errors.New("offline")
+	_, err = c.Search(ctx, "Тула")
+	assert.Error(t, err)
+	_, err = c.Search(ctx, "Тула")
+	assert.Error(t, err)
+	assert.Equal(t, int32(7), next.calls, "errors are not cached")
+
+	assert.Equal(t, geoCacheStats{Hits: 2, Misses: 7, Evictions: 2, Entries: 2}, c.Stats())
+}
+
+func TestCachedProvider_disk(t *testing.T) {
+	dir := t.TempDir()
+	next := &countingGeoProvider{}
+	c, err := NewCachedProvider(next, GeoCacheConfig{Size: 10, TTL: time.Hour, Dir: dir})
+	assert.NoError(t, err)
+	c.Search(context.Background(), "Москва")
+
+	// A new cache over the same directory, as after a restart.
+	c, err = NewCachedProvider(next, GeoCacheConfig{Size: 10, TTL: time.Hour, Dir: dir})
+	assert.NoError(t, err)
+	res, err := c.Search(context.Background(), "МОСКВА")
+	assert.NoError(t, err)
+	assert.Equal(t, "Москва", res[0].Address)
+	c.Search(context.Background(), "МОСКВА")
+	assert.Equal(t, int32(1), next.calls)
+	assert.Equal(t, int64(1), c.Stats().DiskHits)
+	assert.Equal(t, int64(1), c.Stats().Hits)
+
+	assert.NoError(t, c.Purge())
+	c.Search(context.Background(), "Москва")
+	assert.Equal(t, int32(2), next.calls)
+}
+
+func TestCachedProvider_coalescing(t *testing.T) {
+	next := &countingGeoProvider{release: make(chan struct{})}
+	c, err := NewCachedProvider(next, GeoCacheConfig{Size: 10, TTL: time.Hour})
+	assert.NoError(t, err)
+
+	const callers = 5
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.Search(context.Background(), "Москва")
+			assert.NoError(t, err)
+			assert.Len(t, res, 1)
+		}()
+	}
+	for atomic.LoadInt64(&c.coalesced) < callers-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(next.release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), next.calls)
+	assert.Equal(t, int64(1), c.Stats().Misses)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// geoProviderHeader names the provider that answered a search or geocode request.
+const geoProviderHeader = "X-Geo-Provider"
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+var ErrNoGeoProvider = errors.New("no geo provider available")
+
+// BreakerConfig holds the limits of the circuit breaker kept for each provider.
+type BreakerConfig struct {
+	// FailureThreshold consecutive failures open the breaker.
+	FailureThreshold int
+	// OpenTimeout is how long an open breaker rejects calls before letting one through as a trial.
+	OpenTimeout time.Duration
+}
+
+var defaultBreakerConfig = BreakerConfig{FailureThreshold: 5, OpenTimeout: 30 * time.Second}
+
+// circuitBreaker stops calls to a provider that keeps failing. After
+// OpenTimeout a single trial call is let through, its outcome closes the
+// breaker again or reopens it.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	cfg      BreakerConfig
+	state    string
+	failures int
+	openedAt time.Time
+	now      func() time.Time
+}
+
+func newCircuitBreaker(cfg BreakerConfig) *circuitBreaker {
+	return &circuitBreaker{cfg: cfg, state: breakerClosed, now: time.Now}
+}
+
+// Allow reports whether a call may go ahead.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cfg.OpenTimeout {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	default:
+		// A trial call is already on its way.
+		return false
+	}
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.cfg.FailureThreshold {
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// Release gives back a trial call that ended without an outcome, e.g. because
+// the client went away.
+func (b *circuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+		b.openedAt = b.now().Add(-b.cfg.OpenTimeout)
+	}
+}
+
+func (b *circuitBreaker) State() (string, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state, b.failures
+}
+
+// swagger:model geoProviderHealth
+type geoProviderHealth struct {
+	// provider name
+	//
+	// example: dadata
+	Name string `json:"name"`
+	// circuit breaker state: closed, open or half-open
+	//
+	// example: closed
+	State string `json:"state"`
+	// failures since the last success
+	//
+	// example: 0
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// calls made to the provider
+	Requests int64 `json:"requests"`
+	// calls the provider answered, each also counts as a request answered by it
+	Successes int64 `json:"successes"`
+	// calls that failed and were passed on to the next provider
+	Failures int64 `json:"failures"`
+	// calls skipped because the breaker was open
+	Rejected int64 `json:"rejected"`
+	// last failure, absent if there was none
+	LastError string `json:"last_error,omitempty"`
+	// time of the last failure
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+}
+
+type chainLink struct {
+	name     string
+	provider GeoProvider
+	breaker  *circuitBreaker
+
+	mu    sync.Mutex
+	stats geoProviderHealth
+}
+
+func (l *chainLink) record(fn func(s *geoProviderHealth)) {
+	l.mu.Lock()
+	fn(&l.stats)
+	l.mu.Unlock()
+}
+
+// ProviderChain asks its providers in order and fails over to the next one
+// when a provider errors or its circuit breaker is open.
+type ProviderChain struct {
+	links []*chainLink
+	cfg   BreakerConfig
+}
+
+func NewProviderChain(cfg BreakerConfig) *ProviderChain {
+	return &ProviderChain{cfg: cfg}
+}
+
+// Add appends provider to the end of the chain under name.
+func (c *ProviderChain) Add(name string, provider GeoProvider) {
+	c.links = append(c.links, &chainLink{
+		name:     name,
+		provider: provider,
+		breaker:  newCircuitBreaker(c.cfg),
+		stats:    geoProviderHealth{Name: name},
+	})
+}
+
+func (c *ProviderChain) Search(ctx context.Context, query string) ([]*Address, error) {
+	var res []*Address
+	err := c.call(ctx, "search", func(p GeoProvider) (err error) {
+		res, err = p.Search(ctx, query)
+		return err
+	})
+	return res, err
+}
+
+func (c *ProviderChain) Reverse(ctx context.Context, lat, lng float64) ([]*Address, error) {
+	var res []*Address
+	err := c.call(ctx, "reverse", func(p GeoProvider) (err error) {
+		res, err = p.Reverse(ctx, lat, lng)
+		return err
+	})
+	return res, err
+}
+
+// SearchBatch hands the whole batch to one provider at a time, a provider
+// failing any query fails over with the whole batch.
+func (c *ProviderChain) SearchBatch(ctx context.Context, queries []string) ([][]*Address, error) {
+	var res [][]*Address
+	err := c.call(ctx, "batch search", func(p GeoProvider) (err error) {
+		res, err = searchBatch(ctx, p, queries)
+		return err
+	})
+	return res, err
+}
+
+// Suggest asks the providers that have suggestions, the others are passed over
+// without counting against them.
+func (c *ProviderChain) Suggest(ctx context.Context, query string, opts SuggestOptions) ([]*Address, error) {
+	var res []*Address
+	err := c.call(ctx, "suggest", func(p GeoProvider) (err error) {
+		res, err = suggest(ctx, p, query, opts)
+		return err
+	})
+	return res, err
+}
+
+// call runs fn against the providers in order until one succeeds, fn keeps its own results.
+func (c *ProviderChain) call(ctx context.Context, op string, fn func(p GeoProvider) error) error {
+	for _, l := range c.links {
+		if !l.breaker.Allow() {
+			l.record(func(s *geoProviderHealth) { s.Rejected++ })
+			continue
+		}
+
+		err := fn(l.provider)
+		if errors.Is(err, errSuggestUnsupported) {
+			l.breaker.Release()
+			continue
+		}
+		if err == nil {
+			l.breaker.Success()
+			l.record(func(s *geoProviderHealth) { s.Requests++; s.Successes++ })
+			setAnsweredBy(ctx, l.name)
+			return nil
+		}
+		if ctx.Err() != nil {
+			// The client gave up, that says nothing about the provider.
+			l.breaker.Release()
+			return ctx.Err()
+		}
+
+		l.breaker.Failure()
+		now := time.Now()
+		l.record(func(s *geoProviderHealth) {
+			s.Requests++
+			s.Failures++
+			s.LastError = err.Error()
+			s.LastFailure = &now
+		})
+		log.Printf("geochain.go: %s %s failed: %v", l.name, op, err)
+	}
+	return ErrNoGeoProvider
+}
+
+// Health returns the state and counters of every provider in chain order.
+func (c *ProviderChain) Health() []geoProviderHealth {
+	res := make([]geoProviderHealth, len(c.links))
+	for i, l := range c.links {
+		l.mu.Lock()
+		res[i] = l.stats
+		l.mu.Unlock()
+		res[i].State, res[i].ConsecutiveFailures = l.breaker.State()
+	}
+	return res
+}
+
+type answeredByKey struct{}
+
+// withAnsweredBy returns a context in which ProviderChain notes the provider
+// that answered, the returned func reads it back.
+func withAnsweredBy(ctx context.Context) (context.Context, func() string) {
+	var mu sync.Mutex
+	var name string
+	set := func(n string) {
+		mu.Lock()
+		name = n
+		mu.Unlock()
+	}
+	get := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return name
+	}
+	return context.WithValue(ctx, answeredByKey{}, set), get
+}
+
+func setAnsweredBy(ctx context.Context, name string) {
+	if set, ok := ctx.Value(answeredByKey{}).(func(string)); ok {
+		set(name)
+	}
+}
+
+func handleAdminGeoProviders(w http.ResponseWriter, r *http.Request) {
+	if geoChain == nil {
+		writeJSON(w, http.StatusOK, []geoProviderHealth{})
+		return
+	}
+	writeJSON(w, http.StatusOK, geoChain.Health())
+}
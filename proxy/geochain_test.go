@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_circuitBreaker(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := newCircuitBreaker(BreakerConfig{FailureThreshold: 2, OpenTimeout: time.Minute})
+	b.now = func() time.Time { return now }
+
+	assert.True(t, b.Allow())
+	b.Failure()
+	assert.True(t, b.Allow())
+	b.Failure()
+	assert.False(t, b.Allow(), "open after the threshold")
+
+	now = now.Add(time.Minute)
+	assert.True(t, b.Allow(), "one trial after the timeout")
+	assert.False(t, b.Allow(), "only one trial at a time")
+	b.Failure()
+	state, _ := b.State()
+	assert.Equal(t, breakerOpen, state)
+
+	now = now.Add(time.Minute)
+	assert.True(t, b.Allow())
+	b.Release()
+	assert.True(t, b.Allow(), "a released trial can be retried at once")
+	b.Success()
+	state, failures := b.State()
+	assert.Equal(t, breakerClosed, state)
+	assert.Zero(t, failures)
+}
+
+func Test_ProviderChain(t *testing.T) {
+	primary := &fakeGeoProvider{err: errors.New("error status 500 dadata.ru/api")}
+	secondary := &fakeGeoProvider{addresses: []*Address{{Address: "г Москва"}}}
+	chain := NewProviderChain(BreakerConfig{FailureThreshold: 2, OpenTimeout: time.Hour})
+	chain.Add("dadata", primary)
+	chain.Add("local", secondary)
+
+	for i := 0; i < 3; i++ {
+		ctx, answeredBy := withAnsweredBy(context.Background())
+		res, err := chain.Search(ctx, "Москва")
+		assert.NoError(t, err)
+		assert.Equal(t, secondary.addresses, res)
+		assert.Equal(t, "local", answeredBy())
+	}
+
+	health := chain.Health()
+	assert.Equal(t, "dadata", health[0].Name)
+	assert.Equal(t, breakerOpen, health[0].State)
+	assert.Equal(t, int64(2), health[0].Failures)
+	assert.Equal(t, int64(1), health[0].Rejected)
+	assert.Equal(t, "error status 500 dadata.ru/api", health[0].LastError)
+	assert.Equal(t, int64(3), health[1].Successes)
+
+	secondary.err = errors.New("broken dataset")
+	_, err := chain.Reverse(context.Background(), 55.75, 37.62)
+	assert.ErrorIs(t, err, ErrNoGeoProvider)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = chain.Search(ctx, "Москва")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int64(1), chain.Health()[1].Failures, "cancelled calls are not failures")
+}
+
+func Test_handleGeoProviderChain(t *testing.T) {
+	chain := NewProviderChain(defaultBreakerConfig)
+	chain.Add("down", &fakeGeoProvider{err: errors.New("offline")})
+	savedProvider, savedChain := geoProvider, geoChain
+	geoProvider, geoChain = chain, chain
+	defer func() { geoProvider, geoChain = savedProvider, savedChain }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	user := "Bearer " + issueTestToken(t, User{Login: "ChainUser", Roles: []string{RoleUser}})
+	admin := "Bearer " + issueTestToken(t, User{Login: "ChainAdmin", Roles: []string{RoleAdmin}})
+
+	do := func(method, url, body, token string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		req.Header.Set("Authorization", token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res, buf.String()
+	}
+
+	res, body := do("POST", "/api/address/search", `{"query":"Москва"}`, user)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, "{\"error\":\"Geo providers unavailable\"}\n", body)
+
+	chain.Add("local", &fakeGeoProvider{addresses: []*Address{}})
+	res, body = do("POST", "/api/address/geocode", `{"lat":"55.75","lng":"37.62"}`, user)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "local", res.Header.Get(geoProviderHeader))
+	assert.Equal(t, `{"addresses":[]}`, body)
+
+	res, body = do("GET", "/api/admin/providers", "", admin)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, body, `{"name":"down","state":"closed","consecutive_failures":2,"requests":2,"successes":0,"failures":2,"rejected":0,"last_error":"offline"`)
+
+	res, _ = do("GET", "/api/admin/providers", "", user)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	geoJSONMediaType = "application/geo+json"
+	formatGeoJSON    = "geojson"
+)
+
+// FeatureCollection is the GeoJSON form of a list of addresses, RFC 7946.
+//
+// swagger:model featureCollection
+type FeatureCollection struct {
+	// required: true
+	// example: FeatureCollection
+	Type string `json:"type"`
+	// one Point feature per address, in the order of the JSON answer
+	Features []Feature `json:"features"`
+}
+
+// swagger:model feature
+type Feature struct {
+	// required: true
+	// example: Feature
+	Type     string        `json:"type"`
+	Geometry PointGeometry `json:"geometry"`
+	// the address without its coordinates
+	Properties FeatureProperties `json:"properties"`
+}
+
+// swagger:model pointGeometry
+type PointGeometry struct {
+	// required: true
+	// example: Point
+	Type string `json:"type"`
+	// longitude and latitude, in that order
+	//
+	// example: [37.6156, 55.7522]
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// swagger:model featureProperties
+type FeatureProperties struct {
+	// example: г Москва, Красная пл
+	Address string `json:"address"`
+	// structured address, only in the detailed view
+	Details *AddressDetails `json:"details,omitempty"`
+	// metres from the point the request sorted by, if any
+	Distance *float64 `json:"distance,omitempty"`
+}
+
+func newFeatureCollection(addresses []*Address) *FeatureCollection {
+	fc := &FeatureCollection{Type: "FeatureCollection", Features: make([]Feature, len(addresses))}
+	for i, a := range addresses {
+		fc.Features[i] = Feature{
+			Type:       "Feature",
+			Geometry:   PointGeometry{Type: "Point", Coordinates: [2]float64{a.Lon, a.Lat}},
+			Properties: FeatureProperties{Address: a.Address, Details: a.Details, Distance: a.Distance},
+		}
+	}
+	return fc
+}
+
+// wantsGeoJSON reports whether the client asked for GeoJSON, with
+// ?format=geojson or with an Accept header preferring application/geo+json
+// to application/json. The query parameter wins over the header.
+func wantsGeoJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == formatGeoJSON
+	}
+	var geoQ, jsonQ float64
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case geoJSONMediaType:
+			if q > geoQ {
+				geoQ = q
+			}
+		case "application/json", "application/*", "*/*":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		}
+	}
+	return geoQ > 0 && geoQ >= jsonQ
+}
+
+// writeGeoJSON sends addresses as a FeatureCollection.
+func writeGeoJSON(w http.ResponseWriter, addresses []*Address) {
+	w.Header().Set("Content-Type", geoJSONMediaType)
+	body, _ := json.Marshal(newFeatureCollection(addresses))
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
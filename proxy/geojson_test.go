@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_wantsGeoJSON(t *testing.T) {
+	tests := []struct {
+		url, accept string
+		want        bool
+	}{
+		{"/", "", false},
+		{"/", "*/*", false},
+		{"/", "application/geo+json", true},
+		{"/", "application/json, application/geo+json", true},
+		{"/", "application/geo+json;q=0.5, application/json", false},
+		{"/", "application/geo+json, */*;q=0.1", true},
+		{"/", "application/geo+json;q=0", false},
+		{"/?format=geojson", "", true},
+		{"/?format=json", "application/geo+json", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", tt.url, nil)
+		r.Header.Set("Accept", tt.accept)
+		assert.Equal(t, tt.want, wantsGeoJSON(r), "%s %s", tt.url, tt.accept)
+	}
+}
+
+func Test_handleGeoJSON(t *testing.T) {
+	saved := geoProvider
+	geoProvider = &fakeGeoProvider{addresses: []*Address{
+		{Address: "г Москва, Красная пл", Lat: 55.7522, Lon: 37.6156, Details: &AddressDetails{City: "г Москва"}},
+	}}
+	defer func() { geoProvider = saved }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	token := "Bearer " + issueTestToken(t, User{Login: "GeoJSONUser", Roles: []string{RoleUser}})
+	do := func(url, accept, body string) (*http.Response, string) {
+		req, _ := http.NewRequest("POST", ts.URL+url, strings.NewReader(body))
+		req.Header.Set("Authorization", token)
+		req.Header.Set("Accept", accept)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res, buf.String()
+	}
+
+	res, body := do("/api/address/search?format=geojson", "", `{"query":"Красная","near":{"lat":55.7522,"lng":37.6156}}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/geo+json", res.Header.Get("Content-Type"))
+	assert.Equal(t, `{"type":"FeatureCollection","features":[{"type":"Feature",`+
+		`"geometry":{"type":"Point","coordinates":[37.6156,55.7522]},`+
+		`"properties":{"address":"г Москва, Красная пл","distance":0}}]}`, body)
+
+	res, body = do("/api/address/geocode?view=detailed", "application/geo+json", `{"lat":55.7522,"lng":37.6156}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/geo+json", res.Header.Get("Content-Type"))
+	assert.Contains(t, res.Header.Values("Vary"), "Accept")
+	assert.Equal(t, `{"type":"FeatureCollection","features":[{"type":"Feature",`+
+		`"geometry":{"type":"Point","coordinates":[37.6156,55.7522]},`+
+		`"properties":{"address":"г Москва, Красная пл","details":{"city":"г Москва"}}}]}`, body)
+
+	res, body = do("/api/address/geocode", "application/json", `{"lat":55.7522,"lng":37.6156}`)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	assert.Equal(t, `{"addresses":[{"address":"г Москва, Красная пл","lat":55.7522,"lon":37.6156}]}`, body)
+
+	geoProvider = &fakeGeoProvider{}
+	_, body = do("/api/address/search?format=geojson", "", `{"query":"Красная"}`)
+	assert.Equal(t, `{"type":"FeatureCollection","features":[]}`, body)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// distanceMetres returns the great circle distance between two points.
+func distanceMetres(lat1, lng1, lat2, lng2 float64) float64 {
+	return chordToMetres(toPoint3(lat1, lng1).dist2(toPoint3(lat2, lng2)))
+}
+
+// GeoPoint is a point given by its coordinates.
+//
+// swagger:model geoPoint
+type GeoPoint struct {
+	// latitude, a number or a numeric string
+	//
+	// required: true
+	// example: 55.7522
+	Lat Coordinate `json:"lat"`
+	// longitude, a number or a numeric string
+	//
+	// required: true
+	// example: 37.6156
+	Lng Coordinate `json:"lng"`
+}
+
+// checkGeoPoint returns what is wrong with p, field prefixes the names.
+func checkGeoPoint(field string, p *GeoPoint) []FieldError {
+	return append(checkCoordinate(field+".lat", p.Lat, 90), checkCoordinate(field+".lng", p.Lng, 180)...)
+}
+
+// BoundingBox is the area between two parallels and two meridians. A box
+// with west east of east crosses the antimeridian.
+//
+// swagger:model boundingBox
+type BoundingBox struct {
+	// required: true
+	// example: 55.57
+	South Coordinate `json:"south"`
+	// required: true
+	// example: 37.36
+	West Coordinate `json:"west"`
+	// required: true
+	// example: 55.91
+	North Coordinate `json:"north"`
+	// required: true
+	// example: 37.84
+	East Coordinate `json:"east"`
+}
+
+// Contains reports whether a lies in the box, edges included.
+func (b *BoundingBox) Contains(a *Address) bool {
+	if a.Lat < b.South.Value || a.Lat > b.North.Value {
+		return false
+	}
+	if b.West.Value <= b.East.Value {
+		return a.Lon >= b.West.Value && a.Lon <= b.East.Value
+	}
+	return a.Lon >= b.West.Value || a.Lon <= b.East.Value
+}
+
+// checkBoundingBox returns what is wrong with b, field prefixes the names.
+func checkBoundingBox(field string, b *BoundingBox) []FieldError {
+	var errs []FieldError
+	errs = append(errs, checkCoordinate(field+".south", b.South, 90)...)
+	errs = append(errs, checkCoordinate(field+".west", b.West, 180)...)
+	errs = append(errs, checkCoordinate(field+".north", b.North, 90)...)
+	errs = append(errs, checkCoordinate(field+".east", b.East, 180)...)
+	if len(errs) == 0 && b.South.Value > b.North.Value {
+		errs = append(errs, FieldError{Field: field + ".south", Message: "must not be north of north"})
+	}
+	return errs
+}
+
+// withinBounds returns the addresses inside b.
+func withinBounds(addresses []*Address, b *BoundingBox) []*Address {
+	res := make([]*Address, 0, len(addresses))
+	for _, a := range addresses {
+		if b.Contains(a) {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// byDistance returns addresses nearest to p first, equally distant ones keep
+// their order. Each carries its distance.
+func byDistance(addresses []*Address, p *GeoPoint) []*Address {
+	res := editAddresses(addresses, func(a *Address) {
+		d := distanceMetres(p.Lat.Value, p.Lng.Value, a.Lat, a.Lon)
+		a.Distance = &d
+	})
+	sort.SliceStable(res, func(i, j int) bool { return *res[i].Distance < *res[j].Distance })
+	return res
+}
+
+// arrangeSearchResults applies the bounds and near options of req to addresses.
+func arrangeSearchResults(addresses []*Address, req *SearchRequest) []*Address {
+	if req.Bounds != nil {
+		addresses = withinBounds(addresses, req.Bounds)
+	}
+	if req.Near != nil {
+		addresses = byDistance(addresses, req.Near)
+	}
+	return addresses
+}
+
+// DistancePoint is one end of a distance, given either by its coordinates or
+// by an address to look up.
+//
+// swagger:model distancePoint
+type DistancePoint struct {
+	// address to look up, instead of lat and lng
+	//
+	// example: г Москва, Красная пл
+	Address string `json:"address,omitempty"`
+	// example: 55.7522
+	Lat Coordinate `json:"lat"`
+	// example: 37.6156
+	Lng Coordinate `json:"lng"`
+}
+
+// swagger:model distanceRequest
+type DistanceRequest struct {
+	// required: true
+	From *DistancePoint `json:"from"`
+	// required: true
+	To *DistancePoint `json:"to"`
+}
+
+// swagger:model distanceResponse
+type DistanceResponse struct {
+	// great circle distance in metres
+	//
+	// example: 2516.4
+	Distance float64 `json:"distance"`
+	// the ends, as found when given by address
+	From *Address `json:"from"`
+	To   *Address `json:"to"`
+}
+
+// validateDistanceRequest returns every rule req breaks.
+func validateDistanceRequest(req *DistanceRequest) []FieldError {
+	var errs []FieldError
+	for _, end := range []struct {
+		field string
+		p     *DistancePoint
+	}{{"from", req.From}, {"to", req.To}} {
+		switch {
+		case end.p == nil:
+			errs = append(errs, FieldError{Field: end.field, Message: "is required"})
+		case strings.TrimSpace(end.p.Address) != "":
+			if end.p.Lat.Set || end.p.Lng.Set {
+				errs = append(errs, FieldError{Field: end.field, Message: "takes either an address or lat and lng, not both"})
+			} else if n := len([]rune(strings.TrimSpace(end.p.Address))); n < queryMinLength {
+				errs = append(errs, FieldError{Field: end.field + ".address", Message: fmt.Sprintf("must be at least %d characters long", queryMinLength)})
+			}
+		default:
+			errs = append(errs, checkGeoPoint(end.field, &GeoPoint{Lat: end.p.Lat, Lng: end.p.Lng})...)
+		}
+	}
+	return errs
+}
+
+var errAddressNotFound = errors.New("address not found")
+
+// locate returns the address at p, looking its address up when given.
+func locate(r *http.Request, p *DistancePoint) (*Address, error) {
+	query := strings.TrimSpace(p.Address)
+	if query == "" {
+		return &Address{Lat: p.Lat.Value, Lon: p.Lng.Value}, nil
+	}
+	addresses, err := geoProvider.Search(r.Context(), query)
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		return nil, errAddressNotFound
+	}
+	return addresses[0], nil
+}
+
+func handleDistance(w http.ResponseWriter, r *http.Request) {
+	var req DistanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if fields := validateDistanceRequest(&req); len(fields) > 0 {
+		writeValidationError(w, fields, http.StatusBadRequest)
+		return
+	}
+	// Only the ends given as an address are looked up.
+	lookups := 0
+	for _, p := range []*DistancePoint{req.From, req.To} {
+		if strings.TrimSpace(p.Address) != "" {
+			lookups++
+		}
+	}
+	if err := spendQuota(r.Context(), lookups); err != nil {
+		writeQuotaExceeded(w)
+		return
+	}
+
+	res := DistanceResponse{}
+	var notFound []FieldError
+	for _, end := range []struct {
+		field string
+		p     *DistancePoint
+		a     **Address
+	}{{"from", req.From, &res.From}, {"to", req.To, &res.To}} {
+		a, err := locate(r, end.p)
+		switch {
+		case errors.Is(err, errAddressNotFound):
+			notFound = append(notFound, FieldError{Field: end.field + ".address", Message: "was not found"})
+			continue
+		case errors.Is(err, ErrNoGeoProvider):
+			writeError(w, "Geo providers unavailable", http.StatusServiceUnavailable)
+			return
+		case err != nil && r.Context().Err() != nil:
+			return
+		case err != nil:
+			log.Printf("geometry.go: %v", err)
+			writeError(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		*end.a = a
+	}
+	if len(notFound) > 0 {
+		writeValidationError(w, notFound, http.StatusUnprocessableEntity)
+		return
+	}
+
+	res.Distance = distanceMetres(res.From.Lat, res.From.Lon, res.To.Lat, res.To.Lon)
+	w.Header().Add("Vary", "Accept")
+	res.From = viewAddresses([]*Address{res.From}, addressView(r))[0]
+	res.To = viewAddresses([]*Address{res.To}, addressView(r))[0]
+	writeJSON(w, http.StatusOK, res)
+}
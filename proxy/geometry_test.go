@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mapGeoProvider answers searches from a map of query to addresses.
+type mapGeoProvider struct {
+	fakeGeoProvider
+	byQuery map[string][]*Address
+}
+
+func (m *mapGeoProvider) Search(_ context.Context, query string) ([]*Address, error) {
+	return m.byQuery[query], nil
+}
+
+func Test_distanceMetres(t *testing.T) {
+	assert.InDelta(t, 634459.1, distanceMetres(55.7539, 37.6208, 59.9390, 30.3158), 0.5)
+	assert.InDelta(t, 111194.9, distanceMetres(0, 179.5, 0, -179.5), 0.5, "across the antimeridian")
+	assert.Equal(t, 0.0, distanceMetres(55.75, 37.62, 55.75, 37.62))
+}
+
+func TestBoundingBox_Contains(t *testing.T) {
+	box := func(s, w, n, e float64) *BoundingBox {
+		c := func(v float64) Coordinate { return Coordinate{Value: v, Set: true, Valid: true} }
+		return &BoundingBox{South: c(s), West: c(w), North: c(n), East: c(e)}
+	}
+	moscow := box(55.57, 37.36, 55.91, 37.84)
+	assert.True(t, moscow.Contains(&Address{Lat: 55.75, Lon: 37.62}))
+	assert.True(t, moscow.Contains(&Address{Lat: 55.57, Lon: 37.84}), "edges included")
+	assert.False(t, moscow.Contains(&Address{Lat: 59.93, Lon: 30.36}))
+
+	chukotka := box(60, 170, 70, -170)
+	assert.True(t, chukotka.Contains(&Address{Lat: 65, Lon: 175}))
+	assert.True(t, chukotka.Contains(&Address{Lat: 65, Lon: -175}))
+	assert.False(t, chukotka.Contains(&Address{Lat: 65, Lon: 0}))
+
+	assert.Equal(t, []FieldError{{"bounds.south", "must not be north of north"}}, checkBoundingBox("bounds", box(56, 37, 55, 38)))
+	assert.Equal(t, []FieldError{{"bounds.east", "is required"}}, checkBoundingBox("bounds", &BoundingBox{South: moscow.South, West: moscow.West, North: moscow.North}))
+}
+
+func Test_handleDistance(t *testing.T) {
+	kremlin := &Address{Address: "г Москва, Кремль", Lat: 55.7520, Lon: 37.6175, Details: &AddressDetails{City: "г Москва"}}
+	saved, savedLimiter := geoProvider, usageLimiter
+	geoProvider = &mapGeoProvider{byQuery: map[string][]*Address{"Кремль": {kremlin}}}
+	usageLimiter, _ = NewUsageLimiter(map[string]RateLimit{RoleUser: {Daily: 10}}, "")
+	defer func() { geoProvider, usageLimiter = saved, savedLimiter }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	token := "Bearer " + issueTestToken(t, User{Login: "DistanceUser", Roles: []string{RoleUser}})
+	do := func(body string) (*http.Response, string) {
+		req, _ := http.NewRequest("POST", ts.URL+"/api/address/distance", strings.NewReader(body))
+		req.Header.Set("Authorization", token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res, buf.String()
+	}
+
+	res, body := do(`{"from":{"lat":55.7539,"lng":"37.6208"},"to":{"lat":59.9390,"lng":30.3158}}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var got DistanceResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &got))
+	assert.InDelta(t, 634459.1, got.Distance, 0.5)
+	assert.Equal(t, &Address{Lat: 55.7539, Lon: 37.6208}, got.From)
+	assert.Empty(t, res.Header.Get("X-RateLimit-Daily-Remaining"), "no lookup, nothing counted")
+
+	res, body = do(`{"from":{"address":" Кремль "},"to":{"lat":55.7539,"lng":37.6208}}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	got = DistanceResponse{}
+	assert.NoError(t, json.Unmarshal([]byte(body), &got))
+	assert.Equal(t, "г Москва, Кремль", got.From.Address)
+	assert.Nil(t, got.From.Details, "flat view by default")
+	assert.InDelta(t, distanceMetres(55.7520, 37.6175, 55.7539, 37.6208), got.Distance, 0.01)
+	assert.Equal(t, "9", res.Header.Get("X-RateLimit-Daily-Remaining"))
+
+	res, body = do(`{"from":{"address":"Кремль","lat":1},"to":{"lat":91,"lng":0}}`)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, `{"error":"validation failed","fields":[`+
+		`{"field":"from","message":"takes either an address or lat and lng, not both"},`+
+		`{"field":"to.lat","message":"must be between -90 and 90"}]}`, body)
+
+	res, body = do(`{"from":{"address":"Кремль"},"to":{"address":"Атлантида"}}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+	assert.Equal(t, `{"error":"validation failed","fields":[{"field":"to.address","message":"was not found"}]}`, body)
+	assert.Equal(t, "7", res.Header.Get("X-RateLimit-Daily-Remaining"), "two lookups")
+}
+
+func Test_handleGeoSearchArranged(t *testing.T) {
+	spb := &Address{Address: "г Санкт-Петербург, Ленинский пр-кт", Lat: 59.85, Lon: 30.25}
+	far := &Address{Address: "г Москва, ул Сухонская", Lat: 55.87, Lon: 37.65}
+	near := &Address{Address: "г Москва, Ленинский пр-кт", Lat: 55.70, Lon: 37.58}
+	saved := geoProvider
+	geoProvider = &fakeGeoProvider{addresses: []*Address{spb, far, near}}
+	defer func() { geoProvider = saved }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	token := "Bearer " + issueTestToken(t, User{Login: "ArrangeUser", Roles: []string{RoleUser}})
+	req, _ := http.NewRequest("POST", ts.URL+"/api/address/search", strings.NewReader(
+		`{"query":"Ленинский","bounds":{"south":55.57,"west":37.36,"north":55.91,"east":37.84},"near":{"lat":55.7,"lng":37.58}}`))
+	req.Header.Set("Authorization", token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var got SearchResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+	assert.Len(t, got.Addresses, 2)
+	assert.Equal(t, near.Address, got.Addresses[0].Address)
+	assert.Equal(t, 0.0, *got.Addresses[0].Distance)
+	assert.Equal(t, far.Address, got.Addresses[1].Address)
+	assert.InDelta(t, distanceMetres(55.7, 37.58, far.Lat, far.Lon), *got.Addresses[1].Distance, 0.01)
+	assert.Nil(t, far.Distance, "the provider's addresses are left alone")
+}
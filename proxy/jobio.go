@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	jobFormatCSV    = "csv"
+	jobFormatNDJSON = "ndjson"
+
+	jobKindSearch  = "search"
+	jobKindReverse = "reverse"
+)
+
+// resultColumns are appended to every row of a CSV job result.
+var resultColumns = []string{"result_address", "result_lat", "result_lon", "error"}
+
+// jobInputError is a problem with an uploaded file, shown to the client as is.
+type jobInputError struct {
+	msg string
+}
+
+func (e *jobInputError) Error() string {
+	return e.msg
+}
+
+func newJobInputError(format string, args ...interface{}) error {
+	return &jobInputError{msg: fmt.Sprintf(format, args...)}
+}
+
+// jobRecord is one row of a job's input.
+type jobRecord struct {
+	// fields of a CSV row, or the line of an NDJSON file.
+	fields []string
+	raw    []byte
+
+	query    string
+	lat, lng Coordinate
+	// invalid says what is wrong with the record, it is not looked up then.
+	invalid string
+}
+
+// validate fills in rec.invalid for a job of kind.
+func (rec *jobRecord) validate(kind string) {
+	var fields []FieldError
+	if kind == jobKindSearch {
+		fields = validateSearchRequest(&SearchRequest{Query: rec.query})
+	} else {
+		fields = validateGeocodeRequest(&GeocodeRequest{Lat: rec.lat, Lng: rec.lng})
+	}
+	msgs := make([]string, len(fields))
+	for i, f := range fields {
+		msgs[i] = f.Field + " " + f.Message
+	}
+	rec.invalid = strings.Join(msgs, "; ")
+}
+
+type jobReader interface {
+	// Kind is jobKindSearch or jobKindReverse, known once the first record is read.
+	Kind() string
+	// Read returns the next record, io.EOF after the last one.
+	Read() (*jobRecord, error)
+}
+
+type jobWriter interface {
+	// WriteHeader starts a new result.
+	WriteHeader() error
+	// Write adds the outcome for rec, the found addresses or why there are none.
+	Write(rec *jobRecord, addresses []*Address, errMsg string) error
+	Flush() error
+}
+
+func newJobReader(format string, r io.Reader) (jobReader, error) {
+	if format == jobFormatCSV {
+		return newCSVJobReader(r)
+	}
+	return &ndjsonJobReader{r: bufio.NewReader(r)}, nil
+}
+
+func newJobWriter(format string, w io.Writer, r jobReader) jobWriter {
+	if format == jobFormatCSV {
+		return &csvJobWriter{w: csv.NewWriter(w), header: r.(*csvJobReader).header}
+	}
+	return &ndjsonJobWriter{w: bufio.NewWriter(w)}
+}
+
+// csvJobReader reads a CSV file with a header. Searches use its address (or
+// query) column, reverse lookups its lat and lon (or lng) columns.
+type csvJobReader struct {
+	r        *csv.Reader
+	header   []string
+	kind     string
+	query    int
+	lat, lng int
+	line     int
+}
+
+func newCSVJobReader(r io.Reader) (*csvJobReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, newJobInputError("read CSV header: %v", err)
+	}
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+
+	col := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := col[name]; !ok {
+			col[name] = i
+		}
+	}
+	c := &csvJobReader{r: cr, header: header, line: 1}
+	if i, ok := col["address"]; ok {
+		c.kind, c.query = jobKindSearch, i
+	} else if i, ok := col["query"]; ok {
+		c.kind, c.query = jobKindSearch, i
+	} else {
+		lat, okLat := col["lat"]
+		lng, okLng := col["lon"]
+		if !okLng {
+			lng, okLng = col["lng"]
+		}
+		if !okLat || !okLng {
+			return nil, newJobInputError("CSV needs an address or query column, or lat and lon columns")
+		}
+		c.kind, c.lat, c.lng = jobKindReverse, lat, lng
+	}
+	return c, nil
+}
+
+func (c *csvJobReader) Kind() string {
+	return c.kind
+}
+
+func (c *csvJobReader) Read() (*jobRecord, error) {
+	fields, err := c.r.Read()
+	c.line++
+	if errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, newJobInputError("line %d: %v", c.line, err)
+	}
+
+	field := func(i int) string {
+		if i < len(fields) {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+	rec := &jobRecord{fields: fields}
+	if c.kind == jobKindSearch {
+		rec.query = field(c.query)
+	} else {
+		rec.lat, rec.lng = parseCoordinate(field(c.lat)), parseCoordinate(field(c.lng))
+	}
+	rec.validate(c.kind)
+	return rec, nil
+}
+
+func parseCoordinate(s string) Coordinate {
+	var c Coordinate
+	if s != "" {
+		quoted, _ := json.Marshal(s)
+		c.UnmarshalJSON(quoted)
+	}
+	return c
+}
+
+type csvJobWriter struct {
+	w      *csv.Writer
+	header []string
+}
+
+func (c *csvJobWriter) WriteHeader() error {
+	return c.w.Write(append(append([]string{}, c.header...), resultColumns...))
+}
+
+func (c *csvJobWriter) Write(rec *jobRecord, addresses []*Address, errMsg string) error {
+	// Short rows are padded so the result columns line up.
+	n := len(c.header)
+	if len(rec.fields) > n {
+		n = len(rec.fields)
+	}
+	row := make([]string, n, n+len(resultColumns))
+	copy(row, rec.fields)
+
+	if len(addresses) > 0 {
+		a := addresses[0]
+		row = append(row, a.Address, strconv.FormatFloat(a.Lat, 'f', -1, 64), strconv.FormatFloat(a.Lon, 'f', -1, 64), errMsg)
+	} else {
+		row = append(row, "", "", "", errMsg)
+	}
+	return c.w.Write(row)
+}
+
+func (c *csvJobWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// ndjsonJobReader reads one JSON object per line: {"query": ...} (or
+// "address") for searches, {"lat": ..., "lng": ...} (or "lon") for reverse
+// lookups. The first record decides the kind of the job. Blank lines are skipped.
+type ndjsonJobReader struct {
+	r    *bufio.Reader
+	kind string
+}
+
+func (n *ndjsonJobReader) Kind() string {
+	return n.kind
+}
+
+func (n *ndjsonJobReader) Read() (*jobRecord, error) {
+	var line []byte
+	for {
+		b, err := n.r.ReadBytes('\n')
+		if len(bytes.TrimSpace(b)) > 0 {
+			line = bytes.TrimSpace(b)
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var v struct {
+		Query   *string    `json:"query"`
+		Address *string    `json:"address"`
+		Lat     Coordinate `json:"lat"`
+		Lng     Coordinate `json:"lng"`
+		Lon     Coordinate `json:"lon"`
+	}
+	rec := &jobRecord{raw: line}
+	if err := json.Unmarshal(line, &v); err != nil {
+		rec.invalid = "not a JSON object"
+		return rec, nil
+	}
+	if v.Query == nil {
+		v.Query = v.Address
+	}
+	if !v.Lng.Set {
+		v.Lng = v.Lon
+	}
+	if n.kind == "" {
+		n.kind = jobKindSearch
+		if v.Query == nil && v.Lat.Set {
+			n.kind = jobKindReverse
+		}
+	}
+
+	if v.Query != nil {
+		rec.query = strings.TrimSpace(*v.Query)
+	}
+	rec.lat, rec.lng = v.Lat, v.Lng
+	rec.validate(n.kind)
+	return rec, nil
+}
+
+type ndjsonJobWriter struct {
+	w *bufio.Writer
+}
+
+type ndjsonJobResult struct {
+	// Input is the record as uploaded, as a string when it was not JSON.
+	Input     json.RawMessage `json:"input"`
+	Addresses []*Address      `json:"addresses"`
+	Error     string          `json:"error,omitempty"`
+}
+
+func (n *ndjsonJobWriter) WriteHeader() error {
+	return nil
+}
+
+func (n *ndjsonJobWriter) Write(rec *jobRecord, addresses []*Address, errMsg string) error {
+	input := json.RawMessage(rec.raw)
+	if !json.Valid(rec.raw) {
+		input, _ = json.Marshal(string(rec.raw))
+	}
+	line, err := json.Marshal(ndjsonJobResult{Input: input, Addresses: addresses, Error: errMsg})
+	if err != nil {
+		return err
+	}
+	n.w.Write(line)
+	return n.w.WriteByte('\n')
+}
+
+func (n *ndjsonJobWriter) Flush() error {
+	return n.w.Flush()
+}
@@ -0,0 +1,766 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+)
+
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+
+	defaultJobsDir       = "./data/jobs"
+	defaultJobsWorkers   = 2
+	defaultJobsRate      = 10.0
+	defaultJobsChunkSize = 10
+	defaultJobsMaxUpload = 64 << 20
+	jobsQueueSize        = 1024
+)
+
+var (
+	ErrJobNotFound    = errors.New("job not found")
+	ErrJobNotFinished = errors.New("job not finished")
+	ErrJobQueueFull   = errors.New("too many queued jobs")
+)
+
+// JobsConfig holds the settings of a JobManager.
+type JobsConfig struct {
+	// Dir keeps the uploads, results and state of every job.
+	Dir string
+	// Workers is how many jobs run at the same time.
+	Workers int
+	// Rate caps the calls all jobs together make to the geo providers, per
+	// second. 0 means no cap.
+	Rate float64
+	// ChunkSize searches go to the providers together in one call.
+	ChunkSize int
+	// MaxUpload is the largest accepted upload in bytes.
+	MaxUpload int64
+}
+
+// swagger:model job
+type Job struct {
+	// example: 1f0e3c4a9b8d7e6f5a4b3c2d1e0f9a8b
+	ID string `json:"id"`
+	// owner of the job
+	//
+	// example: user
+	Login string `json:"login"`
+	// search looks addresses up, reverse coordinates
+	//
+	// example: search
+	Kind string `json:"kind"`
+	// format of both the upload and the result: csv or ndjson
+	//
+	// example: csv
+	Format string `json:"format"`
+	// queued, running, done or failed
+	//
+	// example: running
+	Status string `json:"status"`
+	// records in the upload
+	//
+	// example: 100000
+	Total int `json:"total"`
+	// records looked up so far
+	//
+	// example: 4200
+	Processed int `json:"processed"`
+	// processed records that got an error instead of an address
+	//
+	// example: 12
+	Failed int `json:"failed"`
+	// why a failed job stopped
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// jobState is what is kept on disk for a job.
+type jobState struct {
+	Job
+	// ResultSize is the length of the result file holding the Processed records,
+	// anything past it was written before a crash and is dropped on resume.
+	ResultSize int64 `json:"result_size"`
+}
+
+// JobManager runs bulk geocoding jobs in the background. Every job lives in
+// Dir as <id>.json, <id>.input and <id>.result, so unfinished jobs pick up
+// where they left off when the process restarts.
+type JobManager struct {
+	cfg     JobsConfig
+	limiter *rateLimiter
+	queue   chan string
+
+	mu   sync.Mutex
+	jobs map[string]*jobState
+}
+
+// jobManager is set in main.
+var jobManager *JobManager
+
+func NewJobManager(cfg JobsConfig) (*JobManager, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("jobs dir: %w", err)
+	}
+	m := &JobManager{
+		cfg:     cfg,
+		limiter: newRateLimiter(cfg.Rate),
+		queue:   make(chan string, jobsQueueSize),
+		jobs:    map[string]*jobState{},
+	}
+
+	files, err := filepath.Glob(filepath.Join(cfg.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var unfinished []*jobState
+	for _, f := range files {
+		var s jobState
+		if err := readJSONFile(f, &s); err != nil {
+			return nil, err
+		}
+		if s.ID == "" {
+			continue
+		}
+		m.jobs[s.ID] = &s
+		if s.Status == JobQueued || s.Status == JobRunning {
+			unfinished = append(unfinished, &s)
+		}
+	}
+	sort.Slice(unfinished, func(i, j int) bool { return unfinished[i].CreatedAt.Before(unfinished[j].CreatedAt) })
+	for _, s := range unfinished {
+		select {
+		case m.queue <- s.ID:
+		default:
+			return nil, fmt.Errorf("more than %d unfinished jobs", jobsQueueSize)
+		}
+	}
+	return m, nil
+}
+
+// Start runs the workers until ctx is done.
+func (m *JobManager) Start(ctx context.Context) {
+	workers := m.cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-m.queue:
+					m.run(ctx, id)
+				}
+			}
+		}()
+	}
+}
+
+func (m *JobManager) path(id, ext string) string {
+	return filepath.Join(m.cfg.Dir, id+ext)
+}
+
+// save writes the state of the job, the caller holds m.mu.
+func (m *JobManager) save(s *jobState) {
+	if err := writeJSONFile(m.path(s.ID, ".json"), s); err != nil {
+		log.Printf("jobs.go: save job %s: %v", s.ID, err)
+	}
+}
+
+// Create stores the upload and queues a job for it. authorize is asked
+// whether login may run a job of the kind found in the upload, with as many
+// lookups as it holds valid records.
+func (m *JobManager) Create(login, format string, input io.Reader, authorize func(kind string, lookups int) error) (Job, error) {
+	id, err := newTokenID()
+	if err != nil {
+		return Job{}, err
+	}
+	inputPath := m.path(id, ".input")
+	ok := false
+	defer func() {
+		if !ok {
+			os.Remove(inputPath)
+		}
+	}()
+
+	f, err := os.OpenFile(inputPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return Job{}, err
+	}
+	_, err = io.Copy(f, input)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return Job{}, err
+	}
+
+	kind, total, lookups, err := scanJobInput(format, inputPath)
+	if err != nil {
+		return Job{}, err
+	}
+
+	// Take the queue slot before authorize spends the quota, so a full queue
+	// costs the caller nothing. A worker that picks the id up waits for m.mu
+	// and skips it if authorize refused the job.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case m.queue <- id:
+	default:
+		return Job{}, ErrJobQueueFull
+	}
+	if err := authorize(kind, lookups); err != nil {
+		return Job{}, err
+	}
+
+	s := &jobState{Job: Job{ID: id, Login: login, Kind: kind, Format: format, Status: JobQueued, Total: total, CreatedAt: time.Now().UTC()}}
+	m.jobs[id] = s
+	m.save(s)
+	ok = true
+	return s.Job, nil
+}
+
+// scanJobInput checks the upload at path and counts its records, and the
+// valid ones among them that will be looked up.
+func scanJobInput(format, path string) (kind string, total, lookups int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer f.Close()
+
+	r, err := newJobReader(format, f)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", 0, 0, err
+		}
+		total++
+		if rec.invalid == "" {
+			lookups++
+		}
+	}
+	if total == 0 {
+		return "", 0, 0, newJobInputError("the file holds no records")
+	}
+	return r.Kind(), total, lookups, nil
+}
+
+// Get returns the job id of login.
+func (m *JobManager) Get(login, id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.jobs[id]
+	if !ok || s.Login != login {
+		return Job{}, ErrJobNotFound
+	}
+	return s.Job, nil
+}
+
+// List returns the jobs of login, newest first.
+func (m *JobManager) List(login string) []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := []Job{}
+	for _, s := range m.jobs {
+		if s.Login == login {
+			res = append(res, s.Job)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.After(res[j].CreatedAt) })
+	return res
+}
+
+// Delete removes the job id of login with its files, a running job stops
+// after its current chunk.
+func (m *JobManager) Delete(login, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.jobs[id]
+	if !ok || s.Login != login {
+		return ErrJobNotFound
+	}
+	return m.remove(id)
+}
+
+// DeleteByLogin removes every job of login with its files, running jobs stop
+// after their current chunk.
+func (m *JobManager) DeleteByLogin(login string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, s := range m.jobs {
+		if s.Login != login {
+			continue
+		}
+		if err := m.remove(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove forgets job id and deletes its files, the caller holds m.mu.
+func (m *JobManager) remove(id string) error {
+	delete(m.jobs, id)
+	for _, ext := range []string{".json", ".input", ".result"} {
+		if err := os.Remove(m.path(id, ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Result opens the result of the finished job id of login.
+func (m *JobManager) Result(login, id string) (Job, *os.File, error) {
+	job, err := m.Get(login, id)
+	if err != nil {
+		return Job{}, nil, err
+	}
+	if job.Status != JobDone {
+		return job, nil, ErrJobNotFinished
+	}
+	f, err := os.Open(m.path(id, ".result"))
+	return job, f, err
+}
+
+// update applies fn to the state of job id and saves it. It returns false
+// when the job has been deleted meanwhile.
+func (m *JobManager) update(id string, fn func(s *jobState)) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.jobs[id]
+	if !ok {
+		return false
+	}
+	fn(s)
+	m.save(s)
+	return true
+}
+
+func (m *JobManager) run(ctx context.Context, id string) {
+	var s jobState
+	started := m.update(id, func(st *jobState) {
+		if st.StartedAt == nil {
+			now := time.Now().UTC()
+			st.StartedAt = &now
+		}
+		st.Status = JobRunning
+		s = *st
+	})
+	if !started {
+		return
+	}
+
+	err := m.process(ctx, &s)
+	if ctx.Err() != nil {
+		// Shutting down, the job resumes on the next start.
+		return
+	}
+	m.update(id, func(st *jobState) {
+		now := time.Now().UTC()
+		st.FinishedAt = &now
+		st.Status = JobDone
+		if err != nil {
+			log.Printf("jobs.go: job %s: %v", id, err)
+			st.Status = JobFailed
+			st.Error = "Internal Server Error"
+			var inputErr *jobInputError
+			if errors.As(err, &inputErr) {
+				st.Error = inputErr.Error()
+			}
+		}
+	})
+}
+
+// process looks up the records of s not yet processed, appending to the result chunk by chunk.
+func (m *JobManager) process(ctx context.Context, s *jobState) error {
+	in, err := os.Open(m.path(s.ID, ".input"))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, err := newJobReader(s.Format, in)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(m.path(s.ID, ".result"), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := out.Truncate(s.ResultSize); err != nil {
+		return err
+	}
+	if _, err := out.Seek(s.ResultSize, io.SeekStart); err != nil {
+		return err
+	}
+	w := newJobWriter(s.Format, out, r)
+	if s.ResultSize == 0 {
+		if err := w.WriteHeader(); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < s.Processed; i++ {
+		if _, err := r.Read(); err != nil {
+			return err
+		}
+	}
+
+	size := m.cfg.ChunkSize
+	if size < 1 {
+		size = 1
+	}
+	for {
+		var chunk []*jobRecord
+		for len(chunk) < size {
+			rec, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			chunk = append(chunk, rec)
+		}
+		if len(chunk) == 0 {
+			return nil
+		}
+
+		failed := 0
+		for i, res := range m.lookup(ctx, r.Kind(), chunk) {
+			if res.err != "" {
+				failed++
+			}
+			if err := w.Write(chunk[i], res.addresses, res.err); err != nil {
+				return err
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		offset, err := out.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		alive := m.update(s.ID, func(st *jobState) {
+			st.Processed += len(chunk)
+			st.Failed += failed
+			st.ResultSize = offset
+			*s = *st
+		})
+		if !alive {
+			return nil
+		}
+	}
+}
+
+type jobLookup struct {
+	addresses []*Address
+	err       string
+}
+
+// lookup finds the addresses of the valid records in chunk, searches in a
+// single call and reverse lookups one by one, each call waiting its turn.
+func (m *JobManager) lookup(ctx context.Context, kind string, chunk []*jobRecord) []jobLookup {
+	res := make([]jobLookup, len(chunk))
+	var valid []int
+	for i, rec := range chunk {
+		if rec.invalid != "" {
+			res[i].err = rec.invalid
+			continue
+		}
+		valid = append(valid, i)
+	}
+	if len(valid) == 0 {
+		return res
+	}
+
+	if kind == jobKindSearch {
+		queries := make([]string, len(valid))
+		for j, i := range valid {
+			queries[j] = chunk[i].query
+		}
+		var found [][]*Address
+		err := m.limiter.Wait(ctx)
+		if err == nil {
+			found, err = searchBatch(ctx, geoProvider, queries)
+		}
+		for j, i := range valid {
+			if err != nil {
+				res[i].err = jobLookupError(err)
+				continue
+			}
+			res[i].addresses = viewAddresses(found[j], addressViewFlat)
+		}
+		return res
+	}
+
+	for _, i := range valid {
+		err := m.limiter.Wait(ctx)
+		var found []*Address
+		if err == nil {
+			found, err = geoProvider.Reverse(ctx, chunk[i].lat.Value, chunk[i].lng.Value)
+		}
+		if err != nil {
+			res[i].err = jobLookupError(err)
+			continue
+		}
+		res[i].addresses = viewAddresses(found, addressViewFlat)
+	}
+	return res
+}
+
+func jobLookupError(err error) string {
+	if errors.Is(err, ErrNoGeoProvider) {
+		return "Geo providers unavailable"
+	}
+	if !errors.Is(err, context.Canceled) {
+		log.Printf("jobs.go: %v", err)
+	}
+	return "Internal Server Error"
+}
+
+// rateLimiter spaces calls evenly, at most rate a second.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// Wait blocks until the next call may go ahead or ctx is done.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// jobUpload returns the uploaded file and its format: the body itself, sent
+// as text/csv or application/x-ndjson, or the "file" field of a multipart
+// form. A format query parameter overrides what the content type says.
+func jobUpload(r *http.Request) (io.Reader, string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	body := io.Reader(r.Body)
+	name := ""
+	if mediaType == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return nil, "", err
+		}
+		var part *multipart.Part
+		for {
+			part, err = mr.NextPart()
+			if err != nil {
+				return nil, "", newJobInputError("no file field in the form")
+			}
+			if part.FormName() == "file" {
+				break
+			}
+		}
+		body, name = part, part.FileName()
+		mediaType, _, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		switch {
+		case mediaType == "text/csv" || strings.HasSuffix(strings.ToLower(name), ".csv"):
+			format = jobFormatCSV
+		case mediaType == "application/x-ndjson" || mediaType == "application/jsonl" || strings.HasSuffix(strings.ToLower(name), ".ndjson") || strings.HasSuffix(strings.ToLower(name), ".jsonl"):
+			format = jobFormatNDJSON
+		}
+	}
+	if format != jobFormatCSV && format != jobFormatNDJSON {
+		return nil, "", errUnsupportedJobFormat
+	}
+	return body, format, nil
+}
+
+var errUnsupportedJobFormat = errors.New("send text/csv or application/x-ndjson")
+
+func handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	token, _, _ := jwtauth.FromContext(r.Context())
+	r.Body = http.MaxBytesReader(w, r.Body, jobManager.cfg.MaxUpload)
+	defer r.Body.Close()
+
+	input, format, err := jobUpload(r)
+	if errors.Is(err, errUnsupportedJobFormat) {
+		writeError(w, "Unsupported Media Type: "+err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Sprintf("bad request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	scopes := map[string]bool{}
+	for _, scope := range tokenScopes(token) {
+		scopes[scope] = true
+	}
+	var missingScope string
+	authorize := func(kind string, lookups int) error {
+		missingScope = ScopeAddressSearch
+		if kind == jobKindReverse {
+			missingScope = ScopeAddressGeocode
+		}
+		if !scopes[missingScope] {
+			return errInsufficientScope
+		}
+		return spendQuota(r.Context(), lookups)
+	}
+
+	job, err := jobManager.Create(token.Subject(), format, input, authorize)
+	var inputErr *jobInputError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusAccepted, job)
+	case errors.As(err, &inputErr):
+		writeValidationError(w, []FieldError{{Field: "file", Message: inputErr.Error()}}, http.StatusUnprocessableEntity)
+	case errors.As(err, &tooLarge):
+		writeError(w, fmt.Sprintf("file is larger than %d bytes", jobManager.cfg.MaxUpload), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errQuotaExceeded):
+		writeQuotaExceeded(w)
+	case errors.Is(err, errInsufficientScope):
+		writeError(w, "insufficient scope: "+missingScope+" required", http.StatusForbidden)
+	case errors.Is(err, ErrJobQueueFull):
+		writeError(w, "Too many queued jobs, try again later", http.StatusServiceUnavailable)
+	default:
+		log.Printf("jobs.go: create job: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+var errInsufficientScope = errors.New("insufficient scope")
+
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	token, _, _ := jwtauth.FromContext(r.Context())
+	writeJSON(w, http.StatusOK, jobManager.List(token.Subject()))
+}
+
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	token, _, _ := jwtauth.FromContext(r.Context())
+	job, err := jobManager.Get(token.Subject(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func handleJobResult(w http.ResponseWriter, r *http.Request) {
+	token, _, _ := jwtauth.FromContext(r.Context())
+	job, f, err := jobManager.Result(token.Subject(), chi.URLParam(r, "id"))
+	switch {
+	case errors.Is(err, ErrJobNotFound):
+		writeError(w, "Job not found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrJobNotFinished) && job.Status == JobFailed:
+		writeError(w, "Job failed: "+job.Error, http.StatusConflict)
+		return
+	case errors.Is(err, ErrJobNotFinished):
+		writeError(w, "Job is "+job.Status+", the result is ready once it is done", http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("jobs.go: open result: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	contentType := "text/csv; charset=utf-8"
+	if job.Format == jobFormatNDJSON {
+		contentType = "application/x-ndjson"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, job.ID, job.Format))
+	http.ServeContent(w, r, "", *job.FinishedAt, f)
+}
+
+func handleDeleteJob(w http.ResponseWriter, r *http.Request) {
+	token, _, _ := jwtauth.FromContext(r.Context())
+	err := jobManager.Delete(token.Subject(), chi.URLParam(r, "id"))
+	if errors.Is(err, ErrJobNotFound) {
+		writeError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("jobs.go: delete job: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireJobManager answers 503 while jobs are not set up.
+func requireJobManager(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if jobManager == nil {
+			writeError(w, "Jobs are unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
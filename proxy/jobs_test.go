@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestJobManager(t *testing.T, dir string) *JobManager {
+	m, err := NewJobManager(JobsConfig{Dir: dir, Workers: 1, ChunkSize: 2, MaxUpload: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func waitJob(t *testing.T, m *JobManager, login, id string) Job {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := m.Get(login, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == JobDone || job.Status == JobFailed || time.Now().After(deadline) {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func readResult(t *testing.T, m *JobManager, login, id string) string {
+	_, f, err := m.Result(login, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, _ := io.ReadAll(f)
+	return string(b)
+}
+
+func allowAll(string, int) error { return nil }
+
+func TestJobManager_csv(t *testing.T) {
+	saved := geoProvider
+	fake := &batchGeoProvider{}
+	geoProvider = fake
+	defer func() { geoProvider = saved }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := newTestJobManager(t, t.TempDir())
+	m.Start(ctx)
+
+	input := "\ufeffid,Address\n1,aa\n2,b\n3,cc,extra\n4\n5,dd\n"
+	job, err := m.Create("JobUser", jobFormatCSV, strings.NewReader(input), allowAll)
+	assert.NoError(t, err)
+	assert.Equal(t, jobKindSearch, job.Kind)
+	assert.Equal(t, 5, job.Total)
+
+	job = waitJob(t, m, "JobUser", job.ID)
+	assert.Equal(t, JobDone, job.Status)
+	assert.Equal(t, 5, job.Processed)
+	assert.Equal(t, 2, job.Failed)
+	assert.Equal(t, "id,Address,result_address,result_lat,result_lon,error\n"+
+		"1,aa,AA,0,0,\n"+
+		"2,b,,,,query must be at least 2 characters long\n"+
+		"3,cc,extra,CC,0,0,\n"+
+		"4,,,,,query must be at least 2 characters long\n"+
+		"5,dd,DD,0,0,\n", readResult(t, m, "JobUser", job.ID))
+	assert.Equal(t, [][]string{{"aa"}, {"cc"}, {"dd"}}, fake.batches, "one call for the valid queries of each chunk")
+
+	_, err = m.Get("Other", job.ID)
+	assert.ErrorIs(t, err, ErrJobNotFound)
+	assert.Empty(t, m.List("Other"))
+	assert.Len(t, m.List("JobUser"), 1)
+
+	for _, bad := range []string{"", "name,city\nx,y\n", "address\n", "address\n\"aa\n"} {
+		_, err = m.Create("JobUser", jobFormatCSV, strings.NewReader(bad), allowAll)
+		var inputErr *jobInputError
+		assert.ErrorAs(t, err, &inputErr, bad)
+	}
+
+	assert.NoError(t, m.Delete("JobUser", job.ID))
+	assert.Empty(t, m.List("JobUser"))
+	files, _ := os.ReadDir(m.cfg.Dir)
+	assert.Empty(t, files)
+}
+
+func TestJobManager_ndjsonReverse(t *testing.T) {
+	saved := geoProvider
+	geoProvider = &fakeGeoProvider{addresses: []*Address{{Address: "г Москва", Lat: 55.75, Lon: 37.62}}}
+	defer func() { geoProvider = saved }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := newTestJobManager(t, t.TempDir())
+	m.Start(ctx)
+
+	input := `{"lat":55.75,"lon":"37.62"}` + "\n\n" + `{"lat":95,"lng":0}` + "\n" + `oops` + "\n"
+	job, err := m.Create("JobUser", jobFormatNDJSON, strings.NewReader(input), func(kind string, lookups int) error {
+		assert.Equal(t, jobKindReverse, kind)
+		assert.Equal(t, 1, lookups, "the invalid records are not looked up")
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, job.Total)
+
+	job = waitJob(t, m, "JobUser", job.ID)
+	assert.Equal(t, JobDone, job.Status)
+	assert.Equal(t, 2, job.Failed)
+	assert.Equal(t, `{"input":{"lat":55.75,"lon":"37.62"},"addresses":[{"address":"г Москва","lat":55.75,"lon":37.62}]}`+"\n"+
+		`{"input":{"lat":95,"lng":0},"addresses":null,"error":"lat must be between -90 and 90"}`+"\n"+
+		`{"input":"oops","addresses":null,"error":"not a JSON object"}`+"\n", readResult(t, m, "JobUser", job.ID))
+}
+
+func TestJobManager_resume(t *testing.T) {
+	saved := geoProvider
+	geoProvider = &batchGeoProvider{}
+	defer func() { geoProvider = saved }()
+
+	dir := t.TempDir()
+	m := newTestJobManager(t, dir)
+	job, err := m.Create("JobUser", jobFormatCSV, strings.NewReader("address\naa\nbb\ncc\n"), allowAll)
+	assert.NoError(t, err)
+
+	// Not started: the job is still queued when the process goes away.
+	m = newTestJobManager(t, dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	m.Start(ctx)
+	job = waitJob(t, m, "JobUser", job.ID)
+	cancel()
+	assert.Equal(t, JobDone, job.Status)
+	want := readResult(t, m, "JobUser", job.ID)
+	assert.Equal(t, "address,result_address,result_lat,result_lon,error\naa,AA,0,0,\nbb,BB,0,0,\ncc,CC,0,0,\n", want)
+
+	// Crashed after the first chunk, with half a row written past it.
+	s := m.jobs[job.ID]
+	s.Status, s.Processed, s.FinishedAt = JobRunning, 2, nil
+	s.ResultSize = int64(strings.Index(want, "cc,"))
+	m.save(s)
+	f, _ := os.OpenFile(m.path(job.ID, ".result"), os.O_WRONLY|os.O_TRUNC, 0)
+	f.WriteString(want[:s.ResultSize] + "garbage")
+	f.Close()
+
+	m = newTestJobManager(t, dir)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	m.Start(ctx)
+	job = waitJob(t, m, "JobUser", job.ID)
+	assert.Equal(t, JobDone, job.Status)
+	assert.Equal(t, 3, job.Processed)
+	assert.Equal(t, want, readResult(t, m, "JobUser", job.ID))
+}
+
+func TestJobManager_queueFull(t *testing.T) {
+	m := newTestJobManager(t, t.TempDir())
+	m.queue = make(chan string)
+	authorized := false
+	_, err := m.Create("JobUser", jobFormatCSV, strings.NewReader("address\naa\n"), func(string, int) error {
+		authorized = true
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrJobQueueFull)
+	assert.False(t, authorized, "no quota is spent on a full queue")
+	assert.Empty(t, m.List("JobUser"))
+}
+
+func Test_rateLimiter(t *testing.T) {
+	l := newRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, l.Wait(context.Background()))
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, newRateLimiter(0).Wait(ctx))
+	assert.Error(t, l.Wait(ctx))
+}
+
+func Test_handleJobs(t *testing.T) {
+	savedProvider, savedJobs, savedLimiter := geoProvider, jobManager, usageLimiter
+	geoProvider = &batchGeoProvider{}
+	usageLimiter, _ = NewUsageLimiter(map[string]RateLimit{RoleUser: {Daily: 10}}, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	jobManager = newTestJobManager(t, t.TempDir())
+	jobManager.Start(ctx)
+	defer func() {
+		cancel()
+		geoProvider, jobManager, usageLimiter = savedProvider, savedJobs, savedLimiter
+	}()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	do := func(method, url, token, contentType, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		req.Header.Set("Authorization", token)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res, buf.String()
+	}
+	token := "Bearer " + issueTestToken(t, User{Login: "JobUser", Roles: []string{RoleUser}})
+	other := "Bearer " + issueTestToken(t, User{Login: "JobOther", Roles: []string{RoleUser}})
+
+	res, body := do("POST", "/api/jobs/geocode", token, "text/csv", "address\naa\nbb\n")
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	var job Job
+	assert.NoError(t, json.Unmarshal([]byte(body), &job))
+	assert.Equal(t, "JobUser", job.Login)
+	assert.Equal(t, 2, job.Total)
+	assert.Equal(t, "8", res.Header.Get("X-RateLimit-Daily-Remaining"))
+
+	waitJob(t, jobManager, "JobUser", job.ID)
+	res, body = do("GET", "/api/jobs/"+job.ID, token, "", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, body, `"status":"done"`)
+
+	res, body = do("GET", "/api/jobs/"+job.ID+"/result", token, "", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/csv; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="`+job.ID+`.csv"`, res.Header.Get("Content-Disposition"))
+	assert.Equal(t, "address,result_address,result_lat,result_lon,error\naa,AA,0,0,\nbb,BB,0,0,\n", body)
+
+	res, _ = do("GET", "/api/jobs/"+job.ID+"/result", other, "", "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, body = do("GET", "/api/jobs", other, "", "")
+	assert.Equal(t, "[]", body)
+
+	multipartBody := "--xx\r\nContent-Disposition: form-data; name=\"file\"; filename=\"points.ndjson\"\r\n\r\n{\"query\":\"cc\"}\n\r\n--xx--\r\n"
+	res, body = do("POST", "/api/jobs/geocode", token, "multipart/form-data; boundary=xx", multipartBody)
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	assert.Contains(t, body, `"format":"ndjson"`)
+
+	res, body = do("POST", "/api/jobs/geocode", token, "text/csv", "address\nx\nМосква\n")
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	assert.Equal(t, "6", res.Header.Get("X-RateLimit-Daily-Remaining"), "the invalid record costs nothing")
+	var mixed Job
+	assert.NoError(t, json.Unmarshal([]byte(body), &mixed))
+	waitJob(t, jobManager, "JobUser", mixed.ID)
+
+	res, body = do("POST", "/api/jobs/geocode", token, "application/json", "{}")
+	assert.Equal(t, http.StatusUnsupportedMediaType, res.StatusCode)
+	assert.Empty(t, res.Header.Get("X-RateLimit-Daily-Remaining"))
+
+	res, body = do("POST", "/api/jobs/geocode?format=csv", token, "", "name\nx\n")
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+	assert.Equal(t, `{"error":"validation failed","fields":[{"field":"file","message":"CSV needs an address or query column, or lat and lon columns"}]}`, body)
+	assert.Empty(t, res.Header.Get("X-RateLimit-Daily-Remaining"))
+
+	res, _ = do("POST", "/api/jobs/geocode", token, "text/csv", "address\n"+strings.Repeat("Москва\n", 200))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+
+	res, _ = do("DELETE", "/api/jobs/"+job.ID, other, "", "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = do("DELETE", "/api/jobs/"+job.ID, token, "", "")
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, _ = do("GET", "/api/jobs/"+job.ID, token, "", "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
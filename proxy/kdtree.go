@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const earthRadius = 6371000.0 // metres
+
+// point3 is a position on the unit sphere. Straight line (chord) distance
+// between two of them grows with the great circle distance, so a plain
+// 3-d tree answers nearest neighbour queries on the globe without any
+// trouble at the poles or the antimeridian.
+type point3 [3]float64
+
+func toPoint3(lat, lng float64) point3 {
+	phi, lambda := lat*math.Pi/180, lng*math.Pi/180
+	return point3{math.Cos(phi) * math.Cos(lambda), math.Cos(phi) * math.Sin(lambda), math.Sin(phi)}
+}
+
+func (p point3) dist2(q point3) float64 {
+	dx, dy, dz := p[0]-q[0], p[1]-q[1], p[2]-q[2]
+	return dx*dx + dy*dy + dz*dz
+}
+
+// chordToMetres converts a squared chord length on the unit sphere to metres along the surface.
+func chordToMetres(d2 float64) float64 {
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(d2)/2))
+}
+
+// metresToChord2 is the inverse of chordToMetres.
+func metresToChord2(m float64) float64 {
+	c := 2 * math.Sin(math.Min(math.Pi/2, m/(2*earthRadius)))
+	return c * c
+}
+
+type kdNode struct {
+	point       point3
+	id          int
+	axis        int
+	left, right *kdNode
+}
+
+// kdTree finds the items nearest to a point, items are identified by the
+// index they had when the tree was built.
+type kdTree struct {
+	root *kdNode
+}
+
+func newKDTree(points []point3) *kdTree {
+	ids := make([]int, len(points))
+	for i := range ids {
+		ids[i] = i
+	}
+	return &kdTree{root: buildKD(points, ids, 0)}
+}
+
+func buildKD(points []point3, ids []int, depth int) *kdNode {
+	if len(ids) == 0 {
+		return nil
+	}
+	axis := depth % 3
+	sort.Slice(ids, func(i, j int) bool { return points[ids[i]][axis] < points[ids[j]][axis] })
+	mid := len(ids) / 2
+	return &kdNode{
+		point: points[ids[mid]],
+		id:    ids[mid],
+		axis:  axis,
+		left:  buildKD(points, ids[:mid], depth+1),
+		right: buildKD(points, ids[mid+1:], depth+1),
+	}
+}
+
+type kdHit struct {
+	id    int
+	dist2 float64
+}
+
+// Nearest returns up to k items within a squared chord distance of max2 from
+// target, closest first.
+func (t *kdTree) Nearest(target point3, k int, max2 float64) []kdHit {
+	if k <= 0 {
+		return nil
+	}
+	hits := make([]kdHit, 0, k)
+	var visit func(n *kdNode)
+	visit = func(n *kdNode) {
+		if n == nil {
+			return
+		}
+		if d := n.point.dist2(target); d <= max2 {
+			// hits stays sorted, k is small so insertion is cheap.
+			i := sort.Search(len(hits), func(i int) bool { return hits[i].dist2 > d })
+			if i < k {
+				if len(hits) < k {
+					hits = append(hits, kdHit{})
+				}
+				copy(hits[i+1:], hits[i:])
+				hits[i] = kdHit{id: n.id, dist2: d}
+			}
+		}
+
+		diff := target[n.axis] - n.point[n.axis]
+		near, far := n.left, n.right
+		if diff > 0 {
+			near, far = far, near
+		}
+		visit(near)
+		bound := max2
+		if len(hits) == k {
+			bound = hits[k-1].dist2
+		}
+		if diff*diff <= bound {
+			visit(far)
+		}
+	}
+	visit(t.root)
+	return hits
+}
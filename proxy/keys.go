@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+const jwksPath = "/.well-known/jwks.json"
+
+var ErrNoSigningKey = errors.New("no signing key configured")
+
+// KeyRing holds the keys used to sign and verify access tokens.
+// Tokens are signed with the active key and carry its id in the kid header.
+// Every other key in the ring still verifies tokens until it is retired,
+// which makes rotation a matter of adding a key and switching the active one.
+type KeyRing struct {
+	mu     sync.RWMutex
+	active jwk.Key
+	verify jwk.Set
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{verify: jwk.NewSet()}
+}
+
+// Add puts a private (or symmetric) key into the ring under kid and makes it
+// the signing key when activate is set.
+func (k *KeyRing) Add(kid string, raw interface{}, activate bool) error {
+	key, err := newSigningKey(kid, raw)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if old, ok := k.verify.LookupKeyID(kid); ok {
+		k.verify.RemoveKey(old)
+	}
+	if err := k.verify.AddKey(key); err != nil {
+		return err
+	}
+	if activate || k.active == nil {
+		k.active = key
+	}
+	return nil
+}
+
+// Retire removes kid from the ring, tokens signed with it stop verifying.
+// The active key cannot be retired.
+func (k *KeyRing) Retire(kid string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.active != nil && k.active.KeyID() == kid {
+		return fmt.Errorf("key %q is the active signing key", kid)
+	}
+	key, ok := k.verify.LookupKeyID(kid)
+	if !ok {
+		return fmt.Errorf("key %q not found", kid)
+	}
+	return k.verify.RemoveKey(key)
+}
+
+// Sign signs token with the active key.
+func (k *KeyRing) Sign(token jwt.Token) ([]byte, error) {
+	k.mu.RLock()
+	key := k.active
+	k.mu.RUnlock()
+
+	if key == nil {
+		return nil, ErrNoSigningKey
+	}
+	return jwt.Sign(token, jwt.WithKey(key.Algorithm(), key))
+}
+
+// Parse verifies the signature of tokenString against the key named by its kid
+// header. Claims are not validated here, that is left to jwt.Validate.
+func (k *KeyRing) Parse(tokenString string) (jwt.Token, error) {
+	k.mu.RLock()
+	set := k.verify
+	k.mu.RUnlock()
+
+	return jwt.Parse([]byte(tokenString), jwt.WithKeySet(set), jwt.WithValidate(false))
+}
+
+// PublicSet returns the public halves of the asymmetric keys in the ring.
+// Symmetric keys are never published.
+func (k *KeyRing) PublicSet() (jwk.Set, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := jwk.NewSet()
+	for i := 0; i < k.verify.Len(); i++ {
+		key, _ := k.verify.Key(i)
+		if key.KeyType() == jwa.OctetSeq {
+			continue
+		}
+		pub, err := key.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := set.AddKey(pub); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// newSigningKey wraps raw into a jwk.Key with kid, alg and use set.
+func newSigningKey(kid string, raw interface{}) (jwk.Key, error) {
+	var alg jwa.SignatureAlgorithm
+	switch v := raw.(type) {
+	case []byte:
+		alg = jwa.HS256
+	case *rsa.PrivateKey:
+		alg = jwa.RS256
+	case *ecdsa.PrivateKey:
+		switch v.Curve {
+		case elliptic.P256():
+			alg = jwa.ES256
+		case elliptic.P384():
+			alg = jwa.ES384
+		case elliptic.P521():
+			alg = jwa.ES512
+		default:
+			return nil, fmt.Errorf("key %q: unsupported curve", kid)
+		}
+	case ed25519.PrivateKey:
+		alg = jwa.EdDSA
+	default:
+		return nil, fmt.Errorf("key %q: unsupported key type %T", kid, raw)
+	}
+
+	key, err := jwk.FromRaw(raw)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", kid, err)
+	}
+	key.Set(jwk.KeyIDKey, kid)
+	key.Set(jwk.AlgorithmKey, alg)
+	key.Set(jwk.KeyUsageKey, jwk.ForSignature)
+	return key, nil
+}
+
+// loadKeyRing builds the key ring from the configuration:
+//   - every <kid>.pem file in cfg.JWTKeysDir is a PEM private key (RSA, EC or Ed25519),
+//     every <kid>.secret file there is an HS256 secret;
+//   - cfg.JWTSecret is an HS256 secret with id cfg.JWTSecretKID.
+//
+// cfg.JWTActiveKID picks the signing key, by default the last key by id is used.
+// With nothing configured a random HS256 key is generated, so tokens do not
+// survive a restart.
+func loadKeyRing(cfg *Config) (*KeyRing, error) {
+	keys := map[string]interface{}{}
+
+	if cfg.JWTKeysDir != "" {
+		entries, err := os.ReadDir(cfg.JWTKeysDir)
+		if err != nil {
+			return nil, fmt.Errorf("read keys dir: %w", err)
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			ext := filepath.Ext(e.Name())
+			kid := strings.TrimSuffix(e.Name(), ext)
+			if ext != ".pem" && ext != ".secret" {
+				continue
+			}
+
+			data, err := os.ReadFile(filepath.Join(cfg.JWTKeysDir, e.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("read key %q: %w", kid, err)
+			}
+			if ext == ".secret" {
+				keys[kid] = []byte(strings.TrimSpace(string(data)))
+				continue
+			}
+
+			parsed, err := jwk.ParseKey(data, jwk.WithPEM(true))
+			if err != nil {
+				return nil, fmt.Errorf("parse key %q: %w", kid, err)
+			}
+			var raw interface{}
+			if err := parsed.Raw(&raw); err != nil {
+				return nil, fmt.Errorf("parse key %q: %w", kid, err)
+			}
+			keys[kid] = raw
+		}
+	}
+
+	if cfg.JWTSecret != "" {
+		keys[cfg.JWTSecretKID] = []byte(cfg.JWTSecret)
+	}
+
+	ring := NewKeyRing()
+	if len(keys) == 0 {
+		log.Println("keys.go: no JWT signing key configured, using a random one")
+		return ring, ring.Add("default", randomSecret(), true)
+	}
+
+	kids := make([]string, 0, len(keys))
+	for kid := range keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	active := cfg.JWTActiveKID
+	if active == "" {
+		active = kids[len(kids)-1]
+	}
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %q not found", active)
+	}
+
+	for _, kid := range kids {
+		if err := ring.Add(kid, keys[kid], kid == active); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+func randomSecret() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Verifier finds a token in the Authorization header or jwt cookie, verifies it
+// against keys and stores the result in the request context, where
+// jwtauth.FromContext picks it up.
+func Verifier(keys *KeyRing) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			token, err := verifyRequest(keys, r)
+			ctx = jwtauth.NewContext(ctx, token, err)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+func verifyRequest(keys *KeyRing, r *http.Request) (jwt.Token, error) {
+	tokenString := jwtauth.TokenFromHeader(r)
+	if tokenString == "" {
+		tokenString = jwtauth.TokenFromCookie(r)
+	}
+	if tokenString == "" {
+		return nil, jwtauth.ErrNoTokenFound
+	}
+
+	token, err := keys.Parse(tokenString)
+	if err != nil {
+		return nil, jwtauth.ErrUnauthorized
+	}
+	if err := jwt.Validate(token); err != nil {
+		return token, jwtauth.ErrorReason(err)
+	}
+	return token, nil
+}
+
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+	set, err := signingKeys.PublicSet()
+	if err != nil {
+		log.Printf("keys.go: public key set: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(set)
+}
+
+// watchKeys reloads the keys dir on every signal sent to reload,
+// so keys can be added, activated and retired without a restart.
+func watchKeys(cfg *Config, keys *KeyRing, reload <-chan os.Signal) {
+	for range reload {
+		ring, err := loadKeyRing(cfg)
+		if err != nil {
+			log.Printf("keys.go: reload keys: %v", err)
+			continue
+		}
+
+		keys.mu.Lock()
+		keys.active, keys.verify = ring.active, ring.verify
+		keys.mu.Unlock()
+		log.Printf("keys.go: reloaded %d signing keys, active %q", ring.verify.Len(), ring.active.KeyID())
+	}
+}
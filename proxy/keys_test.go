@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_KeyRingRotation(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	ring := NewKeyRing()
+	issuer := NewTokenIssuer(ring, time.Minute)
+	user := User{Login: "User1", Roles: []string{RoleUser}}
+
+	tokens := map[string]string{}
+	for _, k := range []struct {
+		kid string
+		raw interface{}
+		alg string
+	}{
+		{"k1", []byte("secret"), "HS256"},
+		{"k2", rsaKey, "RS256"},
+		{"k3", ecKey, "ES256"},
+		{"k4", edKey, "EdDSA"},
+	} {
+		assert.NoError(t, ring.Add(k.kid, k.raw, true))
+		token, err := issuer.Issue(user)
+		assert.NoError(t, err)
+		tokens[k.kid] = token
+
+		msg, err := jws.Parse([]byte(token))
+		assert.NoError(t, err)
+		headers := msg.Signatures()[0].ProtectedHeaders()
+		assert.Equal(t, k.kid, headers.KeyID())
+		assert.Equal(t, k.alg, headers.Algorithm().String())
+	}
+
+	for kid, token := range tokens {
+		_, err := ring.Parse(token)
+		assert.NoError(t, err, kid)
+	}
+
+	assert.Error(t, ring.Retire("k4"), "active key can not be retired")
+	assert.NoError(t, ring.Retire("k2"))
+	_, err = ring.Parse(tokens["k2"])
+	assert.Error(t, err)
+	_, err = ring.Parse(tokens["k3"])
+	assert.NoError(t, err)
+
+	set, err := ring.PublicSet()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, set.Len())
+	_, ok := set.LookupKeyID("k1")
+	assert.False(t, ok, "symmetric keys are not published")
+}
+
+func Test_loadKeyRing(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	assert.NoError(t, err)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "2024-01.pem"), pemBytes, 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "2023-12.secret"), []byte("old secret\n"), 0o600))
+
+	ring, err := loadKeyRing(&Config{JWTKeysDir: dir})
+	assert.NoError(t, err)
+	assert.Equal(t, "2024-01", ring.active.KeyID())
+	assert.Equal(t, 2, ring.verify.Len())
+
+	ring, err = loadKeyRing(&Config{JWTKeysDir: dir, JWTActiveKID: "2023-12"})
+	assert.NoError(t, err)
+	assert.Equal(t, "2023-12", ring.active.KeyID())
+
+	_, err = loadKeyRing(&Config{JWTKeysDir: dir, JWTActiveKID: "missing"})
+	assert.Error(t, err)
+}
+
+func Test_handleJWKS(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	old := signingKeys
+	defer func() { signingKeys = old }()
+	signingKeys = NewKeyRing()
+	assert.NoError(t, signingKeys.Add("hmac", []byte("secret"), false))
+	assert.NoError(t, signingKeys.Add("ed", edKey, true))
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/.well-known/jwks.json")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var body json.RawMessage
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	set, err := jwk.Parse(body)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, set.Len())
+
+	key, ok := set.LookupKeyID("ed")
+	assert.True(t, ok)
+	assert.Equal(t, "EdDSA", key.Algorithm().String())
+	var raw interface{}
+	assert.NoError(t, key.Raw(&raw))
+	assert.IsType(t, ed25519.PublicKey{}, raw)
+}
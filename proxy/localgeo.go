@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultLocalReverseRadius = 1000.0 // metres
+	localReverseLimit         = 5
+)
+
+// LocalProvider geocodes against an address dataset held in memory, so it
+// works without network access. Text search matches every query word against
+// the words of an address by prefix, or with a small edit distance for longer
+// words. Reverse lookups use a k-d tree.
+type LocalProvider struct {
+	addresses []Address
+	// terms is the sorted list of indexed words, postings maps each to the
+	// addresses containing it.
+	terms    []string
+	postings map[string][]int
+	// fuzzy finds the terms a few typos away from a query word.
+	fuzzy *trigramIndex
+	tree  *kdTree
+	// radius2 is the squared chord length of the reverse lookup radius.
+	radius2 float64
+}
+
+// NewLocalProvider indexes addresses, reverse lookups reach radius metres.
+func NewLocalProvider(addresses []Address, radius float64) *LocalProvider {
+	p := &LocalProvider{addresses: addresses, postings: map[string][]int{}, radius2: metresToChord2(radius)}
+
+	points := make([]point3, len(addresses))
+	for i, a := range addresses {
+		points[i] = toPoint3(a.Lat, a.Lon)
+		for _, term := range searchTerms(a.Address) {
+			ids := p.postings[term]
+			if len(ids) > 0 && ids[len(ids)-1] == i {
+				continue
+			}
+			if len(ids) == 0 {
+				p.terms = append(p.terms, term)
+			}
+			p.postings[term] = append(ids, i)
+		}
+	}
+	sort.Strings(p.terms)
+	p.fuzzy = newTrigramIndex(p.terms)
+	p.tree = newKDTree(points)
+	return p
+}
+
+// LoadLocalProvider reads the dataset at path, a .csv or a .geojson/.json file.
+//
+// CSV files need a header naming the columns address, lat and lon (or lng),
+// other columns are ignored. GeoJSON files hold a FeatureCollection of Point
+// features, the address is taken from the "address" property or built from
+// the OpenStreetMap style name, street, housenumber, city, state and country
+// properties, so Photon or osmium exports load as they are.
+func LoadLocalProvider(path string, radius float64) (*LocalProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open dataset: %w", err)
+	}
+	defer f.Close()
+
+	var addresses []Address
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		addresses, err = readAddressCSV(f)
+	case ".geojson", ".json":
+		addresses, err = readAddressGeoJSON(f)
+	default:
+		return nil, fmt.Errorf("dataset %s: unknown format, want .csv or .geojson", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dataset %s: %w", path, err)
+	}
+	return NewLocalProvider(addresses, radius), nil
+}
+
+func readAddressCSV(r io.Reader) ([]Address, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+
+	col := map[string]int{}
+	for i, name := range header {
+		col[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := col["lng"]; ok {
+		if _, ok := col["lon"]; !ok {
+			col["lon"] = col["lng"]
+		}
+	}
+	for _, name := range []string{"address", "lat", "lon"} {
+		if _, ok := col[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	var addresses []Address
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return addresses, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) <= col["address"] || len(rec) <= col["lat"] || len(rec) <= col["lon"] {
+			return nil, fmt.Errorf("line %d: too few columns", line)
+		}
+		lat, errLat := strconv.ParseFloat(strings.TrimSpace(rec[col["lat"]]), 64)
+		lon, errLon := strconv.ParseFloat(strings.TrimSpace(rec[col["lon"]]), 64)
+		if errLat != nil || errLon != nil {
+			return nil, fmt.Errorf("line %d: invalid coordinates", line)
+		}
+		addresses = append(addresses, Address{Address: strings.TrimSpace(rec[col["address"]]), Lat: lat, Lon: lon})
+	}
+}
+
+func readAddressGeoJSON(r io.Reader) ([]Address, error) {
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Type string `json:"type"`
+				// Coordinates are only decoded for points, other shapes nest them deeper.
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+			Properties osmProperties `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.NewDecoder(r).Decode(&fc); err != nil {
+		return nil, err
+	}
+
+	addresses := make([]Address, 0, len(fc.Features))
+	for _, f := range fc.Features {
+		label := f.Properties.label()
+		if f.Geometry.Type != "Point" || label == "" {
+			continue
+		}
+		var lonLat []float64
+		if err := json.Unmarshal(f.Geometry.Coordinates, &lonLat); err != nil || len(lonLat) < 2 {
+			return nil, fmt.Errorf("feature %q: invalid point coordinates", label)
+		}
+		addresses = append(addresses, Address{Address: label, Lat: lonLat[1], Lon: lonLat[0]})
+	}
+	return addresses, nil
+}
+
+func (p *LocalProvider) Search(_ context.Context, query string) ([]*Address, error) {
+	ids := p.rank(query, nil)
+	if len(ids) > geoSearchLimit {
+		ids = ids[:geoSearchLimit]
+	}
+	return p.pick(ids), nil
+}
+
+// Suggest works like Search, the last query word being matched by prefix
+// anyway. Among equally good matches those closer to the point come first.
+func (p *LocalProvider) Suggest(_ context.Context, query string, opts SuggestOptions) ([]*Address, error) {
+	var closer func(a, b int) bool
+	if opts.Near {
+		target := toPoint3(opts.Lat, opts.Lng)
+		closer = func(a, b int) bool {
+			return toPoint3(p.addresses[a].Lat, p.addresses[a].Lon).dist2(target) < toPoint3(p.addresses[b].Lat, p.addresses[b].Lon).dist2(target)
+		}
+	}
+	ids := p.rank(query, closer)
+
+	res := make([]*Address, 0, minInt(len(ids), opts.Limit))
+	for _, id := range ids {
+		if len(res) == opts.Limit {
+			break
+		}
+		addr := p.addresses[id]
+		if len(opts.Regions) == 0 || inRegions(&addr, opts.Regions) {
+			res = append(res, &addr)
+		}
+	}
+	return res, nil
+}
+
+// rank returns the addresses matching every word of query, best first. Equal
+// scores are ordered by before when given and it tells them apart, then the
+// shorter address wins.
+func (p *LocalProvider) rank(query string, before func(a, b int) bool) []int {
+	var scores map[int]int
+	for _, q := range searchTerms(query) {
+		matched := p.match(q)
+		if scores == nil {
+			scores = matched
+			continue
+		}
+		// Every query word has to match.
+		for id := range scores {
+			if s, ok := matched[id]; ok {
+				scores[id] += s
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	ids := make([]int, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if scores[a] != scores[b] {
+			return scores[a] > scores[b]
+		}
+		if before != nil && (before(a, b) || before(b, a)) {
+			return before(a, b)
+		}
+		if la, lb := len(p.addresses[a].Address), len(p.addresses[b].Address); la != lb {
+			return la < lb
+		}
+		return p.addresses[a].Address < p.addresses[b].Address
+	})
+	return ids
+}
+
+// pick returns copies of the addresses at ids.
+func (p *LocalProvider) pick(ids []int) []*Address {
+	res := make([]*Address, len(ids))
+	for i, id := range ids {
+		addr := p.addresses[id]
+		res[i] = &addr
+	}
+	return res
+}
+
+// match scores the addresses containing a word that q matches:
+// 3 for the word itself, 2 for a word starting with q, 1 for a near miss.
+func (p *LocalProvider) match(q string) map[int]int {
+	matched := map[int]int{}
+	add := func(term string, score int) {
+		for _, id := range p.postings[term] {
+			if matched[id] < score {
+				matched[id] = score
+			}
+		}
+	}
+
+	for i := sort.SearchStrings(p.terms, q); i < len(p.terms) && strings.HasPrefix(p.terms[i], q); i++ {
+		if p.terms[i] == q {
+			add(p.terms[i], 3)
+		} else {
+			add(p.terms[i], 2)
+		}
+	}
+
+	maxEdits := fuzzyEdits(q)
+	if maxEdits == 0 {
+		return matched
+	}
+	// Also forgives typos in a word typed only in part.
+	p.fuzzy.near([]rune(q), maxEdits, func(id int) { add(p.terms[id], 1) })
+	return matched
+}
+
+func (p *LocalProvider) Reverse(_ context.Context, lat, lng float64) ([]*Address, error) {
+	hits := p.tree.Nearest(toPoint3(lat, lng), localReverseLimit, p.radius2)
+
+	res := make([]*Address, len(hits))
+	for i, h := range hits {
+		addr := p.addresses[h.id]
+		res[i] = &addr
+	}
+	return res, nil
+}
+
+// searchTerms splits s into lower cased words, "ё" is folded into "е".
+func searchTerms(s string) []string {
+	s = strings.ReplaceAll(strings.ToLower(s), "ё", "е")
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// fuzzyEdits is the number of typos forgiven in a query word, none for short ones.
+func fuzzyEdits(q string) int {
+	switch n := utf8.RuneCountInString(q); {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// editDistance returns the Levenshtein distance of a and b, or max+1 once it
+// is known to exceed max.
+func editDistance(a, b []rune, max int) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if cur[j] < rowMin {
+				rowMin = cur[j]
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(v int, rest ...int) int {
+	for _, r := range rest {
+		if r < v {
+			v = r
+		}
+	}
+	return v
+}
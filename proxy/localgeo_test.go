@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var localAddresses = []Address{
+	{Address: "г Москва, ул Сухонская, д 11", Lat: 55.878315, Lon: 37.65372},
+	{Address: "г Москва, ул Сухонская, д 13", Lat: 55.878666, Lon: 37.6524},
+	{Address: "г Москва, Красная пл, д 1", Lat: 55.7536, Lon: 37.6211},
+	{Address: "г Санкт-Петербург, Ленинский пр-кт, д 118 к 1", Lat: 59.851, Lon: 30.268},
+	{Address: "г Королёв, ул Ленина, д 2", Lat: 55.9162, Lon: 37.8545},
+}
+
+func Test_LocalProviderSearch(t *testing.T) {
+	p := NewLocalProvider(localAddresses, defaultLocalReverseRadius)
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"exact", "Сухонская 11", []string{"г Москва, ул Сухонская, д 11"}},
+		{"prefix", "сухон", []string{"г Москва, ул Сухонская, д 11", "г Москва, ул Сухонская, д 13"}},
+		{"typo", "Сухонсакя", []string{"г Москва, ул Сухонская, д 11", "г Москва, ул Сухонская, д 13"}},
+		{"yo", "королев", []string{"г Королёв, ул Ленина, д 2"}},
+		{"all words", "Москва Ленинский", []string{}},
+		{"exact first", "Ленина", []string{"г Королёв, ул Ленина, д 2", "г Санкт-Петербург, Ленинский пр-кт, д 118 к 1"}},
+		{"empty", " ,", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := p.Search(ctx, tt.query)
+			assert.NoError(t, err)
+			got := []string{}
+			for _, a := range res {
+				got = append(got, a.Address)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_LocalProviderReverse(t *testing.T) {
+	p := NewLocalProvider(localAddresses, 500)
+	ctx := context.Background()
+
+	res, err := p.Reverse(ctx, 55.8787, 37.6523)
+	assert.NoError(t, err)
+	assert.Len(t, res, 2)
+	assert.Equal(t, "г Москва, ул Сухонская, д 13", res[0].Address)
+
+	res, err = p.Reverse(ctx, 0, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, res)
+}
+
+func Test_kdTreeNearest(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	points := make([]point3, 2000)
+	for i := range points {
+		points[i] = toPoint3(rnd.Float64()*180-90, rnd.Float64()*360-180)
+	}
+	tree := newKDTree(points)
+
+	for i := 0; i < 50; i++ {
+		target := toPoint3(rnd.Float64()*180-90, rnd.Float64()*360-180)
+		max2 := metresToChord2(800000)
+
+		var want []kdHit
+		for id, p := range points {
+			if d := p.dist2(target); d <= max2 {
+				want = append(want, kdHit{id: id, dist2: d})
+			}
+		}
+		sort.Slice(want, func(i, j int) bool { return want[i].dist2 < want[j].dist2 })
+		if len(want) > 5 {
+			want = want[:5]
+		}
+
+		got := tree.Nearest(target, 5, max2)
+		assert.Equal(t, len(want), len(got))
+		for j := range want {
+			assert.Equal(t, want[j].id, got[j].id)
+		}
+	}
+
+	assert.InDelta(t, 1000, chordToMetres(metresToChord2(1000)), 1e-6)
+}
+
+// randomWords returns n words of 2 to 12 letters from a small alphabet, so
+// that many of them are a few typos apart.
+func randomWords(rnd *rand.Rand, n int) []string {
+	letters := []rune("абвгдеклмнор")
+	words := make([]string, n)
+	for i := range words {
+		w := make([]rune, 2+rnd.Intn(11))
+		for j := range w {
+			w[j] = letters[rnd.Intn(len(letters))]
+		}
+		words[i] = string(w)
+	}
+	return words
+}
+
+func TestLocalProvider_matchFuzzy(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	words := randomWords(rnd, 3000)
+	addresses := make([]Address, len(words))
+	for i, w := range words {
+		addresses[i] = Address{Address: w}
+	}
+	p := NewLocalProvider(addresses, defaultLocalReverseRadius)
+
+	for _, q := range randomWords(rnd, 200) {
+		// Every term compared in full, or by its first letters when it is much longer.
+		want := map[int]int{}
+		qr := []rune(q)
+		maxEdits := fuzzyEdits(q)
+		for _, term := range p.terms {
+			score := 0
+			switch tr := []rune(term); {
+			case term == q:
+				score = 3
+			case strings.HasPrefix(term, q):
+				score = 2
+			case maxEdits == 0:
+			case len(tr) > len(qr)+maxEdits && editDistance(qr, tr[:len(qr)], maxEdits) <= maxEdits,
+				len(tr) <= len(qr)+maxEdits && editDistance(qr, tr, maxEdits) <= maxEdits:
+				score = 1
+			}
+			for _, id := range p.postings[term] {
+				if score > want[id] {
+					want[id] = score
+				}
+			}
+		}
+		for id, score := range want {
+			if score == 0 {
+				delete(want, id)
+			}
+		}
+		assert.Equal(t, want, p.match(q), q)
+	}
+}
+
+func BenchmarkLocalProvider_Search(b *testing.B) {
+	// Street names have a far sparser vocabulary than randomWords.
+	rnd := rand.New(rand.NewSource(1))
+	letters := []rune("абвгдежзийклмнопрстуфхцчшщыэюя")
+	word := func() []rune {
+		w := make([]rune, 4+rnd.Intn(9))
+		for j := range w {
+			w[j] = letters[rnd.Intn(len(letters))]
+		}
+		return w
+	}
+	addresses := make([]Address, 20000)
+	for i := range addresses {
+		addresses[i] = Address{Address: "ул " + string(word()) + ", д " + strconv.Itoa(i%200)}
+	}
+	p := NewLocalProvider(addresses, defaultLocalReverseRadius)
+	queries := make([]string, 100)
+	for i := range queries {
+		// A known street name with a typo.
+		q := []rune(searchTerms(addresses[rnd.Intn(len(addresses))].Address)[1])
+		q[rnd.Intn(len(q))] = letters[rnd.Intn(len(letters))]
+		queries[i] = string(q)
+	}
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Search(ctx, queries[i%len(queries)])
+	}
+}
+
+func Test_LoadLocalProvider(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "addresses.csv")
+	assert.NoError(t, os.WriteFile(csvPath, []byte("id,address,lat,lng\n1,\"г Москва, Красная пл, д 1\",55.7536,37.6211\n"), 0o600))
+	geoPath := filepath.Join(dir, "addresses.geojson")
+	assert.NoError(t, os.WriteFile(geoPath, []byte(`{"type":"FeatureCollection","features":[
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[37.6211,55.7536]},"properties":{"country":"Россия","city":"Москва","street":"Красная площадь","housenumber":"1"}},
+		{"type":"Feature","geometry":{"type":"LineString","coordinates":[[37.6,55.7],[37.7,55.8]]},"properties":{"name":"ignored"}}]}`), 0o600))
+	badPath := filepath.Join(dir, "addresses.csv.gz")
+	assert.NoError(t, os.WriteFile(badPath, nil, 0o600))
+
+	p, err := LoadLocalProvider(csvPath, defaultLocalReverseRadius)
+	assert.NoError(t, err)
+	assert.Equal(t, []Address{{Address: "г Москва, Красная пл, д 1", Lat: 55.7536, Lon: 37.6211}}, p.addresses)
+
+	p, err = LoadLocalProvider(geoPath, defaultLocalReverseRadius)
+	assert.NoError(t, err)
+	assert.Equal(t, []Address{{Address: "Россия, Москва, Красная площадь 1", Lat: 55.7536, Lon: 37.6211}}, p.addresses)
+
+	_, err = LoadLocalProvider(badPath, defaultLocalReverseRadius)
+	assert.Error(t, err)
+
+	chain, err := newGeoProvider(&Config{GeoProviders: []string{GeoProviderPhoton, GeoProviderLocal}, LocalDatasetPath: csvPath, LocalReverseRadius: 100})
+	assert.NoError(t, err)
+	assert.Len(t, chain.Health(), 2)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	lockoutKindLogin = "login"
+	lockoutKindIP    = "ip"
+
+	loginGuardSweepInterval = time.Minute
+)
+
+// LoginGuardConfig holds the limits of a LoginGuard.
+type LoginGuardConfig struct {
+	// MaxLoginFailures and MaxIPFailures are the failed attempts allowed for
+	// one login or one client address before it gets locked out.
+	MaxLoginFailures int
+	MaxIPFailures    int
+	// BaseLockout is the first lockout, every further failure doubles it up to MaxLockout.
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	// Window is how long failures are remembered after the last one.
+	Window time.Duration
+}
+
+var defaultLoginGuardConfig = LoginGuardConfig{
+	MaxLoginFailures: 5,
+	MaxIPFailures:    20,
+	BaseLockout:      30 * time.Second,
+	MaxLockout:       time.Hour,
+	Window:           time.Hour,
+}
+
+// loginGuard is replaced in main by the configured one.
+var loginGuard = NewLoginGuard(defaultLoginGuardConfig)
+
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+type lockoutKey struct {
+	kind  string
+	value string
+}
+
+// LoginGuard counts failed logins per login and per client address and
+// locks them out for exponentially growing periods.
+type LoginGuard struct {
+	mu        sync.Mutex
+	cfg       LoginGuardConfig
+	attempts  map[lockoutKey]*loginAttempts
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewLoginGuard(cfg LoginGuardConfig) *LoginGuard {
+	return &LoginGuard{cfg: cfg, attempts: make(map[lockoutKey]*loginAttempts), now: time.Now}
+}
+
+// Locked returns how long login or ip remain locked out, zero if neither is.
+func (g *LoginGuard) Locked(login, ip string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	var wait time.Duration
+	for _, key := range []lockoutKey{{lockoutKindLogin, login}, {lockoutKindIP, ip}} {
+		if a := g.get(key, now); a != nil && a.lockedUntil.After(now) {
+			if d := a.lockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// Fail records a failed attempt for login from ip.
+func (g *LoginGuard) Fail(login, ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	g.sweep(now)
+	g.fail(lockoutKey{lockoutKindLogin, login}, g.cfg.MaxLoginFailures, now)
+	g.fail(lockoutKey{lockoutKindIP, ip}, g.cfg.MaxIPFailures, now)
+}
+
+// Succeed forgets the failures of login. Failures of the client address are
+// kept, so one known account does not reset an address guessing others.
+func (g *LoginGuard) Succeed(login string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.attempts, lockoutKey{lockoutKindLogin, login})
+}
+
+// Unlock forgets the failures of value of the given kind, reporting whether there were any.
+func (g *LoginGuard) Unlock(kind, value string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := lockoutKey{kind, value}
+	_, ok := g.attempts[key]
+	delete(g.attempts, key)
+	return ok
+}
+
+// Status lists every login and address with remembered failures.
+func (g *LoginGuard) Status() []loginLockout {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	res := []loginLockout{}
+	for key := range g.attempts {
+		a := g.get(key, now)
+		if a == nil {
+			continue
+		}
+		l := loginLockout{Kind: key.kind, Value: key.value, Failures: a.failures}
+		if a.lockedUntil.After(now) {
+			until := a.lockedUntil
+			l.LockedUntil = &until
+		}
+		res = append(res, l)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Kind != res[j].Kind {
+			return res[i].Kind < res[j].Kind
+		}
+		return res[i].Value < res[j].Value
+	})
+	return res
+}
+
+// get returns the attempts of key, dropping them once the window has passed.
+func (g *LoginGuard) get(key lockoutKey, now time.Time) *loginAttempts {
+	a, ok := g.attempts[key]
+	if !ok {
+		return nil
+	}
+	if now.Sub(a.lastFailure) > g.cfg.Window && !a.lockedUntil.After(now) {
+		delete(g.attempts, key)
+		return nil
+	}
+	return a
+}
+
+// sweep drops, once every loginGuardSweepInterval, the failures that are out
+// of the window and no longer lock anything out, so logins and addresses
+// tried once are not kept forever.
+func (g *LoginGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < loginGuardSweepInterval {
+		return
+	}
+	g.lastSweep = now
+	for key := range g.attempts {
+		g.get(key, now)
+	}
+}
+
+func (g *LoginGuard) fail(key lockoutKey, max int, now time.Time) {
+	a := g.get(key, now)
+	if a == nil {
+		a = &loginAttempts{}
+		g.attempts[key] = a
+	}
+	a.failures++
+	a.lastFailure = now
+
+	if max <= 0 || a.failures < max {
+		return
+	}
+	lockout := g.cfg.BaseLockout
+	for i := max; i < a.failures && lockout < g.cfg.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > g.cfg.MaxLockout {
+		lockout = g.cfg.MaxLockout
+	}
+	a.lockedUntil = now.Add(lockout)
+}
+
+// dummyHash is compared against for unknown logins, it is hashed at startup
+// so that the first such login takes no longer than the others.
+var dummyHash []byte
+
+// newDummyHash hashes a random password at cost.
+func newDummyHash(cost int) ([]byte, error) {
+	return bcrypt.GenerateFromPassword(randomSecret()[:16], cost)
+}
+
+// comparePassword checks password against user's hash. Unknown users are
+// compared against a dummy hash of the same cost, so the response time does
+// not tell whether a login exists.
+func comparePassword(user *User, password string) bool {
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil
+}
+
+// clientIP returns the address of the client that sent r.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeLockedOut answers a login attempt made during a lockout.
+func writeLockedOut(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	writeError(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+}
+
+// swagger:model loginLockout
+type loginLockout struct {
+	// what is tracked: "login" or "ip"
+	//
+	// example: login
+	Kind string `json:"kind"`
+	// the login or client address
+	//
+	// example: user1
+	Value string `json:"value"`
+	// failed attempts within the window
+	//
+	// example: 6
+	Failures int `json:"failures"`
+	// end of the current lockout, absent when not locked out
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+func handleAdminListLockouts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, loginGuard.Status())
+}
+
+func handleAdminUnlock(w http.ResponseWriter, r *http.Request) {
+	kind := chi.URLParam(r, "kind")
+	if kind != lockoutKindLogin && kind != lockoutKindIP {
+		writeError(w, "bad request: kind must be login or ip", http.StatusBadRequest)
+		return
+	}
+	if !loginGuard.Unlock(kind, chi.URLParam(r, "value")) {
+		writeError(w, "Lockout not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_LoginGuard(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	g := NewLoginGuard(LoginGuardConfig{MaxLoginFailures: 3, MaxIPFailures: 5, BaseLockout: time.Minute, MaxLockout: 5 * time.Minute, Window: time.Hour})
+	g.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		g.Fail("user1", "10.0.0.1")
+	}
+	assert.Zero(t, g.Locked("user1", "10.0.0.1"))
+
+	g.Fail("user1", "10.0.0.1")
+	assert.Equal(t, time.Minute, g.Locked("user1", "10.0.0.2"))
+	g.Fail("user1", "10.0.0.1")
+	assert.Equal(t, 2*time.Minute, g.Locked("user1", "10.0.0.2"))
+
+	// the address reached its own limit and stays locked for other logins
+	g.Fail("user2", "10.0.0.1")
+	assert.Equal(t, time.Minute, g.Locked("user3", "10.0.0.1"))
+
+	for i := 0; i < 5; i++ {
+		g.Fail("user1", "10.0.0.3")
+	}
+	assert.Equal(t, 5*time.Minute, g.Locked("user1", "10.0.0.4"), "lockout is capped")
+
+	g.Succeed("user1")
+	assert.Zero(t, g.Locked("user1", "10.0.0.4"))
+	assert.Equal(t, []loginLockout{
+		{Kind: "ip", Value: "10.0.0.1", Failures: 5, LockedUntil: timePtr(now.Add(time.Minute))},
+		{Kind: "ip", Value: "10.0.0.3", Failures: 5, LockedUntil: timePtr(now.Add(time.Minute))},
+		{Kind: "login", Value: "user2", Failures: 1},
+	}, g.Status())
+
+	assert.True(t, g.Unlock("ip", "10.0.0.1"))
+	assert.False(t, g.Unlock("ip", "10.0.0.1"))
+	assert.Zero(t, g.Locked("user3", "10.0.0.1"))
+
+	now = now.Add(2 * time.Hour)
+	assert.Empty(t, g.Status(), "failures are forgotten after the window")
+}
+
+func Test_LoginGuardSweep(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	g := NewLoginGuard(LoginGuardConfig{MaxLoginFailures: 3, MaxIPFailures: 5, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour})
+	g.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		g.Fail("guess"+strconv.Itoa(i), "10.0.0.1")
+	}
+	assert.Len(t, g.attempts, 101)
+
+	now = now.Add(2 * time.Hour)
+	g.Fail("user1", "10.0.0.2")
+	assert.Len(t, g.attempts, 2, "failures out of the window are swept away")
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func Test_handleLoginLockout(t *testing.T) {
+	saved := loginGuard
+	loginGuard = NewLoginGuard(LoginGuardConfig{MaxLoginFailures: 2, MaxIPFailures: 100, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour})
+	defer func() { loginGuard = saved }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	admin := issueTestToken(t, User{Login: "LockAdmin", Roles: []string{RoleAdmin}})
+	pass, err := hashPassword("s3cret-hugo")
+	assert.NoError(t, err)
+	issueTestToken(t, User{Login: "LockUser", Password: pass})
+
+	do := func(method, url, body, token string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res, buf.String()
+	}
+
+	for i := 0; i < 2; i++ {
+		res, body := do("POST", "/api/login", `{"login":"LockUser","password":"wr0ng-hugo"}`, "")
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+		assert.Equal(t, "{\"error\":\"Invalid login or password\"}\n", body)
+	}
+
+	res, body := do("POST", "/api/login", `{"login":"LockUser","password":"s3cret-hugo"}`, "")
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "60", res.Header.Get("Retry-After"))
+	assert.Equal(t, "{\"error\":\"Too many failed login attempts, try again later\"}\n", body)
+
+	res, body = do("GET", "/api/admin/lockouts", "", admin)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, body, `{"kind":"login","value":"LockUser","failures":2,"locked_until":`)
+
+	res, _ = do("DELETE", "/api/admin/lockouts/user/LockUser", "", admin)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res, _ = do("DELETE", "/api/admin/lockouts/login/LockUser", "", admin)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, _ = do("DELETE", "/api/admin/lockouts/login/LockUser", "", admin)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, _ = do("POST", "/api/login", `{"login":"LockUser","password":"s3cret-hugo"}`, "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultNominatimURL = "https://nominatim.openstreetmap.org"
+	defaultPhotonURL    = "https://photon.komoot.io"
+
+	geoSearchLimit = 10
+)
+
+// NominatimProvider talks to a Nominatim server, the OpenStreetMap one or a
+// self hosted instance. Its usage policy requires an identifying User-Agent
+// and forbids autocompletion, so it offers no suggestions.
+type NominatimProvider struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewNominatimProvider(baseURL string, client *http.Client) *NominatimProvider {
+	if baseURL == "" {
+		baseURL = defaultNominatimURL
+	}
+	if client == nil {
+		client = defaultUpstreamClient
+	}
+	return &NominatimProvider{baseURL: strings.TrimRight(baseURL, "/"), client: client}
+}
+
+type nominatimPlace struct {
+	DisplayName string `json:"display_name"`
+	Lat         string `json:"lat"`
+	Lon         string `json:"lon"`
+	OSMType     string `json:"osm_type"`
+	OSMID       int64  `json:"osm_id"`
+	Address     struct {
+		HouseNumber string `json:"house_number"`
+		Road        string `json:"road"`
+		Village     string `json:"village"`
+		Town        string `json:"town"`
+		City        string `json:"city"`
+		State       string `json:"state"`
+		Postcode    string `json:"postcode"`
+		Country     string `json:"country"`
+		CountryCode string `json:"country_code"`
+	} `json:"address"`
+	Error string `json:"error"`
+}
+
+func (p nominatimPlace) address() *Address {
+	a := p.Address
+	city := a.City
+	if city == "" {
+		city = a.Town
+	}
+	details := &AddressDetails{
+		Country:    a.Country,
+		CountryISO: strings.ToUpper(a.CountryCode),
+		Region:     a.State,
+		City:       city,
+		Settlement: a.Village,
+		Street:     a.Road,
+		House:      a.HouseNumber,
+		PostalCode: a.Postcode,
+		OSMID:      osmID(p.OSMType, p.OSMID),
+	}
+	addr := &Address{Address: p.DisplayName, Details: details}
+	addr.Lat, _ = strconv.ParseFloat(p.Lat, 64)
+	addr.Lon, _ = strconv.ParseFloat(p.Lon, 64)
+	return addr
+}
+
+func (p *NominatimProvider) Search(ctx context.Context, query string) ([]*Address, error) {
+	params := url.Values{
+		"q":              {query},
+		"format":         {"jsonv2"},
+		"limit":          {strconv.Itoa(geoSearchLimit)},
+		"addressdetails": {"1"},
+	}
+	var places []nominatimPlace
+	if err := getJSON(ctx, p.client, p.baseURL+"/search?"+params.Encode(), "nominatim", &places); err != nil {
+		return nil, err
+	}
+
+	addresses := make([]*Address, len(places))
+	for i, place := range places {
+		addresses[i] = place.address()
+	}
+	return addresses, nil
+}
+
+// Reverse returns the single place Nominatim finds at the point, or none.
+func (p *NominatimProvider) Reverse(ctx context.Context, lat, lng float64) ([]*Address, error) {
+	params := url.Values{
+		"lat":            {strconv.FormatFloat(lat, 'f', -1, 64)},
+		"lon":            {strconv.FormatFloat(lng, 'f', -1, 64)},
+		"format":         {"jsonv2"},
+		"addressdetails": {"1"},
+	}
+	var place nominatimPlace
+	if err := getJSON(ctx, p.client, p.baseURL+"/reverse?"+params.Encode(), "nominatim", &place); err != nil {
+		return nil, err
+	}
+	// Nominatim answers 200 with an error field when nothing is there.
+	if place.Error != "" || place.DisplayName == "" {
+		return []*Address{}, nil
+	}
+	return []*Address{place.address()}, nil
+}
+
+// PhotonProvider talks to a Photon server, which answers with GeoJSON.
+type PhotonProvider struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewPhotonProvider(baseURL string, client *http.Client) *PhotonProvider {
+	if baseURL == "" {
+		baseURL = defaultPhotonURL
+	}
+	if client == nil {
+		client = defaultUpstreamClient
+	}
+	return &PhotonProvider{baseURL: strings.TrimRight(baseURL, "/"), client: client}
+}
+
+type photonResponse struct {
+	Features []struct {
+		Geometry struct {
+			// Coordinates are longitude, latitude.
+			Coordinates []float64 `json:"coordinates"`
+		} `json:"geometry"`
+		Properties osmProperties `json:"properties"`
+	} `json:"features"`
+}
+
+// osmProperties are the address parts of an OpenStreetMap based GeoJSON feature.
+type osmProperties struct {
+	// Address is a ready made label, used as is when present.
+	Address     string `json:"address"`
+	Name        string `json:"name"`
+	Street      string `json:"street"`
+	HouseNumber string `json:"housenumber"`
+	City        string `json:"city"`
+	State       string `json:"state"`
+	Country     string `json:"country"`
+	Postcode    string `json:"postcode"`
+	CountryCode string `json:"countrycode"`
+	OSMType     string `json:"osm_type"`
+	OSMID       int64  `json:"osm_id"`
+}
+
+func (pr osmProperties) details() *AddressDetails {
+	return &AddressDetails{
+		Country:    pr.Country,
+		CountryISO: strings.ToUpper(pr.CountryCode),
+		Region:     pr.State,
+		City:       pr.City,
+		Street:     pr.Street,
+		House:      pr.HouseNumber,
+		PostalCode: pr.Postcode,
+		OSMID:      osmID(pr.OSMType, pr.OSMID),
+	}
+}
+
+// osmID formats an OpenStreetMap object as N123, W123 or R123, typ may be
+// spelled out as Nominatim does or be just the letter as with Photon.
+func osmID(typ string, id int64) string {
+	if typ == "" || id == 0 {
+		return ""
+	}
+	return strings.ToUpper(typ[:1]) + strconv.FormatInt(id, 10)
+}
+
+// label joins the parts from the largest to the smallest, skipping repeats.
+func (pr osmProperties) label() string {
+	if pr.Address != "" {
+		return pr.Address
+	}
+	street := strings.TrimSpace(pr.Street + " " + pr.HouseNumber)
+
+	var parts []string
+	for _, part := range []string{pr.Country, pr.State, pr.City, street, pr.Name} {
+		if part != "" && (len(parts) == 0 || parts[len(parts)-1] != part) {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (r photonResponse) addresses() []*Address {
+	addresses := make([]*Address, 0, len(r.Features))
+	for _, f := range r.Features {
+		addr := &Address{Address: f.Properties.label(), Details: f.Properties.details()}
+		if len(f.Geometry.Coordinates) == 2 {
+			addr.Lon, addr.Lat = f.Geometry.Coordinates[0], f.Geometry.Coordinates[1]
+		}
+		addresses = append(addresses, addr)
+	}
+	return addresses
+}
+
+func (p *PhotonProvider) Search(ctx context.Context, query string) ([]*Address, error) {
+	params := url.Values{
+		"q":     {query},
+		"limit": {strconv.Itoa(geoSearchLimit)},
+	}
+	var res photonResponse
+	if err := getJSON(ctx, p.client, p.baseURL+"/api?"+params.Encode(), "photon", &res); err != nil {
+		return nil, err
+	}
+	return res.addresses(), nil
+}
+
+// Suggest uses the Photon search, which is built for autocompletion and
+// favours places near a point by itself. Regions are filtered here, out of a
+// longer list.
+func (p *PhotonProvider) Suggest(ctx context.Context, query string, opts SuggestOptions) ([]*Address, error) {
+	limit := opts.Limit
+	if len(opts.Regions) > 0 {
+		limit = maxSuggestLimit
+	}
+	params := url.Values{
+		"q":     {query},
+		"limit": {strconv.Itoa(limit)},
+	}
+	if opts.Near {
+		params.Set("lat", strconv.FormatFloat(opts.Lat, 'f', -1, 64))
+		params.Set("lon", strconv.FormatFloat(opts.Lng, 'f', -1, 64))
+	}
+	var res photonResponse
+	if err := getJSON(ctx, p.client, p.baseURL+"/api?"+params.Encode(), "photon", &res); err != nil {
+		return nil, err
+	}
+	return opts.finish(res.addresses(), false, true), nil
+}
+
+func (p *PhotonProvider) Reverse(ctx context.Context, lat, lng float64) ([]*Address, error) {
+	params := url.Values{
+		"lat": {strconv.FormatFloat(lat, 'f', -1, 64)},
+		"lon": {strconv.FormatFloat(lng, 'f', -1, 64)},
+	}
+	var res photonResponse
+	if err := getJSON(ctx, p.client, p.baseURL+"/reverse?"+params.Encode(), "photon", &res); err != nil {
+		return nil, err
+	}
+	return res.addresses(), nil
+}
+
+// getJSON fetches url and decodes the JSON answer into v, name identifies the backend in errors.
+func getJSON(ctx context.Context, client *http.Client, url, name string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", geoUserAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("nominatim.go: error request %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error status %v %s", resp.StatusCode, name)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode %s response: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NominatimProvider(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.String())
+		assert.Equal(t, geoUserAgent, r.Header.Get("User-Agent"))
+		switch {
+		case r.URL.Path == "/search":
+			fmt.Fprint(w, `[{"display_name":"Красная площадь, Москва, Россия","lat":"55.7536","lon":"37.6211","osm_type":"way","osm_id":4108738,
+				"address":{"road":"Красная площадь","city":"Москва","state":"Москва","postcode":"109012","country":"Россия","country_code":"ru"}}]`)
+		case r.URL.Query().Get("lat") == "0":
+			fmt.Fprint(w, `{"error":"Unable to geocode"}`)
+		default:
+			fmt.Fprint(w, `{"display_name":"Кремль, Москва, Россия","lat":"55.752","lon":"37.6175"}`)
+		}
+	}))
+	defer server.Close()
+
+	p := NewNominatimProvider(server.URL+"/", nil)
+	ctx := context.Background()
+
+	got, err := p.Search(ctx, "Красная площадь")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Address{{Address: "Красная площадь, Москва, Россия", Lat: 55.7536, Lon: 37.6211, Details: &AddressDetails{
+		Country: "Россия", CountryISO: "RU", Region: "Москва", City: "Москва", Street: "Красная площадь", PostalCode: "109012", OSMID: "W4108738",
+	}}}, got)
+
+	got, err = p.Reverse(ctx, 55.752, 37.6175)
+	assert.NoError(t, err)
+	assert.Equal(t, []*Address{{Address: "Кремль, Москва, Россия", Lat: 55.752, Lon: 37.6175, Details: &AddressDetails{}}}, got)
+
+	got, err = p.Reverse(ctx, 0, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+
+	assert.Equal(t, []string{
+		"/search?addressdetails=1&format=jsonv2&limit=10&q=%D0%9A%D1%80%D0%B0%D1%81%D0%BD%D0%B0%D1%8F+%D0%BF%D0%BB%D0%BE%D1%89%D0%B0%D0%B4%D1%8C",
+		"/reverse?addressdetails=1&format=jsonv2&lat=55.752&lon=37.6175",
+		"/reverse?addressdetails=1&format=jsonv2&lat=0&lon=0",
+	}, requests)
+}
+
+func Test_PhotonProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" && r.URL.Query().Get("q") == "fail" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, `{"type":"FeatureCollection","features":[{"type":"Feature",
+			"geometry":{"type":"Point","coordinates":[37.65372,55.8782557]},
+			"properties":{"country":"Россия","countrycode":"RU","state":"Москва","city":"Москва","street":"улица Сухонская","housenumber":"11","postcode":"127642","osm_type":"N","osm_id":42}}]}`)
+	}))
+	defer server.Close()
+
+	p := NewPhotonProvider(server.URL, nil)
+	ctx := context.Background()
+	want := []*Address{{Address: "Россия, Москва, улица Сухонская 11", Lat: 55.8782557, Lon: 37.65372, Details: &AddressDetails{
+		Country: "Россия", CountryISO: "RU", Region: "Москва", City: "Москва", Street: "улица Сухонская", House: "11", PostalCode: "127642", OSMID: "N42",
+	}}}
+
+	got, err := p.Search(ctx, "Сухонская 11")
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	got, err = p.Reverse(ctx, 55.8782557, 37.65372)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	_, err = p.Search(ctx, "fail")
+	assert.EqualError(t, err, "error status 502 photon")
+}
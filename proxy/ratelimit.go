@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// roleAnonymous names the limits of requests made without a token, counted
+// per client address.
+const roleAnonymous = "anonymous"
+
+const (
+	bucketSweepInterval = time.Minute
+	quotaSaveInterval   = time.Minute
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// RateLimit is what one caller may do. Zero in any field means no limit.
+type RateLimit struct {
+	// Rate is the sustained number of requests a second, Burst how many may
+	// come at once.
+	Rate  float64
+	Burst int
+	// Daily and Monthly cap the geo lookups made in a calendar day and month, UTC.
+	Daily   int
+	Monthly int
+}
+
+var defaultRateLimits = map[string]RateLimit{
+	RoleUser:      {Rate: 5, Burst: 20, Daily: 5000, Monthly: 100000},
+	RoleAdmin:     {Rate: 20, Burst: 50},
+	roleAnonymous: {Rate: 1, Burst: 10},
+}
+
+// or returns the more generous of l and o, field by field.
+func (l RateLimit) or(o RateLimit) RateLimit {
+	more := func(a, b float64) float64 {
+		if a == 0 || b == 0 {
+			return 0
+		}
+		return math.Max(a, b)
+	}
+	return RateLimit{
+		Rate:    more(l.Rate, o.Rate),
+		Burst:   int(more(float64(l.Burst), float64(o.Burst))),
+		Daily:   int(more(float64(l.Daily), float64(o.Daily))),
+		Monthly: int(more(float64(l.Monthly), float64(o.Monthly))),
+	}
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate a second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket will have refilled, it can be forgotten then.
+	full time.Time
+}
+
+// quotaUsage counts the lookups of one login in the current day and month.
+type quotaUsage struct {
+	Day     string `json:"day"`
+	Daily   int    `json:"daily"`
+	Month   string `json:"month"`
+	Monthly int    `json:"monthly"`
+}
+
+// UsageLimiter enforces a RateLimit per caller: a token bucket per login, or
+// per client address for anonymous requests, and daily and monthly quotas
+// per login. The limits of a login are the most generous of its roles.
+// Quota usage is kept in path, when given, so it survives a restart.
+type UsageLimiter struct {
+	mu        sync.Mutex
+	limits    map[string]RateLimit
+	buckets   map[string]*tokenBucket
+	usage     map[string]*quotaUsage
+	path      string
+	dirty     bool
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// usageLimiter is replaced in main by the configured one, the default
+// limits nothing.
+var usageLimiter = &UsageLimiter{limits: map[string]RateLimit{}, buckets: map[string]*tokenBucket{}, usage: map[string]*quotaUsage{}, now: time.Now}
+
+// NewUsageLimiter enforces limits, keyed by role, and loads the quota usage
+// stored in path.
+func NewUsageLimiter(limits map[string]RateLimit, path string) (*UsageLimiter, error) {
+	l := &UsageLimiter{
+		limits:  limits,
+		buckets: map[string]*tokenBucket{},
+		usage:   map[string]*quotaUsage{},
+		path:    path,
+		now:     time.Now,
+	}
+	if path != "" {
+		if err := readJSONFile(path, &l.usage); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// limitFor returns the limits of a caller with roles.
+func (l *UsageLimiter) limitFor(roles []string) RateLimit {
+	if len(roles) == 0 {
+		roles = []string{RoleUser}
+	}
+	limit, ok := l.limits[roles[0]]
+	for _, role := range roles[1:] {
+		if o, found := l.limits[role]; found {
+			if !ok {
+				limit, ok = o, true
+				continue
+			}
+			limit = limit.or(o)
+		}
+	}
+	return limit
+}
+
+type rateStatus struct {
+	limit     int
+	remaining int
+	// reset is how long until the bucket is full again, retry how long until
+	// the next request is let through.
+	reset, retry time.Duration
+}
+
+// take spends a token of the bucket under key, reporting whether there was one.
+func (l *UsageLimiter) take(key string, limit RateLimit) (rateStatus, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	st := rateStatus{
+		limit:     limit.Burst,
+		remaining: int(b.tokens),
+		reset:     time.Duration((float64(limit.Burst) - b.tokens) / limit.Rate * float64(time.Second)),
+	}
+	if !allowed {
+		st.retry = time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	b.full = now.Add(st.reset)
+	return st, allowed
+}
+
+// sweep drops, once every bucketSweepInterval, the buckets that have been
+// idle long enough to be full again.
+func (l *UsageLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if !now.Before(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type quotaStatus struct {
+	daily, monthly int
+	// retry is how long until the exhausted quota starts over.
+	retry time.Duration
+}
+
+// spend counts n lookups of login, unless they do not fit into its quotas.
+func (l *UsageLimiter) spend(login string, limit RateLimit, n int) (quotaStatus, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now().UTC()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	u, ok := l.usage[login]
+	if !ok {
+		u = &quotaUsage{}
+		l.usage[login] = u
+	}
+	if u.Day != day {
+		u.Day, u.Daily = day, 0
+	}
+	if u.Month != month {
+		u.Month, u.Monthly = month, 0
+	}
+
+	st := quotaStatus{daily: limit.Daily - u.Daily, monthly: limit.Monthly - u.Monthly}
+	switch {
+	case limit.Monthly > 0 && u.Monthly+n > limit.Monthly:
+		st.retry = time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC).Sub(now)
+		return st, errQuotaExceeded
+	case limit.Daily > 0 && u.Daily+n > limit.Daily:
+		st.retry = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now)
+		return st, errQuotaExceeded
+	}
+	u.Daily += n
+	u.Monthly += n
+	l.dirty = true
+	st.daily -= n
+	st.monthly -= n
+	return st, nil
+}
+
+// Save writes the quota usage to the file it was loaded from, if it changed.
+func (l *UsageLimiter) Save() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.path == "" || !l.dirty {
+		return nil
+	}
+	if err := writeJSONFile(l.path, l.usage); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// saveUsage saves the quota usage of l every interval.
+func saveUsage(l *UsageLimiter, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := l.Save(); err != nil {
+			log.Printf("ratelimit.go: save quota usage: %v", err)
+		}
+	}
+}
+
+// tokenRoles returns the roles claim of token, empty when it has none.
+func tokenRoles(token jwt.Token) []string {
+	v, _ := token.Get(rolesClaim)
+	switch roles := v.(type) {
+	case []string:
+		return roles
+	case []interface{}:
+		res := make([]string, 0, len(roles))
+		for _, role := range roles {
+			if s, ok := role.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+func setSeconds(h http.Header, key string, d time.Duration) {
+	h.Set(key, strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// limitRate answers 429 once key has used up its bucket.
+func limitRate(w http.ResponseWriter, key string, limit RateLimit) bool {
+	if limit.Rate <= 0 || limit.Burst <= 0 {
+		return true
+	}
+	st, ok := usageLimiter.take(key, limit)
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(st.limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(st.remaining))
+	setSeconds(h, "X-RateLimit-Reset", st.reset)
+	if !ok {
+		setSeconds(h, "Retry-After", st.retry)
+		writeError(w, "Too many requests, slow down", http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+// RateLimitByIP limits anonymous requests per client address.
+func RateLimitByIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limitRate(w, "ip:"+clientIP(r), usageLimiter.limitFor([]string{roleAnonymous})) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// RateLimitByUser limits requests per login, by the roles of the token. It
+// must run after Authenticator.
+func RateLimitByUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _, _ := jwtauth.FromContext(r.Context())
+		if limitRate(w, "user:"+token.Subject(), usageLimiter.limitFor(tokenRoles(token))) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+type quotaKey struct{}
+
+// quotaAccount lets a handler spend more of the quota of the caller.
+type quotaAccount struct {
+	login  string
+	limit  RateLimit
+	header http.Header
+}
+
+func (a *quotaAccount) spend(n int) error {
+	st, err := usageLimiter.spend(a.login, a.limit, n)
+	if a.limit.Daily > 0 {
+		a.header.Set("X-RateLimit-Daily-Limit", strconv.Itoa(a.limit.Daily))
+		a.header.Set("X-RateLimit-Daily-Remaining", strconv.Itoa(st.daily))
+	}
+	if a.limit.Monthly > 0 {
+		a.header.Set("X-RateLimit-Monthly-Limit", strconv.Itoa(a.limit.Monthly))
+		a.header.Set("X-RateLimit-Monthly-Remaining", strconv.Itoa(st.monthly))
+	}
+	if err != nil {
+		setSeconds(a.header, "Retry-After", st.retry)
+	}
+	return err
+}
+
+// QuotaDeferred hands the daily and monthly quotas of the caller to the
+// handler. It counts nothing itself: the handler spends with spendQuota once
+// it knows how many lookups the providers are asked for, and answers 429 with
+// writeQuotaExceeded when they are used up. It must run after Authenticator.
+func QuotaDeferred(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _, _ := jwtauth.FromContext(r.Context())
+		a := &quotaAccount{login: token.Subject(), limit: usageLimiter.limitFor(tokenRoles(token)), header: w.Header()}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), quotaKey{}, a)))
+	})
+}
+
+// spendQuota counts n more lookups against the quotas of the caller, it
+// returns errQuotaExceeded, spending nothing, when they do not fit.
+func spendQuota(ctx context.Context, n int) error {
+	a, ok := ctx.Value(quotaKey{}).(*quotaAccount)
+	if !ok || n <= 0 {
+		return nil
+	}
+	return a.spend(n)
+}
+
+func writeQuotaExceeded(w http.ResponseWriter) {
+	writeError(w, "Quota exceeded, try again once it starts over", http.StatusTooManyRequests)
+}
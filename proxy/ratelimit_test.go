@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageLimiter_take(t *testing.T) {
+	now := time.Date(2024, 5, 31, 23, 0, 0, 0, time.UTC)
+	l, _ := NewUsageLimiter(nil, "")
+	l.now = func() time.Time { return now }
+	limit := RateLimit{Rate: 2, Burst: 3}
+
+	for i := 2; i >= 0; i-- {
+		st, ok := l.take("user:a", limit)
+		assert.True(t, ok)
+		assert.Equal(t, i, st.remaining)
+	}
+	st, ok := l.take("user:a", limit)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, st.retry)
+	assert.Equal(t, 1500*time.Millisecond, st.reset)
+
+	_, ok = l.take("user:b", limit)
+	assert.True(t, ok, "every key has its own bucket")
+
+	now = now.Add(500 * time.Millisecond)
+	_, ok = l.take("user:a", limit)
+	assert.True(t, ok)
+
+	now = now.Add(2 * bucketSweepInterval)
+	l.take("user:c", limit)
+	assert.Len(t, l.buckets, 1, "full buckets are forgotten")
+}
+
+func TestUsageLimiter_spend(t *testing.T) {
+	now := time.Date(2024, 5, 31, 23, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "quota.json")
+	l, err := NewUsageLimiter(nil, path)
+	assert.NoError(t, err)
+	l.now = func() time.Time { return now }
+	limit := RateLimit{Daily: 3, Monthly: 5}
+
+	st, err := l.spend("a", limit, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, quotaStatus{daily: 1, monthly: 3}, st)
+	st, err = l.spend("a", limit, 2)
+	assert.ErrorIs(t, err, errQuotaExceeded)
+	assert.Equal(t, time.Hour, st.retry, "until the next day")
+	_, err = l.spend("a", limit, 1)
+	assert.NoError(t, err, "the refused lookups were not counted")
+
+	now = now.Add(2 * time.Hour)
+	st, err = l.spend("a", limit, 2)
+	assert.NoError(t, err, "a new day and month")
+	assert.Equal(t, quotaStatus{daily: 1, monthly: 3}, st)
+
+	now = now.Add(24 * time.Hour)
+	_, err = l.spend("a", limit, 3)
+	assert.NoError(t, err)
+	now = now.Add(24 * time.Hour)
+	st, err = l.spend("a", limit, 1)
+	assert.ErrorIs(t, err, errQuotaExceeded, "the month is used up")
+	assert.Equal(t, 27*24*time.Hour+23*time.Hour, st.retry, "until the next month")
+
+	assert.NoError(t, l.Save())
+	l, err = NewUsageLimiter(nil, path)
+	assert.NoError(t, err)
+	l.now = func() time.Time { return now }
+	_, err = l.spend("a", limit, 1)
+	assert.ErrorIs(t, err, errQuotaExceeded, "usage survives a restart")
+}
+
+func TestUsageLimiter_limitFor(t *testing.T) {
+	l, _ := NewUsageLimiter(map[string]RateLimit{
+		RoleUser:  {Rate: 1, Burst: 5, Daily: 10, Monthly: 100},
+		RoleAdmin: {Rate: 10, Burst: 2, Daily: 0, Monthly: 50},
+	}, "")
+
+	assert.Equal(t, RateLimit{Rate: 1, Burst: 5, Daily: 10, Monthly: 100}, l.limitFor(nil))
+	assert.Equal(t, RateLimit{Rate: 10, Burst: 5, Daily: 0, Monthly: 100}, l.limitFor([]string{RoleUser, RoleAdmin}))
+	assert.Equal(t, RateLimit{Rate: 10, Burst: 2, Daily: 0, Monthly: 50}, l.limitFor([]string{"auditor", RoleAdmin}))
+	assert.Equal(t, RateLimit{}, l.limitFor([]string{"auditor"}))
+}
+
+func Test_rateLimitRoutes(t *testing.T) {
+	saved, savedProvider := usageLimiter, geoProvider
+	usageLimiter, _ = NewUsageLimiter(map[string]RateLimit{
+		RoleUser:      {Rate: 0.001, Burst: 4, Daily: 5},
+		roleAnonymous: {Rate: 0.001, Burst: 1},
+	}, "")
+	geoProvider = &fakeGeoProvider{}
+	defer func() { usageLimiter, geoProvider = saved, savedProvider }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	token := "Bearer " + issueTestToken(t, User{Login: "LimitUser", Roles: []string{RoleUser}})
+	do := func(url, body string) (*http.Response, string) {
+		req, _ := http.NewRequest("POST", ts.URL+url, strings.NewReader(body))
+		req.Header.Set("Authorization", token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res, buf.String()
+	}
+
+	res, _ := do("/api/address/search", `{"query":"Москва"}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "4", res.Header.Get("X-RateLimit-Limit"))
+	assert.Equal(t, "3", res.Header.Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "5", res.Header.Get("X-RateLimit-Daily-Limit"))
+	assert.Equal(t, "4", res.Header.Get("X-RateLimit-Daily-Remaining"))
+	assert.Empty(t, res.Header.Get("X-RateLimit-Monthly-Limit"))
+
+	res, body := do("/api/address/search/batch", `{"queries":["aa","bb","cc","dd","ee"]}`)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode, "5 lookups with 4 left")
+	assert.Equal(t, `{"error":"Quota exceeded, try again once it starts over"}`+"\n", body)
+	assert.NotEmpty(t, res.Header.Get("Retry-After"))
+
+	res, _ = do("/api/address/search/batch", `{"queries":["aa","bb"]}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "2", res.Header.Get("X-RateLimit-Daily-Remaining"))
+
+	res, _ = do("/api/address/search", `{"query":"Москва"}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "1", res.Header.Get("X-RateLimit-Daily-Remaining"))
+
+	res, body = do("/api/address/search", `{"query":"Москва"}`)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode, "out of burst")
+	assert.Equal(t, `{"error":"Too many requests, slow down"}`+"\n", body)
+	assert.Equal(t, "0", res.Header.Get("X-RateLimit-Remaining"))
+	assert.NotEmpty(t, res.Header.Get("Retry-After"))
+
+	for i := 0; i < 2; i++ {
+		res, _ = do("/api/login", `{"login":"nobody","password":"wrong"}`)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode, "anonymous routes are limited per address")
+	assert.Equal(t, "1", res.Header.Get("X-RateLimit-Limit"))
+}
+
+func Test_quotaSpentOnLookups(t *testing.T) {
+	saved, savedProvider, savedCache := usageLimiter, geoProvider, geoCache
+	usageLimiter, _ = NewUsageLimiter(map[string]RateLimit{RoleUser: {Daily: 10}}, "")
+	geoCache, _ = NewCachedProvider(&fakeGeoProvider{}, GeoCacheConfig{Size: 10, TTL: time.Hour, Precision: defaultGeoCachePrecision})
+	geoProvider = geoCache
+	defer func() { usageLimiter, geoProvider, geoCache = saved, savedProvider, savedCache }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	token := "Bearer " + issueTestToken(t, User{Login: "QuotaUser", Roles: []string{RoleUser}})
+	do := func(method, url, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		req.Header.Set("Authorization", token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	for _, call := range []struct{ method, url, body string }{
+		{"GET", "/api/address/search", ""},
+		{"POST", "/api/address/search", `{"query":`},
+		{"POST", "/api/address/search", `{"query":"М"}`},
+		{"POST", "/api/address/geocode", `{"lat":91,"lng":0}`},
+		{"POST", "/api/address/search/batch", `{"queries":["М","Т"]}`},
+	} {
+		res := do(call.method, call.url, call.body)
+		assert.Empty(t, res.Header.Get("X-RateLimit-Daily-Remaining"), "%s %s %s", call.method, call.url, call.body)
+	}
+
+	res := do("POST", "/api/address/search", `{"query":"Москва"}`)
+	assert.Equal(t, "9", res.Header.Get("X-RateLimit-Daily-Remaining"))
+	res = do("POST", "/api/address/search", `{"query":" москва"}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, res.Header.Get("X-RateLimit-Daily-Remaining"), "answered by the cache")
+	res = do("POST", "/api/address/geocode", `{"lat":55.75,"lng":37.61}`)
+	assert.Equal(t, "8", res.Header.Get("X-RateLimit-Daily-Remaining"))
+	res = do("POST", "/api/address/geocode", `{"lat":55.750001,"lng":37.61}`)
+	assert.Empty(t, res.Header.Get("X-RateLimit-Daily-Remaining"), "answered by the cache")
+	res = do("POST", "/api/address/search/batch", `{"queries":["Москва","Тверь","Т"]}`)
+	assert.Equal(t, "7", res.Header.Get("X-RateLimit-Daily-Remaining"), "Тверь only")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+const scopeClaim = "scope"
+
+const (
+	ScopeAddressSearch  = "address:search"
+	ScopeAddressGeocode = "address:geocode"
+	ScopeMeRead         = "me:read"
+	ScopeMeWrite        = "me:write"
+	ScopeAdminTokens    = "admin:tokens"
+	ScopeAdminUsers     = "admin:users"
+	ScopeAdminMetrics   = "admin:metrics"
+)
+
+// roleScopes lists the scopes granted by each role.
+var roleScopes = map[string][]string{
+	RoleUser:  {ScopeAddressSearch, ScopeAddressGeocode, ScopeMeRead, ScopeMeWrite},
+	RoleAdmin: {ScopeAdminMetrics, ScopeAdminTokens, ScopeAdminUsers},
+}
+
+// knownRoles returns the roles of roleScopes, sorted.
+func knownRoles() []string {
+	roles := make([]string, 0, len(roleScopes))
+	for role := range roleScopes {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// knownScopes returns every scope some role grants, sorted.
+func knownScopes() []string {
+	var scopes []string
+	for _, granted := range roleScopes {
+		scopes = append(scopes, granted...)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// EffectiveScopes returns the scopes granted by the user's roles plus
+// the ones granted to the user directly, sorted and without duplicates.
+// Accounts stored before roles existed count as plain users.
+func (u User) EffectiveScopes() []string {
+	roles := u.Roles
+	if len(roles) == 0 {
+		roles = []string{RoleUser}
+	}
+
+	seen := map[string]bool{}
+	for _, role := range roles {
+		for _, scope := range roleScopes[role] {
+			seen[scope] = true
+		}
+	}
+	for _, scope := range u.Scopes {
+		seen[scope] = true
+	}
+
+	scopes := make([]string, 0, len(seen))
+	for scope := range seen {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// tokenScopes returns the space separated scope claim of token.
+func tokenScopes(token jwt.Token) []string {
+	raw, _ := token.PrivateClaims()[scopeClaim].(string)
+	return strings.Fields(raw)
+}
+
+// RequireScopes lets through only requests whose token carries every one of
+// scopes. It must run after Authenticator.
+func RequireScopes(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			token, _, _ := jwtauth.FromContext(r.Context())
+
+			granted := map[string]bool{}
+			for _, scope := range tokenScopes(token) {
+				granted[scope] = true
+			}
+			for _, scope := range scopes {
+				if !granted[scope] {
+					writeError(w, "insufficient scope: "+scope+" required", http.StatusForbidden)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
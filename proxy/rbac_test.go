@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_EffectiveScopes(t *testing.T) {
+	tests := []struct {
+		name string
+		user User
+		want []string
+	}{
+		{"user", User{Roles: []string{RoleUser}}, []string{ScopeAddressGeocode, ScopeAddressSearch, ScopeMeRead, ScopeMeWrite}},
+		{"admin", User{Roles: []string{RoleAdmin}}, []string{ScopeAdminMetrics, ScopeAdminTokens, ScopeAdminUsers}},
+		{"no roles", User{}, []string{ScopeAddressGeocode, ScopeAddressSearch, ScopeMeRead, ScopeMeWrite}},
+		{"extra scopes", User{Roles: []string{"batch"}, Scopes: []string{ScopeAddressSearch, ScopeAddressSearch}}, []string{ScopeAddressSearch}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.user.EffectiveScopes())
+		})
+	}
+}
+
+func Test_RequireScopes(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(Verifier(signingKeys))
+	r.Use(Authenticator())
+	r.With(RequireScopes(ScopeAddressSearch)).Get("/search", handleHello)
+	r.With(RequireScopes(ScopeAddressSearch, ScopeAddressGeocode)).Get("/both", handleHello)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	searchOnly := issueTestToken(t, User{Login: "ScopeBatch", Roles: []string{"batch"}, Scopes: []string{ScopeAddressSearch}})
+	user := issueTestToken(t, User{Login: "ScopeUser", Roles: []string{RoleUser}})
+	admin := issueTestToken(t, User{Login: "ScopeAdmin", Roles: []string{RoleAdmin}})
+
+	tests := []struct {
+		name       string
+		url        string
+		token      string
+		want       string
+		wantStatus int
+	}{
+		{"1", "/search", searchOnly, "Hello from API", http.StatusOK},
+		{"2", "/both", searchOnly, "{\"error\":\"insufficient scope: address:geocode required\"}\n", http.StatusForbidden},
+		{"3", "/both", user, "Hello from API", http.StatusOK},
+		{"4", "/search", admin, "{\"error\":\"insufficient scope: address:search required\"}\n", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", ts.URL+tt.url, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+			buf := new(bytes.Buffer)
+			defer res.Body.Close()
+			buf.ReadFrom(res.Body)
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenInvalid  = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused   = errors.New("refresh token reuse detected")
+)
+
+// RefreshToken is the server side record of an issued refresh token.
+// Only the hash of the opaque token is kept. Tokens rotated from one
+// login share a Family, so a reused token can revoke the whole chain.
+type RefreshToken struct {
+	Hash      string    `json:"hash"`
+	Login     string    `json:"login"`
+	Family    string    `json:"family"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Used      bool      `json:"used"`
+	Revoked   bool      `json:"revoked"`
+}
+
+// RefreshTokenStore keeps refresh token records.
+// Implementations must be safe for concurrent use.
+type RefreshTokenStore interface {
+	// Save stores a new record.
+	Save(ctx context.Context, token RefreshToken) error
+	// Get returns the record with the given hash or ErrRefreshTokenNotFound.
+	Get(ctx context.Context, hash string) (RefreshToken, error)
+	// Use marks the record as used and returns it as it was before the call,
+	// ErrRefreshTokenNotFound is returned for an unknown hash.
+	Use(ctx context.Context, hash string) (RefreshToken, error)
+	// RevokeFamily revokes every record of the family.
+	RevokeFamily(ctx context.Context, family string) error
+	// RevokeLogin revokes every record issued to login.
+	RevokeLogin(ctx context.Context, login string) error
+}
+
+// newRefreshTokenStore builds the store matching cfg.UserStore, so sessions
+// survive a restart whenever the accounts do.
+func newRefreshTokenStore(cfg *Config) (RefreshTokenStore, error) {
+	switch cfg.UserStore {
+	case "", "memory":
+		return NewMemoryRefreshTokenStore(), nil
+	case "file":
+		return NewFileRefreshTokenStore(cfg.RefreshTokenStorePath)
+	default:
+		return nil, fmt.Errorf("unknown user store %q", cfg.UserStore)
+	}
+}
+
+// MemoryRefreshTokenStore keeps refresh tokens in process memory.
+type MemoryRefreshTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]RefreshToken
+	now    func() time.Time
+	// save, when set, persists the changed set of tokens before it becomes visible.
+	save func(tokens map[string]RefreshToken) error
+}
+
+func NewMemoryRefreshTokenStore() *MemoryRefreshTokenStore {
+	return &MemoryRefreshTokenStore{tokens: make(map[string]RefreshToken), now: time.Now}
+}
+
+func (m *MemoryRefreshTokenStore) Save(_ context.Context, token RefreshToken) error {
+	return m.mutate(func(tokens map[string]RefreshToken) error {
+		now := m.now()
+		for hash, t := range tokens {
+			if now.After(t.ExpiresAt) {
+				delete(tokens, hash)
+			}
+		}
+		tokens[token.Hash] = token
+		return nil
+	})
+}
+
+func (m *MemoryRefreshTokenStore) Get(_ context.Context, hash string) (RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[hash]
+	if !ok {
+		return RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	return token, nil
+}
+
+func (m *MemoryRefreshTokenStore) Use(_ context.Context, hash string) (RefreshToken, error) {
+	var token RefreshToken
+	err := m.mutate(func(tokens map[string]RefreshToken) error {
+		var ok bool
+		if token, ok = tokens[hash]; !ok {
+			return ErrRefreshTokenNotFound
+		}
+		used := token
+		used.Used = true
+		tokens[hash] = used
+		return nil
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return token, nil
+}
+
+func (m *MemoryRefreshTokenStore) RevokeFamily(_ context.Context, family string) error {
+	return m.revoke(func(t RefreshToken) bool { return t.Family == family })
+}
+
+func (m *MemoryRefreshTokenStore) RevokeLogin(_ context.Context, login string) error {
+	return m.revoke(func(t RefreshToken) bool { return t.Login == login })
+}
+
+// revoke revokes every record match returns true for.
+func (m *MemoryRefreshTokenStore) revoke(match func(t RefreshToken) bool) error {
+	return m.mutate(func(tokens map[string]RefreshToken) error {
+		for hash, t := range tokens {
+			if match(t) && !t.Revoked {
+				t.Revoked = true
+				tokens[hash] = t
+			}
+		}
+		return nil
+	})
+}
+
+// mutate applies fn to a copy of the tokens and swaps it in once saved,
+// so a failed save leaves the store unchanged.
+func (m *MemoryRefreshTokenStore) mutate(fn func(tokens map[string]RefreshToken) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.save == nil {
+		return fn(m.tokens)
+	}
+
+	next := make(map[string]RefreshToken, len(m.tokens)+1)
+	for k, v := range m.tokens {
+		next[k] = v
+	}
+	if err := fn(next); err != nil {
+		return err
+	}
+	if err := m.save(next); err != nil {
+		return err
+	}
+	m.tokens = next
+	return nil
+}
+
+// FileRefreshTokenStore persists every change to a JSON file.
+type FileRefreshTokenStore struct {
+	*MemoryRefreshTokenStore
+	path string
+}
+
+// NewFileRefreshTokenStore loads tokens from path, a missing file is an empty store.
+func NewFileRefreshTokenStore(path string) (*FileRefreshTokenStore, error) {
+	f := &FileRefreshTokenStore{MemoryRefreshTokenStore: NewMemoryRefreshTokenStore(), path: path}
+
+	var tokens []RefreshToken
+	if err := readJSONFile(path, &tokens); err != nil {
+		return nil, fmt.Errorf("load refresh token store: %w", err)
+	}
+	for _, t := range tokens {
+		f.tokens[t.Hash] = t
+	}
+	f.save = f.flush
+
+	return f, nil
+}
+
+func (f *FileRefreshTokenStore) flush(tokens map[string]RefreshToken) error {
+	list := make([]RefreshToken, 0, len(tokens))
+	for _, t := range tokens {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].IssuedAt.Equal(list[j].IssuedAt) {
+			return list[i].IssuedAt.Before(list[j].IssuedAt)
+		}
+		return list[i].Hash < list[j].Hash
+	})
+	if err := writeJSONFile(f.path, list); err != nil {
+		return fmt.Errorf("save refresh token store: %w", err)
+	}
+	return nil
+}
+
+// RefreshTokens issues and rotates opaque refresh tokens.
+type RefreshTokens struct {
+	store RefreshTokenStore
+	ttl   time.Duration
+	now   func() time.Time
+}
+
+func NewRefreshTokens(store RefreshTokenStore, ttl time.Duration) *RefreshTokens {
+	return &RefreshTokens{store: store, ttl: ttl, now: time.Now}
+}
+
+// Issue returns a new refresh token for login. An empty family starts a new one.
+func (rt *RefreshTokens) Issue(ctx context.Context, login, family string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate refresh token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	if family == "" {
+		var err error
+		if family, err = newTokenID(); err != nil {
+			return "", err
+		}
+	}
+
+	now := rt.now()
+	err := rt.store.Save(ctx, RefreshToken{
+		Hash:      hashToken(token),
+		Login:     login,
+		Family:    family,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(rt.ttl),
+	})
+	if err != nil {
+		return "", fmt.Errorf("save refresh token: %w", err)
+	}
+	return token, nil
+}
+
+// Rotate consumes token and returns the record it was issued for.
+// Presenting an already used token revokes its whole family.
+func (rt *RefreshTokens) Rotate(ctx context.Context, token string) (RefreshToken, error) {
+	rec, err := rt.store.Use(ctx, hashToken(token))
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		return RefreshToken{}, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	if rec.Used {
+		if err := rt.store.RevokeFamily(ctx, rec.Family); err != nil {
+			return RefreshToken{}, err
+		}
+		return RefreshToken{}, ErrRefreshTokenReused
+	}
+	if rec.Revoked || rt.now().After(rec.ExpiresAt) {
+		return RefreshToken{}, ErrRefreshTokenInvalid
+	}
+	return rec, nil
+}
+
+// Revoke revokes the family of token if it was issued to login. A token
+// of someone else is left as it is.
+func (rt *RefreshTokens) Revoke(ctx context.Context, token, login string) error {
+	rec, err := rt.store.Get(ctx, hashToken(token))
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rec.Login != login {
+		return nil
+	}
+	return rt.store.RevokeFamily(ctx, rec.Family)
+}
+
+// RevokeLogin revokes every refresh token issued to login.
+func (rt *RefreshTokens) RevokeLogin(ctx context.Context, login string) error {
+	return rt.store.RevokeLogin(ctx, login)
+}
+
+// hashToken returns the hex SHA-256 of a random opaque token (refresh token
+// or API key). The tokens carry 256 bits of entropy, so no salt or slow hash is needed.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// swagger:model refreshRequest
+type refreshRequest struct {
+	// refresh token from a previous login, register or refresh response
+	//
+	// required: true
+	// example: 3q2-7wAAAAAhF1c0G8h4xq0sY8bLhY6m8Xj7mB9Zb0E
+	RefreshToken string `json:"refresh_token"`
+}
+
+func handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqInput refreshRequest
+	err := json.NewDecoder(r.Body).Decode(&reqInput)
+	defer r.Body.Close()
+	if err != nil || reqInput.RefreshToken == "" {
+		writeError(w, "bad request: refresh_token is required", http.StatusBadRequest)
+		return
+	}
+
+	rec, err := refreshTokens.Rotate(r.Context(), reqInput.RefreshToken)
+	if errors.Is(err, ErrRefreshTokenInvalid) || errors.Is(err, ErrRefreshTokenReused) {
+		writeError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("refresh.go: rotate refresh token: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := userRepo.GetByLogin(r.Context(), rec.Login)
+	if errors.Is(err, ErrUserNotFound) || err == nil && rec.IssuedAt.Before(user.TokensValidAfter) {
+		writeError(w, ErrRefreshTokenInvalid.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("refresh.go: get user: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if user.Disabled {
+		writeError(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+
+	token, err := issueTokens(r.Context(), user, rec.Family)
+	if err != nil {
+		log.Printf("refresh.go: error generate token: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, token)
+}
+
+// issueTokens mints an access token and a refresh token of the given family for user.
+func issueTokens(ctx context.Context, user User, family string) (*tokenResponse, error) {
+	accessToken, err := tokenIssuer.Issue(user)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := refreshTokens.Issue(ctx, user.Login, family)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenResponse{
+		AccessToken:  "Bearer " + accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(tokenIssuer.ttl / time.Second),
+	}, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_handleRefresh(t *testing.T) {
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/api/register", "application/json", strings.NewReader(`{"login":"RefreshUser", "password": "s3cret-hugo"}`))
+	assert.NoError(t, err)
+	var first tokenResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&first))
+	res.Body.Close()
+	assert.NotEmpty(t, first.RefreshToken)
+	assert.Equal(t, int64(tokenIssuer.ttl/time.Second), first.ExpiresIn)
+
+	refresh := func(token string) (int, string, tokenResponse) {
+		body, _ := json.Marshal(refreshRequest{RefreshToken: token})
+		res, err := http.Post(ts.URL+"/api/refresh", "application/json", bytes.NewReader(body))
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		var tr tokenResponse
+		json.Unmarshal(buf.Bytes(), &tr)
+		return res.StatusCode, buf.String(), tr
+	}
+
+	status, _, second := refresh(first.RefreshToken)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	assertTokenClaims(t, mustMarshal(t, second), "RefreshUser")
+
+	tests := []struct {
+		name       string
+		token      string
+		want       string
+		wantStatus int
+	}{
+		{"unknown", "abc", "{\"error\":\"refresh token is invalid or expired\"}\n", http.StatusUnauthorized},
+		{"reuse", first.RefreshToken, "{\"error\":\"refresh token reuse detected\"}\n", http.StatusUnauthorized},
+		{"family revoked", second.RefreshToken, "{\"error\":\"refresh token is invalid or expired\"}\n", http.StatusUnauthorized},
+		{"empty", "", "{\"error\":\"bad request: refresh_token is required\"}\n", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body, _ := refresh(tt.token)
+			assert.Equal(t, tt.wantStatus, status)
+			assert.Equal(t, tt.want, body)
+		})
+	}
+}
+
+func TestRefreshTokens_Revoke(t *testing.T) {
+	ctx := context.Background()
+	rt := NewRefreshTokens(NewMemoryRefreshTokenStore(), time.Hour)
+	token, err := rt.Issue(ctx, "a", "")
+	assert.NoError(t, err)
+
+	assert.NoError(t, rt.Revoke(ctx, token, "b"))
+	rec, err := rt.Rotate(ctx, token)
+	assert.NoError(t, err, "someone else's logout leaves the token alone")
+
+	next, _ := rt.Issue(ctx, "a", rec.Family)
+	assert.NoError(t, rt.Revoke(ctx, next, "a"))
+	_, err = rt.Rotate(ctx, next)
+	assert.ErrorIs(t, err, ErrRefreshTokenInvalid)
+}
+
+func TestFileRefreshTokenStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "refresh_tokens.json")
+	store, err := NewFileRefreshTokenStore(path)
+	assert.NoError(t, err)
+	rt := NewRefreshTokens(store, time.Hour)
+	used, _ := rt.Issue(ctx, "a", "")
+	_, err = rt.Rotate(ctx, used)
+	assert.NoError(t, err)
+	other, _ := rt.Issue(ctx, "b", "")
+
+	store, err = NewFileRefreshTokenStore(path)
+	assert.NoError(t, err)
+	rt = NewRefreshTokens(store, time.Hour)
+	_, err = rt.Rotate(ctx, used)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused, "use survives a restart")
+
+	assert.NoError(t, store.RevokeLogin(ctx, "b"))
+	store, _ = NewFileRefreshTokenStore(path)
+	rec, err := store.Get(ctx, hashToken(other))
+	assert.NoError(t, err)
+	assert.True(t, rec.Revoked)
+}
+
+func Test_AuthenticatorExpired(t *testing.T) {
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	issuer := NewTokenIssuer(signingKeys, time.Minute)
+	issuer.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	expired, err := issuer.Issue(User{Login: "User1", Roles: []string{RoleUser}})
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("POST", ts.URL+"/api/address/search", strings.NewReader(`{"query":"Москва"}`))
+	req.Header.Set("Authorization", "Bearer "+expired)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(res.Body)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Equal(t, "{\"error\":\"Token expired\"}\n", buf.String())
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	assert.NoError(t, err)
+	return b
+}
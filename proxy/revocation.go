@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// Denylist keeps the ids (jti) of revoked access tokens until they expire.
+// Implementations must be safe for concurrent use, a shared implementation
+// lets several proxy instances honour each other's revocations.
+type Denylist interface {
+	// Add revokes jti until expiresAt.
+	Add(ctx context.Context, jti string, expiresAt time.Time) error
+	// Contains reports whether jti is revoked.
+	Contains(ctx context.Context, jti string) (bool, error)
+}
+
+// MemoryDenylist keeps revoked token ids in process memory.
+type MemoryDenylist struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+	now     func() time.Time
+}
+
+func NewMemoryDenylist() *MemoryDenylist {
+	return &MemoryDenylist{entries: make(map[string]time.Time), now: time.Now}
+}
+
+func (m *MemoryDenylist) Add(_ context.Context, jti string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	for id, exp := range m.entries {
+		if now.After(exp) {
+			delete(m.entries, id)
+		}
+	}
+	if exp, ok := m.entries[jti]; !ok || expiresAt.After(exp) {
+		m.entries[jti] = expiresAt
+	}
+	return nil
+}
+
+func (m *MemoryDenylist) Contains(_ context.Context, jti string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	exp, ok := m.entries[jti]
+	if !ok {
+		return false, nil
+	}
+	if m.now().After(exp) {
+		delete(m.entries, jti)
+		return false, nil
+	}
+	return true, nil
+}
+
+// swagger:model logoutRequest
+type logoutRequest struct {
+	// refresh token to revoke together with the access token
+	//
+	// example: 3q2-7wAAAAAhF1c0G8h4xq0sY8bLhY6m8Xj7mB9Zb0E
+	RefreshToken string `json:"refresh_token"`
+}
+
+// swagger:model revokeRequest
+type revokeRequest struct {
+	// id (jti claim) of the access token to revoke
+	//
+	// required: true
+	// example: 9f86d081884c7d659a2feaa0c55ad015
+	JTI string `json:"jti"`
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqInput logoutRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&reqInput)
+		defer r.Body.Close()
+		if err != nil {
+			writeError(w, "bad request: invalid logout body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, _, _ := jwtauth.FromContext(r.Context())
+	if isAPIKeyToken(token) {
+		writeError(w, "bad request: API keys are revoked through /api/me/keys", http.StatusBadRequest)
+		return
+	}
+	if err := tokenDenylist.Add(r.Context(), token.JwtID(), token.Expiration()); err != nil {
+		log.Printf("revocation.go: revoke token: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if reqInput.RefreshToken != "" {
+		if err := refreshTokens.Revoke(r.Context(), reqInput.RefreshToken, token.Subject()); err != nil {
+			log.Printf("revocation.go: revoke refresh token: %v", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqInput revokeRequest
+	err := json.NewDecoder(r.Body).Decode(&reqInput)
+	defer r.Body.Close()
+	if err != nil || reqInput.JTI == "" {
+		writeError(w, "bad request: jti is required", http.StatusBadRequest)
+		return
+	}
+
+	// The token itself is unknown here, so keep it denied for the longest
+	// lifetime an access token can have.
+	expiresAt := time.Now().Add(tokenIssuer.ttl)
+	if err := tokenDenylist.Add(r.Context(), reqInput.JTI, expiresAt); err != nil {
+		log.Printf("revocation.go: revoke token: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_handleLogoutRevoke(t *testing.T) {
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	issue := func(roles ...string) string {
+		return issueTestToken(t, User{Login: "Revoke" + strings.Join(roles, ""), Roles: roles})
+	}
+	jti := func(token string) string {
+		parsed, err := signingKeys.Parse(token)
+		assert.NoError(t, err)
+		return parsed.JwtID()
+	}
+
+	userToken := issue(RoleUser)
+	revokedToken := issue(RoleUser)
+	adminToken := issue(RoleUser, RoleAdmin)
+
+	type args struct {
+		Method string
+		Url    string
+		Body   string
+		token  string
+	}
+
+	tests := []struct {
+		name       string
+		args       args
+		want       string
+		wantStatus int
+	}{
+		{"1", args{Method: "GET", Url: "/api/logout", token: userToken}, "{\"error\":\"Method not allowed\"}\n", http.StatusMethodNotAllowed},
+		{"2", args{Method: "POST", Url: "/api/logout", token: userToken}, "", http.StatusNoContent},
+		{"3", args{Method: "POST", Url: "/api/logout", token: userToken}, "{\"error\":\"Token revoked\"}\n", http.StatusUnauthorized},
+		{"4", args{Method: "POST", Url: "/api/admin/revoke", Body: `{"jti":"` + jti(revokedToken) + `"}`, token: revokedToken}, "{\"error\":\"insufficient scope: admin:tokens required\"}\n", http.StatusForbidden},
+		{"5", args{Method: "POST", Url: "/api/admin/revoke", Body: `{}`, token: adminToken}, "{\"error\":\"bad request: jti is required\"}\n", http.StatusBadRequest},
+		{"6", args{Method: "POST", Url: "/api/admin/revoke", Body: `{"jti":"` + jti(revokedToken) + `"}`, token: adminToken}, "", http.StatusNoContent},
+		{"7", args{Method: "POST", Url: "/api/logout", token: revokedToken}, "{\"error\":\"Token revoked\"}\n", http.StatusUnauthorized},
+		{"8", args{Method: "POST", Url: "/api/admin/revoke", Body: `{"jti":"x"}`, token: "123"}, "{\"error\":\"403 Forbidden\"}\n", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.args.Method, ts.URL+tt.args.Url, strings.NewReader(tt.args.Body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+tt.args.token)
+			res, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+			buf := new(bytes.Buffer)
+			defer res.Body.Close()
+			buf.ReadFrom(res.Body)
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+}
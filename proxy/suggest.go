@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultSuggestLimit = 5
+	maxSuggestLimit     = 20
+	// Suggestions change rarely, the browser may reuse them while the user
+	// types back and forth.
+	suggestCacheControl = "private, max-age=60"
+)
+
+// errSuggestUnsupported is returned for providers that are no Suggester.
+var errSuggestUnsupported = errors.New("provider has no suggestions")
+
+// SuggestOptions narrow down and order suggestions.
+type SuggestOptions struct {
+	// Limit is the most suggestions to return.
+	Limit int
+	// Near, when set, moves suggestions close to Lat, Lng up.
+	Near     bool
+	Lat, Lng float64
+	// Regions, when not empty, keeps only suggestions in one of them, by name
+	// as in "Москва" or "Московская обл".
+	Regions []string
+}
+
+// finish applies the options to suggestions a provider could not narrow down
+// or order itself: it drops those outside Regions, sorts by distance when Near
+// is set and cuts the rest down to Limit.
+func (o SuggestOptions) finish(addrs []*Address, filtered, biased bool) []*Address {
+	if !filtered && len(o.Regions) > 0 {
+		kept := addrs[:0]
+		for _, a := range addrs {
+			if inRegions(a, o.Regions) {
+				kept = append(kept, a)
+			}
+		}
+		addrs = kept
+	}
+	if !biased && o.Near {
+		sortByDistance(addrs, o.Lat, o.Lng)
+	}
+	if o.Limit > 0 && len(addrs) > o.Limit {
+		addrs = addrs[:o.Limit]
+	}
+	return addrs
+}
+
+// inRegions reports whether a lies in one of regions, judged by its region
+// and city or, for providers that give no details, by its label.
+func inRegions(a *Address, regions []string) bool {
+	var terms []string
+	if a.Details != nil {
+		terms = searchTerms(a.Details.Region + " " + a.Details.City)
+	} else {
+		terms = searchTerms(a.Address)
+	}
+	have := map[string]bool{}
+	for _, t := range terms {
+		have[t] = true
+	}
+	for _, region := range regions {
+		all := true
+		for _, t := range searchTerms(region) {
+			if !have[t] {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+// sortByDistance orders addrs nearest to the point first, keeping the order
+// of equally distant ones.
+func sortByDistance(addrs []*Address, lat, lng float64) {
+	target := toPoint3(lat, lng)
+	dist := make(map[*Address]float64, len(addrs))
+	for _, a := range addrs {
+		dist[a] = toPoint3(a.Lat, a.Lon).dist2(target)
+	}
+	sort.SliceStable(addrs, func(i, j int) bool { return dist[addrs[i]] < dist[addrs[j]] })
+}
+
+// swagger:model suggestResponse
+type SuggestResponse struct {
+	// suggestions, best first
+	Addresses []*Address `json:"addresses"`
+}
+
+// parseSuggestRequest reads the query string of GET /api/address/suggest.
+func parseSuggestRequest(r *http.Request) (string, SuggestOptions, []FieldError) {
+	q := r.URL.Query()
+	opts := SuggestOptions{Limit: defaultSuggestLimit}
+	var errs []FieldError
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSuggestLimit {
+			errs = append(errs, FieldError{Field: "limit", Message: fmt.Sprintf("must be a whole number between 1 and %d", maxSuggestLimit)})
+		}
+		opts.Limit = n
+	}
+
+	if q.Has("lat") || q.Has("lon") {
+		lat, lng := parseCoordinate(q.Get("lat")), parseCoordinate(q.Get("lon"))
+		fields := append(checkCoordinate("lat", lat, 90), checkCoordinate("lon", lng, 180)...)
+		errs = append(errs, fields...)
+		opts.Near, opts.Lat, opts.Lng = len(fields) == 0, lat.Value, lng.Value
+	}
+
+	for _, v := range q["region"] {
+		for _, region := range strings.Split(v, ",") {
+			if region = strings.TrimSpace(region); region != "" {
+				opts.Regions = append(opts.Regions, region)
+			}
+		}
+	}
+	return strings.TrimSpace(q.Get("q")), opts, errs
+}
+
+// handleGeoSuggest completes a partly typed address. It is meant to be called
+// as the user types: a query too short to suggest anything gets an empty list
+// rather than an error, and answers may be reused by the client for a minute.
+func handleGeoSuggest(w http.ResponseWriter, r *http.Request) {
+	query, opts, fields := parseSuggestRequest(r)
+	if len(fields) > 0 {
+		writeValidationError(w, fields, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if utf8.RuneCountInString(query) < queryMinLength {
+		w.Header().Set("Cache-Control", suggestCacheControl)
+		writeJSON(w, http.StatusOK, SuggestResponse{Addresses: []*Address{}})
+		return
+	}
+
+	if err := spendQuota(r.Context(), 1); err != nil {
+		writeQuotaExceeded(w)
+		return
+	}
+	ctx, answeredBy := withAnsweredBy(r.Context())
+	addresses, err := suggest(ctx, geoProvider, query, opts)
+	if provider := answeredBy(); provider != "" {
+		w.Header().Set(geoProviderHeader, provider)
+	}
+	switch {
+	case errors.Is(err, ErrNoGeoProvider) || errors.Is(err, errSuggestUnsupported):
+		writeError(w, "Geo providers unavailable", http.StatusServiceUnavailable)
+		return
+	case err != nil && r.Context().Err() != nil:
+		// The client typed on and dropped this request.
+		return
+	case err != nil:
+		log.Printf("suggest.go: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if addresses == nil {
+		addresses = []*Address{}
+	}
+	w.Header().Set("Cache-Control", suggestCacheControl)
+	writeJSON(w, http.StatusOK, SuggestResponse{Addresses: viewAddresses(addresses, addressView(r))})
+}
+
+// suggest asks p for suggestions when it is a Suggester.
+func suggest(ctx context.Context, p GeoProvider, query string, opts SuggestOptions) ([]*Address, error) {
+	s, ok := p.(Suggester)
+	if !ok {
+		return nil, errSuggestUnsupported
+	}
+	return s.Suggest(ctx, query, opts)
+}
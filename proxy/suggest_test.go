@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// suggestingGeoProvider is a fakeGeoProvider with suggestions, it records the
+// last options.
+type suggestingGeoProvider struct {
+	fakeGeoProvider
+	opts SuggestOptions
+}
+
+func (s *suggestingGeoProvider) Suggest(_ context.Context, query string, opts SuggestOptions) ([]*Address, error) {
+	s.query, s.opts = query, opts
+	return s.addresses, s.err
+}
+
+func Test_handleGeoSuggest(t *testing.T) {
+	fake := &suggestingGeoProvider{fakeGeoProvider: fakeGeoProvider{addresses: []*Address{{Address: "г Москва, ул Сухонская", Lat: 55.87, Lon: 37.65}}}}
+	saved, savedLimiter := geoProvider, usageLimiter
+	geoProvider = fake
+	usageLimiter, _ = NewUsageLimiter(map[string]RateLimit{RoleUser: {Daily: 10}}, "")
+	defer func() { geoProvider, usageLimiter = saved, savedLimiter }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	token := "Bearer " + issueTestToken(t, User{Login: "SuggestUser", Roles: []string{RoleUser}})
+	do := func(query string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", ts.URL+"/api/address/suggest?"+query, nil)
+		req.Header.Set("Authorization", token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res, buf.String()
+	}
+
+	res, body := do("q=" + url.QueryEscape(" сухон ") + "&limit=3&lat=55.8&lon=37.6&region=Москва,%20Московская%20обл&region=Тверская")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "private, max-age=60", res.Header.Get("Cache-Control"))
+	assert.Equal(t, "9", res.Header.Get("X-RateLimit-Daily-Remaining"))
+	assert.Equal(t, `{"addresses":[{"address":"г Москва, ул Сухонская","lat":55.87,"lon":37.65}]}`, body)
+	assert.Equal(t, "сухон", fake.query)
+	assert.Equal(t, SuggestOptions{Limit: 3, Near: true, Lat: 55.8, Lng: 37.6, Regions: []string{"Москва", "Московская обл", "Тверская"}}, fake.opts)
+
+	do("q=" + url.QueryEscape("сухон"))
+	assert.Equal(t, SuggestOptions{Limit: defaultSuggestLimit}, fake.opts)
+
+	fake.query = ""
+	res, body = do("q=" + url.QueryEscape("с"))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `{"addresses":[]}`, body)
+	assert.Equal(t, "", fake.query, "too short to ask the provider")
+	assert.Empty(t, res.Header.Get("X-RateLimit-Daily-Remaining"), "nor to count against the quota")
+
+	res, body = do("q=ab&limit=50&lat=91")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, `{"error":"validation failed","fields":[`+
+		`{"field":"limit","message":"must be a whole number between 1 and 20"},`+
+		`{"field":"lat","message":"must be between -90 and 90"},`+
+		`{"field":"lon","message":"is required"}]}`, body)
+
+	geoProvider = &fakeGeoProvider{}
+	res, _ = do("q=ab")
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Cache-Control"))
+}
+
+func TestSuggestOptions_finish(t *testing.T) {
+	addrs := func() []*Address {
+		return []*Address{
+			{Address: "Санкт-Петербург", Lat: 59.93, Lon: 30.36, Details: &AddressDetails{Region: "г Санкт-Петербург"}},
+			{Address: "Королёв", Lat: 55.91, Lon: 37.85, Details: &AddressDetails{Region: "Московская обл", City: "г Королёв"}},
+			{Address: "г Москва, Красная пл", Lat: 55.75, Lon: 37.62},
+		}
+	}
+	labels := func(res []*Address) []string {
+		got := []string{}
+		for _, a := range res {
+			got = append(got, a.Address)
+		}
+		return got
+	}
+
+	opts := SuggestOptions{Limit: 2, Near: true, Lat: 55.75, Lng: 37.6}
+	assert.Equal(t, []string{"г Москва, Красная пл", "Королёв"}, labels(opts.finish(addrs(), false, false)))
+	assert.Equal(t, []string{"Санкт-Петербург", "Королёв"}, labels(opts.finish(addrs(), false, true)))
+
+	opts = SuggestOptions{Limit: 5, Regions: []string{"москва"}}
+	assert.Equal(t, []string{"г Москва, Красная пл"}, labels(opts.finish(addrs(), false, false)))
+	opts.Regions = []string{"Московская", "санкт-петербург"}
+	assert.Equal(t, []string{"Санкт-Петербург", "Королёв"}, labels(opts.finish(addrs(), false, false)))
+	assert.Len(t, opts.finish(addrs(), true, false), 3)
+}
+
+func Test_LocalProviderSuggest(t *testing.T) {
+	p := NewLocalProvider(localAddresses, defaultLocalReverseRadius)
+	ctx := context.Background()
+	labels := func(res []*Address, err error) []string {
+		assert.NoError(t, err)
+		got := []string{}
+		for _, a := range res {
+			got = append(got, a.Address)
+		}
+		return got
+	}
+
+	assert.Equal(t, []string{"г Москва, ул Сухонская, д 11"}, labels(p.Suggest(ctx, "сух", SuggestOptions{Limit: 1})))
+	assert.Equal(t, []string{"г Москва, ул Сухонская, д 13", "г Москва, ул Сухонская, д 11"},
+		labels(p.Suggest(ctx, "сух", SuggestOptions{Limit: 5, Near: true, Lat: 55.8787, Lng: 37.6523})))
+	assert.Equal(t, []string{"г Санкт-Петербург, Ленинский пр-кт, д 118 к 1"},
+		labels(p.Suggest(ctx, "лени", SuggestOptions{Limit: 5, Regions: []string{"Санкт-Петербург"}})))
+}
+
+func TestDaDataProvider_Suggest(t *testing.T) {
+	var got map[string]interface{}
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		json.Unmarshal(b, &got)
+		auth = r.Header.Get("Authorization") + "/" + r.Header.Get("X-Secret")
+		w.Write([]byte(`{"suggestions":[` +
+			`{"value":"г Москва, ул Сухонская","data":{"region_with_type":"г Москва","geo_lat":"55.87","geo_lon":"37.65"}},` +
+			`{"value":"г Москва, Красная пл","data":{"region_with_type":"г Москва","geo_lat":"55.75","geo_lon":"37.62"}}]}`))
+	}))
+	defer ts.Close()
+
+	p := NewDaDataProvider(DaDataConfig{SuggestURL: ts.URL, Credentials: []DaDataCredential{{Token: "t", Secret: "s"}}})
+	res, err := p.Suggest(context.Background(), "моск", SuggestOptions{Limit: 2, Regions: []string{"Москва"}})
+	assert.NoError(t, err)
+	assert.Len(t, res, 2)
+	assert.Equal(t, "г Москва, ул Сухонская", res[0].Address)
+	assert.Equal(t, "г Москва", res[0].Details.Region)
+	assert.Equal(t, "Token t/", auth, "the suggestions API takes no secret")
+	assert.Equal(t, map[string]interface{}{"query": "моск", "count": 2.0, "locations": []interface{}{map[string]interface{}{"region": "Москва"}}}, got)
+
+	res, err = p.Suggest(context.Background(), "моск", SuggestOptions{Limit: 1, Near: true, Lat: 55.75, Lng: 37.62})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(maxSuggestLimit), got["count"])
+	assert.Len(t, res, 1)
+	assert.Equal(t, "г Москва, Красная пл", res[0].Address)
+}
+
+func Test_PhotonProviderSuggest(t *testing.T) {
+	var query url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte(`{"features":[{"geometry":{"coordinates":[37.65,55.87]},"properties":{"name":"Сухонская","state":"Москва"}}]}`))
+	}))
+	defer ts.Close()
+
+	p := NewPhotonProvider(ts.URL, nil)
+	res, err := p.Suggest(context.Background(), "сухон", SuggestOptions{Limit: 3, Near: true, Lat: 55.8, Lng: 37.6})
+	assert.NoError(t, err)
+	assert.Len(t, res, 1)
+	assert.Equal(t, url.Values{"q": {"сухон"}, "limit": {"3"}, "lat": {"55.8"}, "lon": {"37.6"}}, query)
+
+	res, err = p.Suggest(context.Background(), "сухон", SuggestOptions{Limit: 3, Regions: []string{"Тверская"}})
+	assert.NoError(t, err)
+	assert.Empty(t, res)
+	assert.Equal(t, "20", query.Get("limit"))
+}
+
+func TestProviderChain_Suggest(t *testing.T) {
+	chain := NewProviderChain(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+	chain.Add("plain", &fakeGeoProvider{})
+	chain.Add("suggesting", &suggestingGeoProvider{fakeGeoProvider: fakeGeoProvider{addresses: []*Address{{Address: "Москва"}}}})
+
+	res, err := chain.Suggest(context.Background(), "моск", SuggestOptions{Limit: 5})
+	assert.NoError(t, err)
+	assert.Len(t, res, 1)
+	health := chain.Health()
+	assert.Equal(t, breakerClosed, health[0].State)
+	assert.Equal(t, int64(0), health[0].Requests, "skipped, not failed")
+	assert.Equal(t, int64(1), health[1].Successes)
+
+	chain = NewProviderChain(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+	chain.Add("plain", &fakeGeoProvider{})
+	_, err = chain.Suggest(context.Background(), "моск", SuggestOptions{Limit: 5})
+	assert.ErrorIs(t, err, ErrNoGeoProvider)
+}
+
+func TestCachedProvider_Suggest(t *testing.T) {
+	fake := &suggestingGeoProvider{fakeGeoProvider: fakeGeoProvider{addresses: []*Address{{Address: "Москва"}}}}
+	c, err := NewCachedProvider(fake, GeoCacheConfig{Size: 10, TTL: time.Minute, Precision: 2})
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	opts := SuggestOptions{Limit: 5, Near: true, Lat: 55.7512, Lng: 37.6184}
+	c.Suggest(ctx, "Моск", opts)
+	assert.Equal(t, 55.75, fake.opts.Lat, "rounded before going upstream")
+	c.Suggest(ctx, " моск", SuggestOptions{Limit: 5, Near: true, Lat: 55.749, Lng: 37.621})
+	c.Suggest(ctx, "моск", SuggestOptions{Limit: 4, Near: true, Lat: 55.75, Lng: 37.62})
+	stats := c.Stats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(2), stats.Misses)
+
+	c, _ = NewCachedProvider(&fakeGeoProvider{}, GeoCacheConfig{Size: 10, TTL: time.Minute})
+	_, err = c.Suggest(ctx, "моск", opts)
+	assert.ErrorIs(t, err, errSuggestUnsupported)
+}
@@ -0,0 +1,90 @@
+package main
+
+// trigram is three letters of a word, zero runes pad the start of the word.
+type trigram [3]rune
+
+type trigramPosting struct {
+	term int32
+	// pos is where the trigram first ends in the term.
+	pos int32
+}
+
+// trigramIndex finds the words a few typos away from a query without
+// comparing it to every word. A word of n letters has n trigrams and one edit
+// changes at most three of them, so a word within k edits of the query still
+// holds n-3k of the query's trigrams. Only the words that do are compared.
+type trigramIndex struct {
+	words    [][]rune
+	postings map[trigram][]trigramPosting
+}
+
+func newTrigramIndex(words []string) *trigramIndex {
+	x := &trigramIndex{words: make([][]rune, len(words)), postings: map[trigram][]trigramPosting{}}
+	for id, w := range words {
+		wr := []rune(w)
+		x.words[id] = wr
+		seen := map[trigram]bool{}
+		for i := range wr {
+			t := trigramAt(wr, i)
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+			x.postings[t] = append(x.postings[t], trigramPosting{term: int32(id), pos: int32(i)})
+		}
+	}
+	return x
+}
+
+// trigramAt returns the trigram of w ending at i.
+func trigramAt(w []rune, i int) trigram {
+	var t trigram
+	for j := 0; j < 3; j++ {
+		if k := i - 2 + j; k >= 0 {
+			t[j] = w[k]
+		}
+	}
+	return t
+}
+
+// near calls fn with the id of every word at most max edits from q, and of
+// every word longer than len(q)+max whose first len(q) letters are.
+func (x *trigramIndex) near(q []rune, max int, fn func(id int)) {
+	type count struct{ whole, prefix int }
+	counts := map[int32]*count{}
+	need := len(q) - 3*max
+	if need < 1 {
+		// Too short a word for the trigrams to tell anything.
+		need = 0
+		for id := range x.words {
+			counts[int32(id)] = &count{}
+		}
+	}
+	for i := range q {
+		for _, p := range x.postings[trigramAt(q, i)] {
+			c := counts[p.term]
+			if c == nil {
+				c = &count{}
+				counts[p.term] = c
+			}
+			c.whole++
+			if int(p.pos) < len(q) {
+				c.prefix++
+			}
+		}
+	}
+
+	for id, c := range counts {
+		w := x.words[id]
+		switch {
+		case len(w) > len(q)+max:
+			if c.prefix >= need && editDistance(q, w[:len(q)], max) <= max {
+				fn(int(id))
+			}
+		case len(w) >= len(q)-max:
+			if c.whole >= need && editDistance(q, w, max) <= max {
+				fn(int(id))
+			}
+		}
+	}
+}
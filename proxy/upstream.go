@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// UpstreamConfig holds the settings of the HTTP client shared by the geo
+// providers. Zero fields get the defaults.
+type UpstreamConfig struct {
+	// ConnectTimeout bounds dialing and the TLS handshake, ReadTimeout the wait
+	// for the response headers of each attempt.
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	// Timeout bounds a whole call, retries and reading the body included.
+	Timeout time.Duration
+	// MaxAttempts is how many times an idempotent request is sent at most, 1
+	// turns retries off. RetryBackoff is the first pause between attempts, it
+	// doubles with every retry and is jittered.
+	MaxAttempts  int
+	RetryBackoff time.Duration
+	// MaxRetryWait caps the pause before a retry, an upstream asking to wait
+	// longer with Retry-After gets its answer passed on instead.
+	MaxRetryWait time.Duration
+	// Connection pool of each upstream host.
+	MaxConnsPerHost     int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+}
+
+var defaultUpstreamConfig = UpstreamConfig{
+	ConnectTimeout:      3 * time.Second,
+	ReadTimeout:         10 * time.Second,
+	Timeout:             20 * time.Second,
+	MaxAttempts:         3,
+	RetryBackoff:        200 * time.Millisecond,
+	MaxRetryWait:        5 * time.Second,
+	MaxConnsPerHost:     64,
+	MaxIdleConnsPerHost: 16,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// defaultUpstreamClient is used by providers built without a client.
+var defaultUpstreamClient = NewUpstreamClient(UpstreamConfig{})
+
+func (c UpstreamConfig) withDefaults() UpstreamConfig {
+	d := defaultUpstreamConfig
+	if c.ConnectTimeout <= 0 {
+		c.ConnectTimeout = d.ConnectTimeout
+	}
+	if c.ReadTimeout <= 0 {
+		c.ReadTimeout = d.ReadTimeout
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = d.Timeout
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = d.MaxAttempts
+	}
+	if c.RetryBackoff <= 0 {
+		c.RetryBackoff = d.RetryBackoff
+	}
+	if c.MaxRetryWait <= 0 {
+		c.MaxRetryWait = d.MaxRetryWait
+	}
+	if c.MaxConnsPerHost <= 0 {
+		c.MaxConnsPerHost = d.MaxConnsPerHost
+	}
+	if c.MaxIdleConnsPerHost <= 0 {
+		c.MaxIdleConnsPerHost = d.MaxIdleConnsPerHost
+	}
+	if c.IdleConnTimeout <= 0 {
+		c.IdleConnTimeout = d.IdleConnTimeout
+	}
+	return c
+}
+
+// NewUpstreamClient returns a client with pooled connections that retries
+// idempotent requests failing on the network, with 429 or with a 5xx status.
+// Requests are tied to their context, so a client of the proxy hanging up
+// aborts the call upstream as well.
+func NewUpstreamClient(cfg UpstreamConfig) *http.Client {
+	cfg = cfg.withDefaults()
+	dialer := &net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.ReadTimeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          cfg.MaxIdleConnsPerHost * 4,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+	}
+	return &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &retryTransport{
+			next:     transport,
+			attempts: cfg.MaxAttempts,
+			backoff:  cfg.RetryBackoff,
+			maxWait:  cfg.MaxRetryWait,
+		},
+	}
+}
+
+// retryTransport sends a request again after a failure worth retrying.
+type retryTransport struct {
+	next     http.RoundTripper
+	attempts int
+	backoff  time.Duration
+	maxWait  time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	canRetry := idempotent(req) && (req.Body == nil || req.GetBody != nil)
+	for attempt := 1; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if !canRetry || attempt >= t.attempts || req.Context().Err() != nil || !retryable(resp, err) || handedBack(req, resp) {
+			return resp, err
+		}
+
+		wait := jitter(t.backoff << (attempt - 1))
+		if resp != nil {
+			if after, ok := retryAfter(resp); ok && after > wait {
+				wait = after
+			}
+			if wait > t.maxWait {
+				return resp, nil
+			}
+			// Drained, the connection goes back to the pool.
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		} else if wait > t.maxWait {
+			wait = t.maxWait
+		}
+
+		if err := sleepContext(req.Context(), wait); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+type retryKey struct{}
+
+// withRetries marks the requests made with ctx as safe to send again, for a
+// POST that only looks something up. Answers with one of the handBack
+// statuses are returned at once rather than retried, e.g. for the caller to
+// try another account.
+func withRetries(ctx context.Context, handBack ...int) context.Context {
+	return context.WithValue(ctx, retryKey{}, handBack)
+}
+
+// handedBack reports whether resp has a status the context of req asks to
+// get back without a retry.
+func handedBack(req *http.Request, resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+	handBack, _ := req.Context().Value(retryKey{}).([]int)
+	for _, status := range handBack {
+		if resp.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// idempotent reports whether req may be sent twice: its method is, the
+// context allows it with withRetries, or like in net/http it is a POST
+// carrying an Idempotency-Key header.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	if _, ok := req.Context().Value(retryKey{}).([]int); ok {
+		return true
+	}
+	if _, ok := req.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	_, ok := req.Header["X-Idempotency-Key"]
+	return ok
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter reads the Retry-After header, in seconds or as a date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return time.Until(at), true
+	}
+	return 0, false
+}
+
+// jitter returns a random pause between d/2 and d, so that callers failing
+// together do not come back together.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUpstreamClient_retries(t *testing.T) {
+	var calls int32
+	var bodies []string
+	failures := int32(2)
+	status := http.StatusServiceUnavailable
+	retryAfterHeader := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if atomic.AddInt32(&calls, 1) <= failures {
+			if retryAfterHeader != "" {
+				w.Header().Set("Retry-After", retryAfterHeader)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	client := NewUpstreamClient(UpstreamConfig{MaxAttempts: 3, RetryBackoff: time.Millisecond})
+	reset := func() {
+		atomic.StoreInt32(&calls, 0)
+		bodies = nil
+	}
+
+	resp, err := client.Get(ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(3), calls)
+	resp.Body.Close()
+
+	reset()
+	resp, err = client.Post(ts.URL, "application/json", strings.NewReader(`{"q":1}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "a plain POST is sent once")
+	assert.Equal(t, int32(1), calls)
+	resp.Body.Close()
+
+	reset()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader(`{"q":1}`))
+	req.Header["Idempotency-Key"] = nil
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{`{"q":1}`, `{"q":1}`, `{"q":1}`}, bodies, "the body is sent again")
+	resp.Body.Close()
+
+	reset()
+	req, _ = http.NewRequestWithContext(withRetries(context.Background()), http.MethodPost, ts.URL, strings.NewReader(`{"q":1}`))
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "a POST the caller allowed to retry")
+	assert.Equal(t, int32(3), calls)
+	resp.Body.Close()
+
+	reset()
+	failures = 5
+	resp, err = client.Get(ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "out of attempts")
+	assert.Equal(t, int32(3), calls)
+	resp.Body.Close()
+
+	reset()
+	status = http.StatusNotFound
+	resp, err = client.Get(ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), calls, "not worth retrying")
+	resp.Body.Close()
+
+	reset()
+	status, retryAfterHeader = http.StatusTooManyRequests, "60"
+	resp, err = client.Get(ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "asked to wait too long")
+	assert.Equal(t, int32(1), calls)
+	resp.Body.Close()
+}
+
+func TestNewUpstreamClient_cancel(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	client := NewUpstreamClient(UpstreamConfig{MaxAttempts: 3})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+
+	start := time.Now()
+	_, err := client.Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second, "neither waited out nor retried")
+}
+
+func Test_jitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		assert.GreaterOrEqual(t, d, 500*time.Millisecond)
+		assert.LessOrEqual(t, d, time.Second)
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth/v5"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxPlaces           = 100
+	placeLabelMaxLength = 64
+
+	historySearch  = "search"
+	historyGeocode = "geocode"
+)
+
+var (
+	ErrPlaceNotFound = errors.New("place not found")
+	errTooManyPlaces = errors.New("too many places")
+)
+
+// HistoryEntry is a search or geocode request of a user with its answer.
+//
+// swagger:model historyEntry
+type HistoryEntry struct {
+	// search or geocode
+	//
+	// example: search
+	Kind string `json:"kind"`
+	// the query of a search
+	//
+	// example: Москва
+	Query string `json:"query,omitempty"`
+	// the point of a geocode request
+	Lat *float64 `json:"lat,omitempty"`
+	Lng *float64 `json:"lng,omitempty"`
+	// the addresses found, without details
+	Addresses []*Address `json:"addresses"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Place is an address a user saved under a label of their own.
+//
+// swagger:model place
+type Place struct {
+	// example: 9f86d081884c7d659a2feaa0c55ad015
+	ID string `json:"id"`
+	// example: Дом
+	Label string `json:"label"`
+	// example: г Москва, ул Сухонская, д 11
+	Address   string    `json:"address"`
+	Lat       float64   `json:"lat"`
+	Lon       float64   `json:"lon"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// UserDataStore keeps the search history and saved places of every user,
+// each user only ever reaches their own by login.
+// Implementations must be safe for concurrent use.
+type UserDataStore interface {
+	// AddHistory records an entry of login, the oldest ones past the limit
+	// of the store are dropped.
+	AddHistory(ctx context.Context, login string, entry HistoryEntry) error
+	// ListHistory returns the history of login, newest first.
+	ListHistory(ctx context.Context, login string) ([]HistoryEntry, error)
+	ClearHistory(ctx context.Context, login string) error
+	// ListPlaces returns the places of login ordered by creation time.
+	ListPlaces(ctx context.Context, login string) ([]Place, error)
+	// GetPlace returns the place id of login or ErrPlaceNotFound.
+	GetPlace(ctx context.Context, login, id string) (Place, error)
+	// CreatePlace stores a new place, or returns errTooManyPlaces once login
+	// has maxPlaces of them.
+	CreatePlace(ctx context.Context, login string, place Place) error
+	// UpdatePlace replaces the label and address of a place, keeping its id
+	// and creation time, or returns ErrPlaceNotFound.
+	UpdatePlace(ctx context.Context, login string, place Place) (Place, error)
+	// DeletePlace removes the place id of login or returns ErrPlaceNotFound.
+	DeletePlace(ctx context.Context, login, id string) error
+	// DeleteByLogin removes everything kept for login.
+	DeleteByLogin(ctx context.Context, login string) error
+}
+
+// userData is replaced in main by the configured store.
+var userData UserDataStore = NewMemoryUserDataStore(defaultHistoryLimit)
+
+// newUserDataStore builds the store matching cfg.UserStore, the data lives as
+// long as its user.
+func newUserDataStore(cfg *Config) (UserDataStore, error) {
+	switch cfg.UserStore {
+	case "", "memory":
+		return NewMemoryUserDataStore(cfg.HistoryLimit), nil
+	case "file":
+		return NewFileUserDataStore(cfg.UserDataStorePath, cfg.HistoryLimit)
+	default:
+		return nil, fmt.Errorf("unknown user store %q", cfg.UserStore)
+	}
+}
+
+type userRecord struct {
+	History []HistoryEntry `json:"history"`
+	Places  []Place        `json:"places"`
+}
+
+// MemoryUserDataStore keeps user data in process memory, it is lost on restart.
+type MemoryUserDataStore struct {
+	mu           sync.RWMutex
+	records      map[string]*userRecord
+	historyLimit int
+	// save, when set, persists the changed records before they become visible.
+	save func(records map[string]*userRecord) error
+}
+
+// NewMemoryUserDataStore keeps the newest historyLimit entries of each user.
+func NewMemoryUserDataStore(historyLimit int) *MemoryUserDataStore {
+	if historyLimit <= 0 {
+		historyLimit = defaultHistoryLimit
+	}
+	return &MemoryUserDataStore{records: make(map[string]*userRecord), historyLimit: historyLimit}
+}
+
+func (m *MemoryUserDataStore) AddHistory(_ context.Context, login string, entry HistoryEntry) error {
+	return m.mutate(login, func(rec *userRecord) error {
+		n := minInt(len(rec.History)+1, m.historyLimit)
+		rec.History = append([]HistoryEntry{entry}, rec.History[:n-1]...)
+		return nil
+	})
+}
+
+func (m *MemoryUserDataStore) ListHistory(_ context.Context, login string) ([]HistoryEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := []HistoryEntry{}
+	if rec, ok := m.records[login]; ok {
+		list = append(list, rec.History...)
+	}
+	return list, nil
+}
+
+func (m *MemoryUserDataStore) ClearHistory(_ context.Context, login string) error {
+	return m.mutate(login, func(rec *userRecord) error {
+		rec.History = nil
+		return nil
+	})
+}
+
+func (m *MemoryUserDataStore) ListPlaces(_ context.Context, login string) ([]Place, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := []Place{}
+	if rec, ok := m.records[login]; ok {
+		list = append(list, rec.Places...)
+	}
+	return list, nil
+}
+
+func (m *MemoryUserDataStore) GetPlace(_ context.Context, login, id string) (Place, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if rec, ok := m.records[login]; ok {
+		for _, p := range rec.Places {
+			if p.ID == id {
+				return p, nil
+			}
+		}
+	}
+	return Place{}, ErrPlaceNotFound
+}
+
+func (m *MemoryUserDataStore) CreatePlace(_ context.Context, login string, place Place) error {
+	return m.mutate(login, func(rec *userRecord) error {
+		if len(rec.Places) >= maxPlaces {
+			return errTooManyPlaces
+		}
+		rec.Places = append(rec.Places, place)
+		return nil
+	})
+}
+
+func (m *MemoryUserDataStore) UpdatePlace(_ context.Context, login string, place Place) (Place, error) {
+	err := m.mutate(login, func(rec *userRecord) error {
+		for i, p := range rec.Places {
+			if p.ID == place.ID {
+				place.CreatedAt = p.CreatedAt
+				rec.Places[i] = place
+				return nil
+			}
+		}
+		return ErrPlaceNotFound
+	})
+	return place, err
+}
+
+func (m *MemoryUserDataStore) DeletePlace(_ context.Context, login, id string) error {
+	return m.mutate(login, func(rec *userRecord) error {
+		for i, p := range rec.Places {
+			if p.ID == id {
+				rec.Places = append(rec.Places[:i], rec.Places[i+1:]...)
+				return nil
+			}
+		}
+		return ErrPlaceNotFound
+	})
+}
+
+func (m *MemoryUserDataStore) DeleteByLogin(_ context.Context, login string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.records[login]; !ok {
+		return nil
+	}
+	next := make(map[string]*userRecord, len(m.records))
+	for k, v := range m.records {
+		if k != login {
+			next[k] = v
+		}
+	}
+	if m.save != nil {
+		if err := m.save(next); err != nil {
+			return err
+		}
+	}
+	m.records = next
+	return nil
+}
+
+// mutate applies fn to a copy of the record of login and swaps it in once
+// saved, so a failed save or fn leaves the store unchanged. Records are never
+// changed in place, readers may hold on to them.
+func (m *MemoryUserDataStore) mutate(login string, fn func(rec *userRecord) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec := &userRecord{}
+	if old, ok := m.records[login]; ok {
+		rec.History = append([]HistoryEntry(nil), old.History...)
+		rec.Places = append([]Place(nil), old.Places...)
+	}
+	if err := fn(rec); err != nil {
+		return err
+	}
+
+	next := m.records
+	if m.save != nil {
+		next = make(map[string]*userRecord, len(m.records)+1)
+		for k, v := range m.records {
+			next[k] = v
+		}
+	}
+	next[login] = rec
+	if m.save != nil {
+		if err := m.save(next); err != nil {
+			return err
+		}
+		m.records = next
+	}
+	return nil
+}
+
+// FileUserDataStore persists every change to a JSON file.
+type FileUserDataStore struct {
+	*MemoryUserDataStore
+	path string
+}
+
+// NewFileUserDataStore loads user data from path, a missing file is an empty store.
+func NewFileUserDataStore(path string, historyLimit int) (*FileUserDataStore, error) {
+	f := &FileUserDataStore{MemoryUserDataStore: NewMemoryUserDataStore(historyLimit), path: path}
+	if err := readJSONFile(path, &f.records); err != nil {
+		return nil, fmt.Errorf("load user data store: %w", err)
+	}
+	if f.records == nil {
+		f.records = make(map[string]*userRecord)
+	}
+	f.save = f.flush
+	return f, nil
+}
+
+func (f *FileUserDataStore) flush(records map[string]*userRecord) error {
+	if err := writeJSONFile(f.path, records); err != nil {
+		return fmt.Errorf("save user data store: %w", err)
+	}
+	return nil
+}
+
+// recordHistory adds a search or geocode request of the caller to their
+// history. It never fails the request, errors are only logged.
+func recordHistory(r *http.Request, entry HistoryEntry) {
+	token, _, _ := jwtauth.FromContext(r.Context())
+	if token == nil || token.Subject() == "" {
+		return
+	}
+	entry.Addresses = viewAddresses(entry.Addresses, addressViewFlat)
+	if entry.Addresses == nil {
+		entry.Addresses = []*Address{}
+	}
+	entry.CreatedAt = time.Now().UTC()
+	if err := userData.AddHistory(r.Context(), token.Subject(), entry); err != nil {
+		log.Printf("userdata.go: add history: %v", err)
+	}
+}
+
+func meLogin(r *http.Request) string {
+	token, _, _ := jwtauth.FromContext(r.Context())
+	return token.Subject()
+}
+
+func handleListHistory(w http.ResponseWriter, r *http.Request) {
+	history, err := userData.ListHistory(r.Context(), meLogin(r))
+	if err != nil {
+		log.Printf("userdata.go: list history: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+func handleClearHistory(w http.ResponseWriter, r *http.Request) {
+	if err := userData.ClearHistory(r.Context(), meLogin(r)); err != nil {
+		log.Printf("userdata.go: clear history: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// swagger:model placeInput
+type placeInput struct {
+	// required: true
+	// max length: 64
+	// example: Дом
+	Label string `json:"label"`
+	// required: true
+	// example: г Москва, ул Сухонская, д 11
+	Address string `json:"address"`
+	// latitude, a number or a numeric string
+	//
+	// required: true
+	// example: 55.8787
+	Lat Coordinate `json:"lat"`
+	// longitude, a number or a numeric string
+	//
+	// required: true
+	// example: 37.6523
+	Lon Coordinate `json:"lon"`
+}
+
+// readPlaceInput decodes and checks the body of a create or update request,
+// answering the client itself when it is not acceptable.
+func readPlaceInput(w http.ResponseWriter, r *http.Request) (Place, bool) {
+	var reqInput placeInput
+	err := json.NewDecoder(r.Body).Decode(&reqInput)
+	defer r.Body.Close()
+	if err != nil {
+		writeError(w, "bad request: invalid place", http.StatusBadRequest)
+		return Place{}, false
+	}
+
+	var fields []FieldError
+	label := strings.TrimSpace(reqInput.Label)
+	if label == "" || len([]rune(label)) > placeLabelMaxLength {
+		fields = append(fields, FieldError{Field: "label", Message: fmt.Sprintf("must be 1 to %d characters long", placeLabelMaxLength)})
+	}
+	address := strings.TrimSpace(reqInput.Address)
+	if address == "" {
+		fields = append(fields, FieldError{Field: "address", Message: "is required"})
+	}
+	fields = append(fields, checkCoordinate("lat", reqInput.Lat, 90)...)
+	fields = append(fields, checkCoordinate("lon", reqInput.Lon, 180)...)
+	if len(fields) > 0 {
+		writeValidationError(w, fields, http.StatusUnprocessableEntity)
+		return Place{}, false
+	}
+
+	now := time.Now().UTC()
+	return Place{Label: label, Address: address, Lat: reqInput.Lat.Value, Lon: reqInput.Lon.Value, CreatedAt: now, UpdatedAt: now}, true
+}
+
+func handleListPlaces(w http.ResponseWriter, r *http.Request) {
+	places, err := userData.ListPlaces(r.Context(), meLogin(r))
+	if err != nil {
+		log.Printf("userdata.go: list places: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, places)
+}
+
+func handleCreatePlace(w http.ResponseWriter, r *http.Request) {
+	place, ok := readPlaceInput(w, r)
+	if !ok {
+		return
+	}
+	id, err := newTokenID()
+	if err != nil {
+		log.Printf("userdata.go: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	place.ID = id
+
+	err = userData.CreatePlace(r.Context(), meLogin(r), place)
+	if errors.Is(err, errTooManyPlaces) {
+		writeError(w, fmt.Sprintf("At most %d places can be saved", maxPlaces), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("userdata.go: create place: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, place)
+}
+
+func handleGetPlace(w http.ResponseWriter, r *http.Request) {
+	place, err := userData.GetPlace(r.Context(), meLogin(r), chi.URLParam(r, "id"))
+	if errors.Is(err, ErrPlaceNotFound) {
+		writeError(w, "Place not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("userdata.go: get place: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, place)
+}
+
+func handleUpdatePlace(w http.ResponseWriter, r *http.Request) {
+	place, ok := readPlaceInput(w, r)
+	if !ok {
+		return
+	}
+	place.ID = chi.URLParam(r, "id")
+
+	place, err := userData.UpdatePlace(r.Context(), meLogin(r), place)
+	if errors.Is(err, ErrPlaceNotFound) {
+		writeError(w, "Place not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("userdata.go: update place: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, place)
+}
+
+func handleDeletePlace(w http.ResponseWriter, r *http.Request) {
+	err := userData.DeletePlace(r.Context(), meLogin(r), chi.URLParam(r, "id"))
+	if errors.Is(err, ErrPlaceNotFound) {
+		writeError(w, "Place not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("userdata.go: delete place: %v", err)
+		writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
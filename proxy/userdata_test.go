@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryUserDataStore_history(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryUserDataStore(2)
+	for _, q := range []string{"first", "second", "third"} {
+		assert.NoError(t, m.AddHistory(ctx, "a", HistoryEntry{Kind: historySearch, Query: q}))
+	}
+	m.AddHistory(ctx, "b", HistoryEntry{Kind: historySearch, Query: "other"})
+
+	history, _ := m.ListHistory(ctx, "a")
+	assert.Equal(t, []HistoryEntry{{Kind: historySearch, Query: "third"}, {Kind: historySearch, Query: "second"}}, history)
+
+	assert.NoError(t, m.ClearHistory(ctx, "a"))
+	history, _ = m.ListHistory(ctx, "a")
+	assert.Empty(t, history)
+	history, _ = m.ListHistory(ctx, "b")
+	assert.Len(t, history, 1, "only a's history is gone")
+}
+
+func TestFileUserDataStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "user_data.json")
+	f, err := NewFileUserDataStore(path, 10)
+	assert.NoError(t, err)
+
+	assert.NoError(t, f.CreatePlace(ctx, "a", Place{ID: "1", Label: "Дом", Address: "г Москва"}))
+	assert.NoError(t, f.AddHistory(ctx, "a", HistoryEntry{Kind: historySearch, Query: "Москва"}))
+	_, err = f.UpdatePlace(ctx, "a", Place{ID: "2", Label: "Работа"})
+	assert.ErrorIs(t, err, ErrPlaceNotFound)
+	_, err = f.GetPlace(ctx, "b", "1")
+	assert.ErrorIs(t, err, ErrPlaceNotFound, "places are found by their owner only")
+
+	f, err = NewFileUserDataStore(path, 10)
+	assert.NoError(t, err)
+	place, err := f.GetPlace(ctx, "a", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "Дом", place.Label)
+	history, _ := f.ListHistory(ctx, "a")
+	assert.Len(t, history, 1)
+
+	assert.NoError(t, f.DeleteByLogin(ctx, "a"))
+	f, _ = NewFileUserDataStore(path, 10)
+	places, _ := f.ListPlaces(ctx, "a")
+	assert.Empty(t, places)
+}
+
+func Test_handleUserData(t *testing.T) {
+	savedData, savedProvider := userData, geoProvider
+	userData = NewMemoryUserDataStore(defaultHistoryLimit)
+	geoProvider = &fakeGeoProvider{addresses: []*Address{
+		{Address: "г Москва, ул Сухонская, д 11", Lat: 55.8787, Lon: 37.6523, Details: &AddressDetails{House: "д 11"}},
+	}}
+	defer func() { userData, geoProvider = savedData, savedProvider }()
+
+	router := getProxyRouter("http://hugo", ":1313")
+	ts := httptest.NewServer(router.r)
+	defer ts.Close()
+
+	owner := "Bearer " + issueTestToken(t, User{Login: "PlacesUser", Roles: []string{RoleUser}})
+	other := "Bearer " + issueTestToken(t, User{Login: "PlacesOther", Roles: []string{RoleUser}})
+	do := func(token, method, url, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		req.Header.Set("Authorization", token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		return res, buf.String()
+	}
+
+	do(owner, "POST", "/api/address/search?view=detailed", `{"query":" Сухонская "}`)
+	do(owner, "POST", "/api/address/geocode", `{"lat":"55.8787","lng":37.6523}`)
+	res, body := do(owner, "GET", "/api/me/history", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var history []HistoryEntry
+	assert.NoError(t, json.Unmarshal([]byte(body), &history))
+	assert.Len(t, history, 2)
+	assert.Equal(t, historyGeocode, history[0].Kind)
+	assert.Equal(t, 55.8787, *history[0].Lat)
+	assert.Equal(t, historySearch, history[1].Kind)
+	assert.Equal(t, "Сухонская", history[1].Query)
+	assert.Equal(t, []*Address{{Address: "г Москва, ул Сухонская, д 11", Lat: 55.8787, Lon: 37.6523}}, history[1].Addresses, "kept without details")
+
+	_, body = do(other, "GET", "/api/me/history", "")
+	assert.Equal(t, "[]", body, "every user sees their own history only")
+
+	res, body = do(owner, "POST", "/api/me/places", `{"label":" Дом ","address":"г Москва, ул Сухонская, д 11","lat":55.8787,"lon":"37.6523"}`)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	var place Place
+	assert.NoError(t, json.Unmarshal([]byte(body), &place))
+	assert.NotEmpty(t, place.ID)
+	assert.Equal(t, "Дом", place.Label)
+	assert.Equal(t, 37.6523, place.Lon)
+
+	res, body = do(owner, "POST", "/api/me/places", `{"label":"","lat":91}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+	assert.Equal(t, `{"error":"validation failed","fields":[`+
+		`{"field":"label","message":"must be 1 to 64 characters long"},`+
+		`{"field":"address","message":"is required"},`+
+		`{"field":"lat","message":"must be between -90 and 90"},`+
+		`{"field":"lon","message":"is required"}]}`, body)
+
+	res, _ = do(other, "GET", "/api/me/places/"+place.ID, "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = do(other, "PUT", "/api/me/places/"+place.ID, `{"label":"Чужой","address":"г Москва","lat":55,"lon":37}`)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = do(other, "DELETE", "/api/me/places/"+place.ID, "")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	_, body = do(other, "GET", "/api/me/places", "")
+	assert.Equal(t, "[]", body)
+
+	res, body = do(owner, "PUT", "/api/me/places/"+place.ID, `{"label":"Дача","address":"Московская обл","lat":56,"lon":38}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var updated Place
+	assert.NoError(t, json.Unmarshal([]byte(body), &updated))
+	assert.Equal(t, place.ID, updated.ID)
+	assert.Equal(t, "Дача", updated.Label)
+	assert.Equal(t, place.CreatedAt, updated.CreatedAt)
+
+	res, body = do(owner, "GET", "/api/me/places/"+place.ID, "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, body, `"label":"Дача"`)
+
+	res, _ = do(owner, "DELETE", "/api/me/places/"+place.ID, "")
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, body = do(owner, "GET", "/api/me/places", "")
+	assert.Equal(t, "[]", body)
+
+	res, _ = do(owner, "DELETE", "/api/me/history", "")
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, body = do(owner, "GET", "/api/me/history", "")
+	assert.Equal(t, "[]", body)
+
+	_, body = do(owner, "POST", "/api/me/keys", `{"name":"search only","scopes":["address:search"]}`)
+	var key apiKeyInfo
+	assert.NoError(t, json.Unmarshal([]byte(body), &key))
+	for _, method := range []string{"GET", "DELETE"} {
+		req, _ := http.NewRequest(method, ts.URL+"/api/me/history", nil)
+		req.Header.Set(apiKeyHeader, key.Key)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusForbidden, res.StatusCode, "a key without the me scopes, %s", method)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// User is a registered account as kept by a UserRepository.
+// Password holds the bcrypt hash, never the plain text, and must not leave the store.
+// Scopes are granted on top of the ones the roles carry.
+// Tokens issued before TokensValidAfter are no longer accepted.
+type User struct {
+	Login            string    `json:"login"`
+	Password         string    `json:"password"`
+	Roles            []string  `json:"roles"`
+	Scopes           []string  `json:"scopes,omitempty"`
+	Disabled         bool      `json:"disabled,omitempty"`
+	TokensValidAfter time.Time `json:"tokens_valid_after,omitempty"`
+}
+
+// UserRepository stores registered accounts.
+// Implementations must be safe for concurrent use.
+type UserRepository interface {
+	// Create stores a new user, ErrUserExists is returned if the login is taken.
+	Create(ctx context.Context, user User) error
+	// GetByLogin returns the user with the given login or ErrUserNotFound.
+	GetByLogin(ctx context.Context, login string) (User, error)
+	// Update replaces the stored user with the same login or returns ErrUserNotFound.
+	Update(ctx context.Context, user User) error
+	// Delete removes the user with the given login or returns ErrUserNotFound.
+	Delete(ctx context.Context, login string) error
+	// List returns up to limit users ordered by login starting at offset,
+	// along with the total number of users.
+	List(ctx context.Context, offset, limit int) ([]User, int, error)
+}
+
+// newUserRepository builds the repository selected by cfg.UserStore.
+func newUserRepository(cfg *Config) (UserRepository, error) {
+	switch cfg.UserStore {
+	case "", "memory":
+		return NewMemoryUserRepository(), nil
+	case "file":
+		return NewFileUserRepository(cfg.UserStorePath)
+	default:
+		return nil, fmt.Errorf("unknown user store %q", cfg.UserStore)
+	}
+}
+
+// bcryptCost is the cost of newly hashed passwords.
+var bcryptCost = bcrypt.DefaultCost
+
+// hashPassword returns the bcrypt hash of password.
+func hashPassword(password string) (string, error) {
+	pass, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", fmt.Errorf("hash password: %w", err)
+	}
+	return string(pass), nil
+}
+
+// ensureAdmin creates the bootstrap admin account unless login is already taken.
+func ensureAdmin(ctx context.Context, repo UserRepository, login, password string) error {
+	if password == "" {
+		return errors.New("admin password is empty")
+	}
+	pass, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	err = repo.Create(ctx, User{Login: login, Password: pass, Roles: []string{RoleUser, RoleAdmin}})
+	if errors.Is(err, ErrUserExists) {
+		return nil
+	}
+	return err
+}
+
+// MemoryUserRepository keeps users in process memory, they are lost on restart.
+type MemoryUserRepository struct {
+	mu    sync.RWMutex
+	users map[string]User
+	// save, when set, persists the changed set of users before it becomes visible.
+	save func(users map[string]User) error
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{users: make(map[string]User)}
+}
+
+func (m *MemoryUserRepository) Create(_ context.Context, user User) error {
+	return m.mutate(func(users map[string]User) error {
+		if _, ok := users[user.Login]; ok {
+			return ErrUserExists
+		}
+		users[user.Login] = user
+		return nil
+	})
+}
+
+func (m *MemoryUserRepository) GetByLogin(_ context.Context, login string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[login]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (m *MemoryUserRepository) Update(_ context.Context, user User) error {
+	return m.mutate(func(users map[string]User) error {
+		if _, ok := users[user.Login]; !ok {
+			return ErrUserNotFound
+		}
+		users[user.Login] = user
+		return nil
+	})
+}
+
+func (m *MemoryUserRepository) Delete(_ context.Context, login string) error {
+	return m.mutate(func(users map[string]User) error {
+		if _, ok := users[login]; !ok {
+			return ErrUserNotFound
+		}
+		delete(users, login)
+		return nil
+	})
+}
+
+func (m *MemoryUserRepository) List(_ context.Context, offset, limit int) ([]User, int, error) {
+	m.mu.RLock()
+	list := sortedUsers(m.users)
+	m.mu.RUnlock()
+
+	total := len(list)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if limit <= 0 || end > total {
+		end = total
+	}
+	return list[offset:end], total, nil
+}
+
+func sortedUsers(users map[string]User) []User {
+	list := make([]User, 0, len(users))
+	for _, u := range users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Login < list[j].Login })
+	return list
+}
+
+// mutate applies fn to a copy of the users and swaps it in once saved,
+// so a failed save leaves the repository unchanged.
+func (m *MemoryUserRepository) mutate(fn func(users map[string]User) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.save == nil {
+		return fn(m.users)
+	}
+
+	next := make(map[string]User, len(m.users)+1)
+	for k, v := range m.users {
+		next[k] = v
+	}
+	if err := fn(next); err != nil {
+		return err
+	}
+	if err := m.save(next); err != nil {
+		return err
+	}
+	m.users = next
+	return nil
+}
+
+// FileUserRepository persists every change to a JSON file,
+// so accounts survive a restart of the proxy.
+type FileUserRepository struct {
+	*MemoryUserRepository
+	path string
+}
+
+// NewFileUserRepository loads users from path, a missing file is an empty store.
+func NewFileUserRepository(path string) (*FileUserRepository, error) {
+	f := &FileUserRepository{MemoryUserRepository: NewMemoryUserRepository(), path: path}
+
+	var users []User
+	if err := readJSONFile(path, &users); err != nil {
+		return nil, fmt.Errorf("load user store: %w", err)
+	}
+	for _, u := range users {
+		f.users[u.Login] = u
+	}
+	f.save = f.flush
+
+	return f, nil
+}
+
+func (f *FileUserRepository) flush(users map[string]User) error {
+	if err := writeJSONFile(f.path, sortedUsers(users)); err != nil {
+		return fmt.Errorf("save user store: %w", err)
+	}
+	return nil
+}
+
+// readJSONFile decodes path into v, a missing or empty file leaves v untouched.
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeJSONFile encodes v into a temporary file and renames it over path,
+// so a crash never leaves a half written file behind.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
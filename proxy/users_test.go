@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UserRepository(t *testing.T) {
+	fileRepo, err := NewFileUserRepository(filepath.Join(t.TempDir(), "users.json"))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		repo UserRepository
+	}{
+		{"memory", NewMemoryUserRepository()},
+		{"file", fileRepo},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			_, err := tt.repo.GetByLogin(ctx, "User1")
+			assert.ErrorIs(t, err, ErrUserNotFound)
+
+			assert.NoError(t, tt.repo.Create(ctx, User{Login: "User1", Password: "hash"}))
+			assert.ErrorIs(t, tt.repo.Create(ctx, User{Login: "User1", Password: "other"}), ErrUserExists)
+
+			user, err := tt.repo.GetByLogin(ctx, "User1")
+			assert.NoError(t, err)
+			assert.Equal(t, User{Login: "User1", Password: "hash"}, user)
+
+			assert.NoError(t, tt.repo.Update(ctx, User{Login: "User1", Password: "hash", Disabled: true}))
+			assert.ErrorIs(t, tt.repo.Update(ctx, User{Login: "User2"}), ErrUserNotFound)
+			user, _ = tt.repo.GetByLogin(ctx, "User1")
+			assert.True(t, user.Disabled)
+
+			assert.NoError(t, tt.repo.Create(ctx, User{Login: "User0"}))
+			page, total, err := tt.repo.List(ctx, 1, 5)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, total)
+			assert.Equal(t, []User{user}, page)
+
+			assert.NoError(t, tt.repo.Delete(ctx, "User0"))
+			assert.ErrorIs(t, tt.repo.Delete(ctx, "User0"), ErrUserNotFound)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					login := fmt.Sprintf("user%d", i)
+					assert.NoError(t, tt.repo.Create(ctx, User{Login: login}))
+					_, err := tt.repo.GetByLogin(ctx, login)
+					assert.NoError(t, err)
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func Test_FileUserRepositoryReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "users.json")
+	ctx := context.Background()
+
+	repo, err := NewFileUserRepository(path)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.Create(ctx, User{Login: "User1", Password: "hash"}))
+
+	reloaded, err := NewFileUserRepository(path)
+	assert.NoError(t, err)
+	user, err := reloaded.GetByLogin(ctx, "User1")
+	assert.NoError(t, err)
+	assert.Equal(t, "hash", user.Password)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//go:embed common-passwords.txt
+var commonPasswords string
+
+var loginPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+const (
+	loginMinLength = 3
+	loginMaxLength = 32
+
+	defaultPasswordMinLength = 8
+	// bcrypt ignores everything past 72 bytes.
+	passwordMaxLength = 72
+
+	queryMinLength = 2
+)
+
+// swagger:model fieldError
+type FieldError struct {
+	// name of the offending field
+	//
+	// example: password
+	Field string `json:"field"`
+	// what is wrong with it
+	//
+	// example: must be at least 8 characters long
+	Message string `json:"message"`
+}
+
+// swagger:model validationErrorResponse
+type ValidationErrorResponse struct {
+	// required: true
+	// example: validation failed
+	Message string `json:"error"`
+	// every failed check, a field may appear more than once
+	Fields []FieldError `json:"fields"`
+}
+
+// writeValidationError sends fields as a validationErrorResponse with the given status code.
+func writeValidationError(w http.ResponseWriter, fields []FieldError, code int) {
+	writeJSON(w, code, ValidationErrorResponse{Message: "validation failed", Fields: fields})
+}
+
+// passwordPolicy is replaced in main by the configured one.
+var passwordPolicy, _ = NewPasswordPolicy(&Config{PasswordMinLength: defaultPasswordMinLength, PasswordRequireDigit: true})
+
+// PasswordPolicy decides which passwords are acceptable.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// breached holds known leaked passwords, lower cased.
+	breached map[string]struct{}
+}
+
+// NewPasswordPolicy returns the policy described by cfg. The built-in list of
+// common passwords is always rejected, cfg.PasswordBlocklistPath adds more,
+// one password per line.
+func NewPasswordPolicy(cfg *Config) (*PasswordPolicy, error) {
+	p := &PasswordPolicy{
+		MinLength:     cfg.PasswordMinLength,
+		RequireUpper:  cfg.PasswordRequireUpper,
+		RequireLower:  cfg.PasswordRequireLower,
+		RequireDigit:  cfg.PasswordRequireDigit,
+		RequireSymbol: cfg.PasswordRequireSymbol,
+		breached:      make(map[string]struct{}),
+	}
+	p.addBreached(strings.NewReader(commonPasswords))
+
+	if cfg.PasswordBlocklistPath != "" {
+		f, err := os.Open(cfg.PasswordBlocklistPath)
+		if err != nil {
+			return nil, fmt.Errorf("open password blocklist: %w", err)
+		}
+		defer f.Close()
+		if err := p.addBreached(f); err != nil {
+			return nil, fmt.Errorf("read password blocklist: %w", err)
+		}
+	}
+	return p, nil
+}
+
+func (p *PasswordPolicy) addBreached(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if v := strings.TrimSpace(sc.Text()); v != "" {
+			p.breached[strings.ToLower(v)] = struct{}{}
+		}
+	}
+	return sc.Err()
+}
+
+// Check returns every rule password breaks, login is used to reject
+// passwords equal to it.
+func (p *PasswordPolicy) Check(login, password string) []FieldError {
+	var errs []FieldError
+	add := func(msg string) {
+		errs = append(errs, FieldError{Field: "password", Message: msg})
+	}
+
+	if n := len([]rune(password)); n < p.MinLength {
+		add(fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+	if len(password) > passwordMaxLength {
+		add(fmt.Sprintf("must be at most %d bytes long", passwordMaxLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		add("must contain an upper case letter")
+	}
+	if p.RequireLower && !lower {
+		add("must contain a lower case letter")
+	}
+	if p.RequireDigit && !digit {
+		add("must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		add("must contain a symbol")
+	}
+
+	if login != "" && strings.EqualFold(password, login) {
+		add("must not be the same as the login")
+	}
+	if _, ok := p.breached[strings.ToLower(password)]; ok {
+		add("is too common, it appears in a list of breached passwords")
+	}
+	return errs
+}
+
+// checkLogin returns every rule login breaks.
+func checkLogin(login string) []FieldError {
+	var errs []FieldError
+	if n := len(login); n < loginMinLength || n > loginMaxLength {
+		errs = append(errs, FieldError{Field: "login", Message: fmt.Sprintf("must be %d to %d characters long", loginMinLength, loginMaxLength)})
+	}
+	if login != "" && !loginPattern.MatchString(login) {
+		errs = append(errs, FieldError{Field: "login", Message: "may only contain latin letters, digits, '.', '_' and '-'"})
+	}
+	return errs
+}
+
+// validateCredentials checks a new login and password against the rules.
+func validateCredentials(login, password string) []FieldError {
+	return append(checkLogin(login), passwordPolicy.Check(login, password)...)
+}
+
+// Coordinate is a latitude or longitude sent either as a JSON number or as a
+// string holding one. Anything else still decodes, so that the request can be
+// rejected with the offending field named, Valid tells the two apart.
+//
+// swagger:type number
+type Coordinate struct {
+	Value float64
+	// Set is false when the field was missing or null.
+	Set bool
+	// Valid is false when the field held something other than a finite number.
+	Valid bool
+}
+
+func (c *Coordinate) UnmarshalJSON(data []byte) error {
+	*c = Coordinate{}
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	c.Set = true
+
+	text := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return nil
+		}
+		text = strings.TrimSpace(text)
+	}
+	v, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	c.Value, c.Valid = v, true
+	return nil
+}
+
+func (c Coordinate) MarshalJSON() ([]byte, error) {
+	if !c.Set || !c.Valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(c.Value)
+}
+
+// checkCoordinate returns what is wrong with c, which must lie within ±limit.
+func checkCoordinate(field string, c Coordinate, limit float64) []FieldError {
+	switch {
+	case !c.Set:
+		return []FieldError{{Field: field, Message: "is required"}}
+	case !c.Valid:
+		return []FieldError{{Field: field, Message: "must be a number"}}
+	case c.Value < -limit || c.Value > limit:
+		return []FieldError{{Field: field, Message: fmt.Sprintf("must be between %v and %v", -limit, limit)}}
+	}
+	return nil
+}
+
+// validateSearchRequest returns every rule req breaks.
+func validateSearchRequest(req *SearchRequest) []FieldError {
+	var errs []FieldError
+	if utf8.RuneCountInString(strings.TrimSpace(req.Query)) < queryMinLength {
+		errs = append(errs, FieldError{Field: "query", Message: fmt.Sprintf("must be at least %d characters long", queryMinLength)})
+	}
+	if req.Bounds != nil {
+		errs = append(errs, checkBoundingBox("bounds", req.Bounds)...)
+	}
+	if req.Near != nil {
+		errs = append(errs, checkGeoPoint("near", req.Near)...)
+	}
+	return errs
+}
+
+// validateGeocodeRequest returns every rule req breaks.
+func validateGeocodeRequest(req *GeocodeRequest) []FieldError {
+	return append(checkCoordinate("lat", req.Lat, 90), checkCoordinate("lng", req.Lng, 180)...)
+}
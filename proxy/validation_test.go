@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PasswordPolicy(t *testing.T) {
+	blocklist := filepath.Join(t.TempDir(), "breached.txt")
+	assert.NoError(t, os.WriteFile(blocklist, []byte("Leaked-Pass-1\n\n"), 0o600))
+
+	policy, err := NewPasswordPolicy(&Config{
+		PasswordMinLength:     10,
+		PasswordRequireUpper:  true,
+		PasswordRequireLower:  true,
+		PasswordRequireDigit:  true,
+		PasswordRequireSymbol: true,
+		PasswordBlocklistPath: blocklist,
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		login    string
+		password string
+		want     []string
+	}{
+		{"ok", "user1", "Str0ng-Enough", nil},
+		{"short", "user1", "Sh0rt-1", []string{"must be at least 10 characters long"}},
+		{"classes", "user1", "alllowercase", []string{"must contain an upper case letter", "must contain a digit", "must contain a symbol"}},
+		{"login", "Abcdefgh-1", "abcdefgh-1", []string{"must contain an upper case letter", "must not be the same as the login"}},
+		{"blocklist", "user1", "leaked-pass-1", []string{"must contain an upper case letter", "is too common, it appears in a list of breached passwords"}},
+		{"builtin", "user1", "Password123!", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range policy.Check(tt.login, tt.password) {
+				assert.Equal(t, "password", e.Field)
+				got = append(got, e.Message)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err = NewPasswordPolicy(&Config{PasswordBlocklistPath: filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
+
+func Test_checkLogin(t *testing.T) {
+	tests := []struct {
+		login string
+		want  int
+	}{
+		{"user1", 0},
+		{"us", 1},
+		{"user name", 1},
+		{"пользователь", 1},
+		{"a-very-long-login-that-does-not-fit", 1},
+		{"a.b_c-d", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.login, func(t *testing.T) {
+			assert.Len(t, checkLogin(tt.login), tt.want)
+		})
+	}
+}
+
+func Test_validateGeocodeRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []FieldError
+	}{
+		{"strings", `{"lat":"55.7522","lng":" 37.6156 "}`, nil},
+		{"numbers", `{"lat":-90,"lng":180}`, nil},
+		{"missing", `{"lng":null}`, []FieldError{{"lat", "is required"}, {"lng", "is required"}}},
+		{"not numbers", `{"lat":"","lng":{"x":1}}`, []FieldError{{"lat", "must be a number"}, {"lng", "must be a number"}}},
+		{"not finite", `{"lat":"NaN","lng":"Inf"}`, []FieldError{{"lat", "must be a number"}, {"lng", "must be a number"}}},
+		{"out of range", `{"lat":90.5,"lng":"-180.1"}`, []FieldError{{"lat", "must be between -90 and 90"}, {"lng", "must be between -180 and 180"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req GeocodeRequest
+			assert.NoError(t, json.Unmarshal([]byte(tt.body), &req))
+			assert.Equal(t, tt.want, validateGeocodeRequest(&req))
+		})
+	}
+}
+
+func Test_validateSearchRequest(t *testing.T) {
+	assert.Nil(t, validateSearchRequest(&SearchRequest{Query: "ул"}))
+	assert.Equal(t, []FieldError{{"query", "must be at least 2 characters long"}}, validateSearchRequest(&SearchRequest{Query: " ё  "}))
+}